@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mobchat/encryption"
+	"mobchat/node"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//A backup file holds the node key as exported from the keystore and a
+//section for each package that registered one, such as the contacts and
+//group memberships. The whole file is sealed with the node passphrase.
+//Sessions are left out on purpose, they are restarted after a restore
+
+const version = 1
+
+//Section - how a package exports and restores its part of a backup
+type Section struct {
+	Export  func() ([]byte, error)
+	Restore func([]byte) error
+}
+
+//Backup - contents of a backup file
+type Backup struct {
+	Version  int
+	Created  time.Time
+	NodeID   []byte
+	Key      []byte //from node.ExportKey, still protected by the passphrase
+	Sections map[string][]byte
+}
+
+var (
+	_sections = make(map[string]Section)
+	bmutex    = sync.Mutex{}
+)
+
+//Register - adds a named section to all backups
+func Register(name string, section Section) {
+	bmutex.Lock()
+	_sections[name] = section
+	bmutex.Unlock()
+}
+
+//Write - creates a backup file at path. Call after node.Initialize and the
+//Initialize of the packages with sections
+func Write(path string, passphrase string) error {
+	key, err := node.ExportKey()
+	if err != nil {
+		return err
+	}
+	b := Backup{
+		Version:  version,
+		Created:  time.Now(),
+		NodeID:   node.ID(),
+		Key:      key,
+		Sections: make(map[string][]byte),
+	}
+	bmutex.Lock()
+	for name, section := range _sections {
+		data, err := section.Export()
+		if err != nil {
+			bmutex.Unlock()
+			return errors.New("Backup of " + name + " failed: " + err.Error())
+		}
+		b.Sections[name] = data
+	}
+	bmutex.Unlock()
+	var buff bytes.Buffer
+	err = gob.NewEncoder(&buff).Encode(b)
+	if err != nil {
+		return err
+	}
+	sealed, err := encryption.SealWithPassphrase(passphrase, buff.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, sealed, 0600)
+}
+
+//Read - opens the backup file at path
+func Read(path string, passphrase string) (*Backup, error) {
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encryption.OpenWithPassphrase(passphrase, sealed)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Version > version {
+		return nil, errors.New("Backup was made by a newer version")
+	}
+	return b, nil
+}
+
+//RestoreKey - stores the backed up key as the node key. Call after
+//node.SetPassphrase and before node.Initialize
+func (b *Backup) RestoreKey() error {
+	return node.ImportKey(b.Key)
+}
+
+//RestoreSections - hands each section to the package that registered it.
+//Call after the Initialize of those packages. Sections nobody registered
+//are skipped
+func (b *Backup) RestoreSections() error {
+	names := make([]string, 0, len(b.Sections))
+	for name := range b.Sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failed []string
+	for _, name := range names {
+		bmutex.Lock()
+		section, exists := _sections[name]
+		bmutex.Unlock()
+		if !exists {
+			fmt.Println("skipping unknown backup section", name)
+			continue
+		}
+		err := section.Restore(b.Sections[name])
+		if err != nil {
+			fmt.Println("restoring", name, err)
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("Could not restore " + fmt.Sprint(failed))
+	}
+	return nil
+}
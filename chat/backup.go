@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/gob"
+	"mobchat/util"
+)
+
+//exportGroups - the groups section of a backup, with the event logs and
+//group keys so old messages stay readable after a restore
+func exportGroups() ([]byte, error) {
+	gmutex.Lock()
+	defer gmutex.Unlock()
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(_groups)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//restoreGroups - adds the backed up groups. A group that is known already
+//is only replaced if the backup has a longer version of the same log
+func restoreGroups(data []byte) error {
+	groups := make(map[string]*Group)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&groups)
+	if err != nil {
+		return err
+	}
+	gmutex.Lock()
+	for _, group := range groups {
+		existing, exists := _groups[util.ToHexString(group.ID)]
+		if exists && !(len(group.Log) > len(existing.Log) && isPrefix(existing.Log, group.Log)) {
+			for id, groupKey := range group.Keys {
+				if _, known := existing.Keys[id]; !known {
+					existing.installKey(id, groupKey)
+				}
+			}
+			continue
+		}
+		if exists {
+			for id, groupKey := range existing.Keys {
+				group.installKey(id, groupKey)
+			}
+		}
+		_groups[util.ToHexString(group.ID)] = group
+	}
+	gmutex.Unlock()
+	return saveGroups()
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"fmt"
+	"mobchat/backup"
+	"mobchat/config"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+)
+
+var (
+	_groups        = make(map[string]*Group)
+	_groupHandlers []func(GroupMessage)
+	gmutex         = sync.Mutex{}
+)
+
+type handler struct{}
+
+//Handle - routes direct messages meant for the chat package
+func (h handler) Handle(env node.Envelope) {
+	if len(env.Payload) == 0 {
+		return
+	}
+	switch env.Payload[0] {
+	case commands.PayloadGroupLog:
+		handleGroupLog(env)
+	case commands.PayloadGroupMessage:
+		if !handleGroupMessage(env) {
+			deferEnvelope(env.Payload[1:33], env)
+		}
+	case commands.PayloadGroupAction:
+		if !handleGroupAction(env) {
+			deferEnvelope(env.Payload[1:33], env)
+		}
+	case commands.PayloadGroupKey:
+		if !handleGroupKey(env) {
+			deferEnvelope(env.Payload[1:33], env)
+			return
+		}
+		err := saveGroups()
+		if err != nil {
+			fmt.Println(err)
+		}
+		retryPending(env.Payload[1:33])
+	}
+}
+
+//Initialize - loads stored groups and starts handling chat messages. Call
+//after node.Initialize
+func Initialize() error {
+	err := loadGroups()
+	if err != nil {
+		return err
+	}
+	err = loadHistory()
+	if err != nil {
+		return err
+	}
+	node.AddMessageHandler(handler{})
+	node.AddShutdownHook(saveGroups)
+	node.AddShutdownHook(saveHistory)
+	backup.Register("groups", backup.Section{Export: exportGroups, Restore: restoreGroups})
+	return nil
+}
+
+//AddGroupMessageHandler - registers a callback for incoming group messages
+func AddGroupMessageHandler(handler func(GroupMessage)) {
+	gmutex.Lock()
+	_groupHandlers = append(_groupHandlers, handler)
+	gmutex.Unlock()
+}
+
+func groupHandlers() []func(GroupMessage) {
+	gmutex.Lock()
+	defer gmutex.Unlock()
+	return _groupHandlers
+}
+
+func saveGroups() error {
+	gmutex.Lock()
+	defer gmutex.Unlock()
+	return util.SaveGob(config.Attr("groupsfile"), _groups)
+}
+
+func loadGroups() error {
+	groups := make(map[string]*Group)
+	err := util.LoadGob(config.Attr("groupsfile"), &groups)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	gmutex.Lock()
+	_groups = groups
+	gmutex.Unlock()
+	fmt.Println("loaded", len(groups), "groups")
+	return nil
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"mobchat/encryption"
+	"mobchat/node"
+)
+
+//EventKind - type of a group membership change
+type EventKind byte
+
+const (
+	//EventCreate - first event of every group, the actor becomes admin
+	EventCreate EventKind = 0x01
+	//EventAdd - an admin adds a member
+	EventAdd EventKind = 0x02
+	//EventRemove - an admin removes a member
+	EventRemove EventKind = 0x03
+	//EventLeave - a member leaves
+	EventLeave EventKind = 0x04
+	//EventAdminGrant - an admin makes a member admin
+	EventAdminGrant EventKind = 0x05
+)
+
+//event header: kind, group ID, actor, subject, timestamp, data length
+const eventHeaderLen = 1 + 32 + 32 + 32 + 8 + 2
+
+//Event - a membership change signed by the node that made it
+type Event struct {
+	Kind      EventKind
+	GroupID   []byte
+	Actor     []byte
+	Subject   []byte
+	Timestamp uint64
+	Data      []byte //group name for EventCreate
+	Sig       []byte
+}
+
+func (ev *Event) signedPart() []byte {
+	var buff bytes.Buffer
+	buff.WriteByte(byte(ev.Kind))
+	buff.Write(ev.GroupID)
+	buff.Write(ev.Actor)
+	buff.Write(ev.Subject)
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, ev.Timestamp)
+	buff.Write(ts)
+	ln := make([]byte, 2)
+	binary.BigEndian.PutUint16(ln, uint16(len(ev.Data)))
+	buff.Write(ln)
+	buff.Write(ev.Data)
+	return buff.Bytes()
+}
+
+//Serialize -
+func (ev *Event) Serialize() []byte {
+	return append(ev.signedPart(), ev.Sig...)
+}
+
+//DeserializeEvent -
+func DeserializeEvent(data []byte) (Event, error) {
+	if len(data) < eventHeaderLen {
+		return Event{}, errors.New("Invalid event length")
+	}
+	ln := int(binary.BigEndian.Uint16(data[eventHeaderLen-2 : eventHeaderLen]))
+	if len(data) < eventHeaderLen+ln+encryption.MinSigLen {
+		return Event{}, errors.New("Invalid event length")
+	}
+	return Event{
+		Kind:      EventKind(data[0]),
+		GroupID:   data[1:33],
+		Actor:     data[33:65],
+		Subject:   data[65:97],
+		Timestamp: binary.BigEndian.Uint64(data[97:105]),
+		Data:      data[eventHeaderLen : eventHeaderLen+ln],
+		Sig:       data[eventHeaderLen+ln:],
+	}, nil
+}
+
+//Verify - checks the actor's signature
+func (ev *Event) Verify() error {
+	key, err := node.KeyOf(ev.Actor)
+	if err != nil {
+		return err
+	}
+	if !encryption.ValidateSig(key, ev.Sig, ev.signedPart()) {
+		return errors.New("Invalid event signature")
+	}
+	return nil
+}
+
+func newEvent(kind EventKind, groupID []byte, subject []byte, data []byte) (Event, error) {
+	ev := Event{
+		Kind:      kind,
+		GroupID:   groupID,
+		Actor:     node.ID(),
+		Subject:   subject,
+		Timestamp: now(),
+		Data:      data,
+	}
+	sig, err := node.Sign(ev.signedPart())
+	if err != nil {
+		return Event{}, err
+	}
+	ev.Sig = sig
+	return ev, nil
+}
@@ -0,0 +1,496 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"time"
+)
+
+//Group - a group conversation. Membership is the result of replaying the
+//signed event log, so any member can verify it
+type Group struct {
+	ID      []byte
+	Name    string
+	Members [][]byte
+	Admins  [][]byte
+	Log     []Event
+	KeyID   uint64            //ID of the newest group key
+	Keys    map[uint64][]byte //group keys by ID
+}
+
+//GroupMessage - a message sent to a group
+type GroupMessage struct {
+	ID        []byte
+	GroupID   []byte
+	Sender    []byte
+	Timestamp uint64
+	Body      []byte
+}
+
+func now() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+func contains(ids [][]byte, id []byte) bool {
+	for _, i := range ids {
+		if bytes.Equal(i, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func without(ids [][]byte, id []byte) [][]byte {
+	kept := make([][]byte, 0, len(ids))
+	for _, i := range ids {
+		if !bytes.Equal(i, id) {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+//IsMember -
+func (group *Group) IsMember(id []byte) bool {
+	return contains(group.Members, id)
+}
+
+//IsAdmin -
+func (group *Group) IsAdmin(id []byte) bool {
+	return contains(group.Admins, id)
+}
+
+//apply - validates the event against the current state and applies it
+func (group *Group) apply(ev Event) error {
+	if len(group.Log) == 0 {
+		if ev.Kind != EventCreate {
+			return errors.New("First event must create the group")
+		}
+	} else if !bytes.Equal(ev.GroupID, group.ID) {
+		return errors.New("Event is for another group")
+	}
+	if err := ev.Verify(); err != nil {
+		return err
+	}
+	switch ev.Kind {
+	case EventCreate:
+		if len(group.Log) != 0 {
+			return errors.New("Group already created")
+		}
+		group.ID = ev.GroupID
+		group.Name = string(ev.Data)
+		group.Members = [][]byte{ev.Actor}
+		group.Admins = [][]byte{ev.Actor}
+	case EventAdd:
+		if !group.IsAdmin(ev.Actor) || group.IsMember(ev.Subject) {
+			return errors.New("Invalid add event")
+		}
+		group.Members = append(group.Members, ev.Subject)
+	case EventRemove:
+		if !group.IsAdmin(ev.Actor) || !group.IsMember(ev.Subject) {
+			return errors.New("Invalid remove event")
+		}
+		group.Members = without(group.Members, ev.Subject)
+		group.Admins = without(group.Admins, ev.Subject)
+	case EventLeave:
+		if !bytes.Equal(ev.Actor, ev.Subject) || !group.IsMember(ev.Actor) {
+			return errors.New("Invalid leave event")
+		}
+		group.Members = without(group.Members, ev.Actor)
+		group.Admins = without(group.Admins, ev.Actor)
+	case EventAdminGrant:
+		if !group.IsAdmin(ev.Actor) || !group.IsMember(ev.Subject) || group.IsAdmin(ev.Subject) {
+			return errors.New("Invalid admin grant event")
+		}
+		group.Admins = append(group.Admins, ev.Subject)
+	default:
+		return errors.New("Unknown event kind")
+	}
+	group.Log = append(group.Log, ev)
+	return nil
+}
+
+//replay - builds a group from an event log
+func replay(log []Event) (*Group, error) {
+	group := &Group{}
+	for _, ev := range log {
+		err := group.apply(ev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return group, nil
+}
+
+func (group *Group) copy() Group {
+	g := *group
+	g.Members = append([][]byte(nil), group.Members...)
+	g.Admins = append([][]byte(nil), group.Admins...)
+	g.Log = append([]Event(nil), group.Log...)
+	g.Keys = make(map[uint64][]byte)
+	for id, key := range group.Keys {
+		g.Keys[id] = key
+	}
+	return g
+}
+
+//serializeLog - PayloadGroupLog, group ID, count, (length, event)...
+func (group *Group) serializeLog() []byte {
+	var buff bytes.Buffer
+	buff.WriteByte(commands.PayloadGroupLog)
+	buff.Write(group.ID)
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(group.Log)))
+	buff.Write(cnt)
+	for _, ev := range group.Log {
+		data := ev.Serialize()
+		ln := make([]byte, 2)
+		binary.BigEndian.PutUint16(ln, uint16(len(data)))
+		buff.Write(ln)
+		buff.Write(data)
+	}
+	return buff.Bytes()
+}
+
+func deserializeLog(data []byte) ([]Event, error) {
+	if len(data) < 1+32+2 {
+		return nil, errors.New("Invalid group log")
+	}
+	cnt := int(binary.BigEndian.Uint16(data[33:35]))
+	log := make([]Event, 0, cnt)
+	idx := 35
+	for i := 0; i < cnt; i++ {
+		if len(data) < idx+2 {
+			return nil, errors.New("Invalid group log")
+		}
+		ln := int(binary.BigEndian.Uint16(data[idx : idx+2]))
+		idx += 2
+		if len(data) < idx+ln {
+			return nil, errors.New("Invalid group log")
+		}
+		ev, err := DeserializeEvent(data[idx : idx+ln])
+		if err != nil {
+			return nil, err
+		}
+		log = append(log, ev)
+		idx += ln
+	}
+	return log, nil
+}
+
+//isPrefix - whether every event of log a is at the start of log b
+func isPrefix(a []Event, b []Event) bool {
+	if len(a) > len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Sig, b[i].Sig) {
+			return false
+		}
+	}
+	return true
+}
+
+//handleGroupLog - adopts a log that extends the one we have and rotates the
+//group key if that falls to this node
+func handleGroupLog(env node.Envelope) {
+	log, err := deserializeLog(env.Payload)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	group, err := replay(log)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	//only members (or members just removed) may tell us about a group
+	if !group.IsMember(env.Sender) && !contains(subjects(log), env.Sender) {
+		fmt.Println("Group log from non member", util.ToHexString(env.Sender))
+		return
+	}
+	gmutex.Lock()
+	existing, exists := _groups[util.ToHexString(group.ID)]
+	if exists && !isPrefix(existing.Log, group.Log) {
+		gmutex.Unlock()
+		fmt.Println("Conflicting group log for", util.ToHexString(group.ID))
+		return
+	}
+	if exists {
+		group.KeyID = existing.KeyID
+		group.Keys = existing.Keys
+	}
+	_groups[util.ToHexString(group.ID)] = group
+	rotate := group.mustRotate()
+	gmutex.Unlock()
+	err = saveGroups()
+	if err != nil {
+		fmt.Println(err)
+	}
+	if rotate {
+		err = distributeKey(context.Background(), group.ID)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	retryPending(group.ID)
+}
+
+func subjects(log []Event) [][]byte {
+	ids := make([][]byte, 0, len(log))
+	for _, ev := range log {
+		ids = append(ids, ev.Actor, ev.Subject)
+	}
+	return ids
+}
+
+//GetGroup - returns a copy of the group
+func GetGroup(id []byte) (Group, bool) {
+	gmutex.Lock()
+	defer gmutex.Unlock()
+	group, exists := _groups[util.ToHexString(id)]
+	if !exists {
+		return Group{}, false
+	}
+	return group.copy(), true
+}
+
+//Groups - returns copies of all groups this node knows of
+func Groups() []Group {
+	gmutex.Lock()
+	defer gmutex.Unlock()
+	groups := make([]Group, 0, len(_groups))
+	for _, group := range _groups {
+		groups = append(groups, group.copy())
+	}
+	return groups
+}
+
+//change - signs and applies an event to a local group and sends the new
+//log to the members plus extra recipients (e.g. a removed member)
+func change(ctx context.Context, groupID []byte, kind EventKind, subject []byte) error {
+	gmutex.Lock()
+	group, exists := _groups[util.ToHexString(groupID)]
+	if !exists {
+		gmutex.Unlock()
+		return errors.New("Unknown group")
+	}
+	ev, err := newEvent(kind, groupID, subject, nil)
+	if err != nil {
+		gmutex.Unlock()
+		return err
+	}
+	err = group.apply(ev)
+	if err != nil {
+		gmutex.Unlock()
+		return err
+	}
+	recipients := append([][]byte(nil), group.Members...)
+	if !contains(recipients, subject) {
+		recipients = append(recipients, subject)
+	}
+	payload := group.serializeLog()
+	rotate := group.mustRotate()
+	gmutex.Unlock()
+	err = saveGroups()
+	if err != nil {
+		fmt.Println(err)
+	}
+	_, err = node.SendMulti(ctx, recipients, payload)
+	if err != nil {
+		return err
+	}
+	if rotate {
+		return distributeKey(ctx, groupID)
+	}
+	return nil
+}
+
+//CreateGroup - creates a group with this node as admin and adds members
+func CreateGroup(ctx context.Context, name string, members [][]byte) (Group, error) {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Group{}, err
+	}
+	ev, err := newEvent(EventCreate, id, node.ID(), []byte(name))
+	if err != nil {
+		return Group{}, err
+	}
+	group := &Group{}
+	err = group.apply(ev)
+	if err != nil {
+		return Group{}, err
+	}
+	for _, member := range members {
+		if group.IsMember(member) {
+			continue
+		}
+		ev, err := newEvent(EventAdd, id, member, nil)
+		if err != nil {
+			return Group{}, err
+		}
+		err = group.apply(ev)
+		if err != nil {
+			return Group{}, err
+		}
+	}
+	gmutex.Lock()
+	_groups[util.ToHexString(id)] = group
+	result := group.copy()
+	payload := group.serializeLog()
+	gmutex.Unlock()
+	err = saveGroups()
+	if err != nil {
+		fmt.Println(err)
+	}
+	if len(result.Members) > 1 {
+		_, err = node.SendMulti(ctx, result.Members, payload)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, distributeKey(ctx, id)
+}
+
+//AddMember - adds a member. Only admins can add
+func AddMember(ctx context.Context, groupID []byte, member []byte) error {
+	return change(ctx, groupID, EventAdd, member)
+}
+
+//RemoveMember - removes a member. Only admins can remove
+func RemoveMember(ctx context.Context, groupID []byte, member []byte) error {
+	return change(ctx, groupID, EventRemove, member)
+}
+
+//Leave - leaves the group
+func Leave(ctx context.Context, groupID []byte) error {
+	return change(ctx, groupID, EventLeave, node.ID())
+}
+
+//GrantAdmin - makes a member admin. Only admins can grant
+func GrantAdmin(ctx context.Context, groupID []byte, member []byte) error {
+	return change(ctx, groupID, EventAdminGrant, member)
+}
+
+//SendGroupMessage - encrypts body with the current group key and sends it
+//to all other members with one ciphertext. The key ID goes in the header
+//so receivers pick the right key. Returns the message ID
+func SendGroupMessage(ctx context.Context, groupID []byte, body []byte) ([]byte, error) {
+	sent, err := sendGroupPayload(ctx, commands.PayloadGroupMessage, groupID, body)
+	if err != nil {
+		return nil, err
+	}
+	addMessage(GroupMessage{
+		ID:        sent.ID,
+		GroupID:   groupID,
+		Sender:    node.ID(),
+		Timestamp: sent.Timestamp,
+		Body:      body,
+	})
+	return sent.ID, nil
+}
+
+//sentPayload - what the members see of a group payload this node sent
+type sentPayload struct {
+	ID        []byte
+	Timestamp uint64 //sealed timestamp, Envelope.Timestamp of the members
+	Epoch     uint32 //epoch of the key it was encrypted with
+}
+
+//sendGroupPayload - sends a group message or action
+func sendGroupPayload(ctx context.Context, code byte, groupID []byte, body []byte) (sentPayload, error) {
+	group, exists := GetGroup(groupID)
+	if !exists {
+		return sentPayload{}, errors.New("Unknown group")
+	}
+	if !group.IsMember(node.ID()) {
+		return sentPayload{}, errors.New("Not a member of this group")
+	}
+	if !group.hasCurrentKey() {
+		if !group.IsAdmin(node.ID()) {
+			return sentPayload{}, errors.New("Waiting for the group key")
+		}
+		err := distributeKey(ctx, groupID)
+		if err != nil {
+			return sentPayload{}, err
+		}
+		group, _ = GetGroup(groupID)
+	}
+	encrypted, err := encryption.EncryptMsg(group.Keys[group.KeyID], body)
+	if err != nil {
+		return sentPayload{}, err
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(code)
+	buff.Write(groupID)
+	keyID := make([]byte, 8)
+	binary.BigEndian.PutUint64(keyID, group.KeyID)
+	buff.Write(keyID)
+	buff.Write(encrypted)
+	id, ts, err := node.SendMultiStamped(ctx, group.Members, buff.Bytes())
+	if err != nil {
+		return sentPayload{}, err
+	}
+	return sentPayload{ID: id, Timestamp: ts, Epoch: keyEpoch(group.KeyID)}, nil
+}
+
+//openGroupPayload - decrypts a group message or action. Returns false if
+//it can't be handled yet, and an error if it is to be dropped
+func openGroupPayload(env node.Envelope) ([]byte, bool, error) {
+	if len(env.Payload) < 1+32+8 {
+		return nil, true, errors.New("Malformed group message from " + util.ToHexString(env.Sender))
+	}
+	groupID := env.Payload[1:33]
+	keyID := binary.BigEndian.Uint64(env.Payload[33:41])
+	group, exists := GetGroup(groupID)
+	if !exists {
+		return nil, false, nil
+	}
+	if !group.IsMember(env.Sender) {
+		return nil, true, errors.New("Group message from non member " + util.ToHexString(env.Sender))
+	}
+	key, exists := group.Keys[keyID]
+	if !exists {
+		return nil, false, nil
+	}
+	body, err := encryption.DecryptMessage(key, env.Payload[41:])
+	if err != nil {
+		return nil, true, err
+	}
+	return body, true, nil
+}
+
+//handleGroupMessage - returns false if the message can't be handled yet
+func handleGroupMessage(env node.Envelope) bool {
+	body, ready, err := openGroupPayload(env)
+	if !ready {
+		return false
+	}
+	if err != nil {
+		fmt.Println(err)
+		return true
+	}
+	msg := GroupMessage{
+		ID:        env.ID,
+		GroupID:   env.Payload[1:33],
+		Sender:    env.Sender,
+		Timestamp: env.Timestamp,
+		Body:      body,
+	}
+	if !addMessage(msg) {
+		return true
+	}
+	for _, handler := range groupHandlers() {
+		handler(msg)
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package chat
+
+import (
+	"crypto/rand"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/node/routing"
+	"testing"
+)
+
+type testMember struct {
+	key encryption.Key
+	id  []byte
+}
+
+func newTestMember(t *testing.T, name string) (testMember, *routing.Node) {
+	key, err := encryption.Generate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := routing.NewNode(key, commands.NewAddress("127.0.0.1", name), nil)
+	return testMember{key: key, id: n.ID()}, &n
+}
+
+//testMembers - members known to the routing table, so events they sign verify
+func testMembers(t *testing.T, names ...string) map[string]testMember {
+	members := make(map[string]testMember, len(names))
+	for _, name := range names {
+		m, n := newTestMember(t, name)
+		routing.Table.AddNode(n)
+		t.Cleanup(func() { routing.Table.RemoveNode(n) })
+		members[name] = m
+	}
+	return members
+}
+
+func testID(t *testing.T) []byte {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func signedEvent(t *testing.T, actor testMember, kind EventKind, groupID []byte, subject []byte, ts uint64) Event {
+	ev := Event{
+		Kind:      kind,
+		GroupID:   groupID,
+		Actor:     actor.id,
+		Subject:   subject,
+		Timestamp: ts,
+	}
+	if kind == EventCreate {
+		ev.Data = []byte("test group")
+	}
+	sig, err := encryption.Sign(actor.key, ev.signedPart())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.Sig = sig
+	return ev
+}
+
+func TestReplay(t *testing.T) {
+	members := testMembers(t, "alice", "bob", "carol", "dave")
+	members["stranger"], _ = newTestMember(t, "stranger")
+	groupID := testID(t)
+	otherGroup := testID(t)
+
+	type step struct {
+		actor   string
+		kind    EventKind
+		subject string
+	}
+	create := step{"alice", EventCreate, "alice"}
+	tests := []struct {
+		name    string
+		steps   []step
+		valid   bool
+		members []string
+		admins  []string
+	}{
+		{"create", []step{create}, true, []string{"alice"}, []string{"alice"}},
+		{"add", []step{create, {"alice", EventAdd, "bob"}, {"alice", EventAdd, "carol"}},
+			true, []string{"alice", "bob", "carol"}, []string{"alice"}},
+		{"add by a member", []step{create, {"alice", EventAdd, "bob"}, {"bob", EventAdd, "carol"}}, false, nil, nil},
+		{"add twice", []step{create, {"alice", EventAdd, "bob"}, {"alice", EventAdd, "bob"}}, false, nil, nil},
+		{"remove", []step{create, {"alice", EventAdd, "bob"}, {"alice", EventRemove, "bob"}},
+			true, []string{"alice"}, []string{"alice"}},
+		{"remove by a member", []step{create, {"alice", EventAdd, "bob"}, {"alice", EventAdd, "carol"},
+			{"bob", EventRemove, "carol"}}, false, nil, nil},
+		{"remove a non member", []step{create, {"alice", EventRemove, "bob"}}, false, nil, nil},
+		{"removed admin", []step{create, {"alice", EventAdd, "bob"}, {"alice", EventAdminGrant, "bob"},
+			{"bob", EventRemove, "alice"}}, true, []string{"bob"}, []string{"bob"}},
+		{"leave", []step{create, {"alice", EventAdd, "bob"}, {"bob", EventLeave, "bob"}},
+			true, []string{"alice"}, []string{"alice"}},
+		{"leave for someone else", []step{create, {"alice", EventAdd, "bob"}, {"alice", EventLeave, "bob"}}, false, nil, nil},
+		{"admin grant", []step{create, {"alice", EventAdd, "bob"}, {"alice", EventAdminGrant, "bob"},
+			{"bob", EventAdd, "carol"}}, true, []string{"alice", "bob", "carol"}, []string{"alice", "bob"}},
+		{"admin grant to a non member", []step{create, {"alice", EventAdminGrant, "bob"}}, false, nil, nil},
+		{"admin grant by a member", []step{create, {"alice", EventAdd, "bob"}, {"bob", EventAdminGrant, "bob"}}, false, nil, nil},
+		{"no create", []step{{"alice", EventAdd, "bob"}}, false, nil, nil},
+		{"second create", []step{create, create}, false, nil, nil},
+		{"unknown actor", []step{create, {"alice", EventAdd, "stranger"}, {"stranger", EventLeave, "stranger"}}, false, nil, nil},
+		{"unknown kind", []step{create, {"alice", EventKind(0x7F), "bob"}}, false, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := make([]Event, 0, len(tt.steps))
+			for i, s := range tt.steps {
+				log = append(log, signedEvent(t, members[s.actor], s.kind, groupID, members[s.subject].id, uint64(i+1)))
+			}
+			group, err := replay(log)
+			if (err == nil) != tt.valid {
+				t.Fatalf("replay: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if len(group.Members) != len(tt.members) || len(group.Admins) != len(tt.admins) {
+				t.Fatalf("%d members, %d admins", len(group.Members), len(group.Admins))
+			}
+			for _, name := range tt.members {
+				if !group.IsMember(members[name].id) {
+					t.Fatalf("%s is not a member", name)
+				}
+			}
+			for _, name := range tt.admins {
+				if !group.IsAdmin(members[name].id) {
+					t.Fatalf("%s is not an admin", name)
+				}
+			}
+
+			//the log survives the wire and replays the same
+			group.ID = groupID
+			data := group.serializeLog()
+			received, err := deserializeLog(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := replay(received)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isPrefix(group.Log, again.Log) || len(again.Log) != len(group.Log) {
+				t.Fatal("log changed on the wire")
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		forOther := signedEvent(t, members["alice"], EventAdd, otherGroup, members["bob"].id, 2)
+		tests := []struct {
+			name   string
+			mangle func(log []Event)
+		}{
+			{"signature", func(log []Event) { log[1].Sig[0] ^= 0x01 }},
+			{"subject", func(log []Event) { log[1].Subject = members["dave"].id }},
+			{"other group", func(log []Event) { log[1] = forOther }},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				log := []Event{
+					signedEvent(t, members["alice"], EventCreate, groupID, members["alice"].id, 1),
+					signedEvent(t, members["alice"], EventAdd, groupID, members["bob"].id, 2),
+				}
+				tt.mangle(log)
+				_, err := replay(log)
+				if err == nil {
+					t.Fatal("replayed")
+				}
+			})
+		}
+	})
+}
+
+func TestIsPrefix(t *testing.T) {
+	members := testMembers(t, "alice", "bob", "carol")
+	groupID := testID(t)
+	create := signedEvent(t, members["alice"], EventCreate, groupID, members["alice"].id, 1)
+	addBob := signedEvent(t, members["alice"], EventAdd, groupID, members["bob"].id, 2)
+	addCarol := signedEvent(t, members["alice"], EventAdd, groupID, members["carol"].id, 2)
+	tests := []struct {
+		name string
+		a    []Event
+		b    []Event
+		ok   bool
+	}{
+		{"empty", nil, []Event{create}, true},
+		{"same", []Event{create, addBob}, []Event{create, addBob}, true},
+		{"extends", []Event{create}, []Event{create, addBob}, true},
+		{"shorter", []Event{create, addBob}, []Event{create}, false},
+		{"fork", []Event{create, addBob}, []Event{create, addCarol}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if isPrefix(tt.a, tt.b) != tt.ok {
+				t.Fatalf("isPrefix %v", !tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/user"
+	"mobchat/util"
+	"time"
+)
+
+//Every membership change rotates the group key. A key ID is the epoch of
+//the key (the length of the event log when it was made, so it belongs to
+//exactly one membership) followed by 4 random bytes, so two admins rotating
+//at the same time can't clash. The member that made the change, or the
+//first admin when someone left, creates the key and wraps it for each
+//remaining member with encryption.EncryptCypherKey. Removed members never
+//get it. Old keys are kept only to read messages sent before the change
+
+//Messages and keys that arrive before the group log or key they depend on
+//wait, at most pendingMax per group and pendingMaxTotal overall, for
+//pendingTTL. The key of a new group can arrive before its log, from an
+//inviter that isn't a contact, so envelopes for unknown groups from
+//strangers wait too, but at most pendingMax per sender, so one stranger
+//can't fill the queue with made up group IDs
+
+const (
+	pendingMax      = 100
+	pendingMaxTotal = 1000
+	pendingTTL      = 10 * time.Minute
+)
+
+type pendingEnvelope struct {
+	env   node.Envelope
+	added time.Time
+}
+
+//pending - messages and keys that arrived before what they depend on
+var _pending = make(map[string][]pendingEnvelope)
+
+func keyEpoch(keyID uint64) uint32 {
+	return uint32(keyID >> 32)
+}
+
+func (group *Group) epoch() uint32 {
+	return uint32(len(group.Log))
+}
+
+//hasCurrentKey - whether the newest key belongs to the current membership
+func (group *Group) hasCurrentKey() bool {
+	_, exists := group.Keys[group.KeyID]
+	return exists && keyEpoch(group.KeyID) == group.epoch()
+}
+
+//installKey - keeps the key and makes it current if it is the newest.
+//Caller holds gmutex
+func (group *Group) installKey(keyID uint64, key []byte) {
+	if group.Keys == nil {
+		group.Keys = make(map[uint64][]byte)
+	}
+	group.Keys[keyID] = key
+	if _, exists := group.Keys[group.KeyID]; !exists || keyEpoch(keyID) > keyEpoch(group.KeyID) {
+		group.KeyID = keyID
+	}
+}
+
+//rotateKey - creates a key for the current membership and returns the
+//PayloadGroupKey to send to the other members. Caller holds gmutex
+func (group *Group) rotateKey() ([]byte, [][]byte, error) {
+	key := encryption.GetCipherKey()
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := uint64(group.epoch())<<32 | uint64(binary.BigEndian.Uint32(suffix))
+	recipients := make([][]byte, 0, len(group.Members))
+	var wraps bytes.Buffer
+	for _, member := range group.Members {
+		if bytes.Equal(member, node.ID()) {
+			continue
+		}
+		memberKey, err := node.KeyOf(member)
+		if err != nil {
+			return nil, nil, err
+		}
+		wrap, err := encryption.EncryptCypherKey(memberKey, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		ln := make([]byte, 2)
+		binary.BigEndian.PutUint16(ln, uint16(len(wrap)))
+		wraps.Write(member)
+		wraps.Write(ln)
+		wraps.Write(wrap)
+		recipients = append(recipients, member)
+	}
+	group.installKey(keyID, key)
+
+	var buff bytes.Buffer
+	buff.WriteByte(commands.PayloadGroupKey)
+	buff.Write(group.ID)
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, keyID)
+	buff.Write(id)
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(recipients)))
+	buff.Write(cnt)
+	buff.Write(wraps.Bytes())
+	return buff.Bytes(), recipients, nil
+}
+
+//distributeKey - rotates the key of a local group and sends it out
+func distributeKey(ctx context.Context, groupID []byte) error {
+	gmutex.Lock()
+	group, exists := _groups[util.ToHexString(groupID)]
+	if !exists {
+		gmutex.Unlock()
+		return errors.New("Unknown group")
+	}
+	payload, recipients, err := group.rotateKey()
+	gmutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = saveGroups()
+	if err != nil {
+		fmt.Println(err)
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+	_, err = node.SendMulti(ctx, recipients, payload)
+	return err
+}
+
+//mustRotate - whether this node is responsible for the key of the current
+//membership: the actor of the last change, or the first admin if the
+//actor left
+func (group *Group) mustRotate() bool {
+	if len(group.Log) == 0 || group.hasCurrentKey() || !group.IsMember(node.ID()) {
+		return false
+	}
+	last := group.Log[len(group.Log)-1]
+	if group.IsMember(last.Actor) {
+		return bytes.Equal(last.Actor, node.ID())
+	}
+	return len(group.Admins) > 0 && bytes.Equal(group.Admins[0], node.ID())
+}
+
+//handleGroupKey - returns false if the key can't be handled yet
+func handleGroupKey(env node.Envelope) bool {
+	data := env.Payload
+	if len(data) < 1+32+8+2 {
+		fmt.Println("Malformed group key from", util.ToHexString(env.Sender))
+		return true
+	}
+	groupID := data[1:33]
+	keyID := binary.BigEndian.Uint64(data[33:41])
+	cnt := int(binary.BigEndian.Uint16(data[41:43]))
+	wraps := make(map[string][]byte, cnt)
+	idx := 43
+	for i := 0; i < cnt; i++ {
+		if len(data) < idx+32+2 {
+			break
+		}
+		ln := int(binary.BigEndian.Uint16(data[idx+32 : idx+34]))
+		if len(data) < idx+34+ln {
+			break
+		}
+		wraps[util.ToHexString(data[idx:idx+32])] = data[idx+34 : idx+34+ln]
+		idx += 34 + ln
+	}
+	if idx != len(data) {
+		fmt.Println("Malformed group key from", util.ToHexString(env.Sender))
+		return true
+	}
+	gmutex.Lock()
+	defer gmutex.Unlock()
+	group, exists := _groups[util.ToHexString(groupID)]
+	epoch := keyEpoch(keyID)
+	if !exists || epoch > group.epoch() {
+		return false
+	}
+	if epoch == 0 || !group.IsMember(env.Sender) ||
+		!(group.IsAdmin(env.Sender) || bytes.Equal(group.Log[epoch-1].Actor, env.Sender)) {
+		fmt.Println("Group key from unauthorized member", util.ToHexString(env.Sender))
+		return true
+	}
+	if wrap, exists := wraps[util.ToHexString(node.ID())]; exists {
+		key, err := node.DecryptCypher(wrap)
+		if err != nil {
+			fmt.Println(err)
+			return true
+		}
+		group.installKey(keyID, key)
+		return true
+	}
+	return true
+}
+
+//knownSender - whether the sender is one of the user's contacts, or a
+//device of one
+func knownSender(sender []byte) bool {
+	if _, exists := user.GetContact(sender); exists {
+		return true
+	}
+	owner, ok := user.UserOf(sender)
+	if !ok {
+		return false
+	}
+	_, exists := user.GetContact(owner)
+	return exists
+}
+
+//expirePending - drops envelopes older than pendingTTL and returns how many
+//are left. Caller holds gmutex
+func expirePending() int {
+	total := 0
+	cutoff := time.Now().Add(-pendingTTL)
+	for key, envs := range _pending {
+		kept := envs[:0]
+		for _, p := range envs {
+			if p.added.After(cutoff) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(_pending, key)
+			continue
+		}
+		_pending[key] = kept
+		total += len(kept)
+	}
+	return total
+}
+
+//pendingFrom - how many envelopes of the sender are waiting. Caller holds
+//gmutex
+func pendingFrom(sender []byte) int {
+	cnt := 0
+	for _, envs := range _pending {
+		for _, p := range envs {
+			if bytes.Equal(p.env.Sender, sender) {
+				cnt++
+			}
+		}
+	}
+	return cnt
+}
+
+//deferEnvelope - keeps an envelope until its group log or key arrives
+func deferEnvelope(groupID []byte, env node.Envelope) {
+	_, known := GetGroup(groupID)
+	trusted := known || knownSender(env.Sender)
+	key := util.ToHexString(groupID)
+	gmutex.Lock()
+	defer gmutex.Unlock()
+	if expirePending() >= pendingMaxTotal {
+		fmt.Println("Too many pending group messages, dropping one from", util.ToHexString(env.Sender))
+		return
+	}
+	if !trusted && pendingFrom(env.Sender) >= pendingMax {
+		fmt.Println("Too many pending messages for unknown groups from", util.ToHexString(env.Sender))
+		return
+	}
+	if len(_pending[key]) >= pendingMax {
+		_pending[key] = _pending[key][1:]
+	}
+	_pending[key] = append(_pending[key], pendingEnvelope{env: env, added: time.Now()})
+}
+
+//retryPending - handles envelopes that were waiting on the group
+func retryPending(groupID []byte) {
+	key := util.ToHexString(groupID)
+	gmutex.Lock()
+	pending := _pending[key]
+	delete(_pending, key)
+	gmutex.Unlock()
+	for _, p := range pending {
+		handler{}.Handle(p.env)
+	}
+}
@@ -0,0 +1,473 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Group messages are kept in a local history, at most historymax per group.
+//Edits, deletions and reactions are actions sent to the group like
+//messages, referring to a message by its ID. Actions are kept apart from
+//the messages and applied when the history is read, so they can arrive
+//more than once, in any order, and before the message they refer to.
+//Actions on messages that aren't known yet are held, at most
+//historyorphans per group. Messages and actions are ordered by the
+//timestamp sealed into them, on the sending node as on the others. An edit
+//counts if it comes from the sender of the message, the newest one wins. A
+//deletion counts if it comes from the sender or from a member that was
+//admin at the epoch of the group key the deletion was sent with, so the
+//outcome doesn't depend on what arrives first. It clears the body and the
+//edits for good. Each member has one reaction per message, the newest one,
+//and an empty one takes it back. The history is saved at most every
+//historysaveinterval.
+//Only group chats keep a history. One to one session messages are handed
+//to the session handlers as they arrive and have no ID the sender knows,
+//so there are no actions on them
+
+//ActionKind - what an action does to a message
+type ActionKind byte
+
+const (
+	//ActionEdit - replaces the body of a message
+	ActionEdit ActionKind = 0x01
+	//ActionDelete - deletes a message for everyone
+	ActionDelete ActionKind = 0x02
+	//ActionReact - reacts to a message with an emoji
+	ActionReact ActionKind = 0x03
+)
+
+const maxReaction = 64
+
+//Action - an edit, deletion or reaction referring to a group message
+type Action struct {
+	ID        []byte
+	Kind      ActionKind
+	GroupID   []byte
+	Target    []byte //ID of the message
+	Sender    []byte
+	Timestamp uint64
+	Epoch     uint32 //epoch of the group key the action was sent with
+	Data      []byte //new body for ActionEdit, emoji for ActionReact
+}
+
+//Entry - a message of the history with the actions on it applied
+type Entry struct {
+	GroupMessage
+	Edited    uint64 //timestamp of the edit shown, 0 if not edited
+	Deleted   bool
+	Reactions map[string][][]byte //members by emoji
+}
+
+type history struct {
+	Messages map[string][]GroupMessage //by group
+	Actions  map[string][]Action       //by group
+	Deleted  map[string]bool           //IDs of deleted messages
+}
+
+var (
+	_history        = history{Messages: make(map[string][]GroupMessage), Actions: make(map[string][]Action), Deleted: make(map[string]bool)}
+	_messageIDs     = make(map[string]bool) //IDs of the messages in _history
+	_actionHandlers []func(Action)
+	_savePending    bool
+	hmutex          = sync.Mutex{}
+)
+
+//findMessage - index of the message in the group's history, -1 if not
+//known. Caller holds hmutex
+func findMessage(key string, id []byte) int {
+	if !_messageIDs[util.ToHexString(id)] {
+		return -1
+	}
+	for i, msg := range _history.Messages[key] {
+		if bytes.Equal(msg.ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+//canDelete - whether the action is a deletion that counts for msg, given
+//the group log
+func canDelete(action Action, msg GroupMessage, log []Event) bool {
+	if action.Kind != ActionDelete {
+		return false
+	}
+	if bytes.Equal(action.Sender, msg.Sender) {
+		return true
+	}
+	if action.Epoch == 0 || int(action.Epoch) > len(log) {
+		return false
+	}
+	group, err := replay(log[:action.Epoch])
+	return err == nil && group.IsAdmin(action.Sender)
+}
+
+//decide - applies the actions on message i of the group once both are
+//known: a deletion that counts marks the message deleted for good and
+//clears its body and edits. Caller holds hmutex
+func decide(key string, i int, actions []Action, log []Event) {
+	msg := &_history.Messages[key][i]
+	id := util.ToHexString(msg.ID)
+	for _, action := range actions {
+		if !_history.Deleted[id] && canDelete(action, *msg, log) {
+			_history.Deleted[id] = true
+		}
+	}
+	if !_history.Deleted[id] {
+		return
+	}
+	msg.Body = nil
+	for j, action := range _history.Actions[key] {
+		if action.Kind == ActionEdit && bytes.Equal(action.Target, msg.ID) {
+			_history.Actions[key][j].Data = nil
+		}
+	}
+}
+
+//isOrphan - whether the action refers to a message that isn't known.
+//Caller holds hmutex
+func isOrphan(action Action) bool {
+	return !_messageIDs[util.ToHexString(action.Target)]
+}
+
+//trim - drops the oldest messages of a group beyond historymax, with the
+//actions on them, and the oldest actions on unknown messages beyond
+//historyorphans. Caller holds hmutex
+func trim(key string) {
+	messages := _history.Messages[key]
+	max := config.AttrInt("historymax", 1000)
+	dropped := make(map[string]bool)
+	if len(messages) > max {
+		sort.Slice(messages, func(i, j int) bool { return messages[i].Timestamp < messages[j].Timestamp })
+		for _, msg := range messages[:len(messages)-max] {
+			id := util.ToHexString(msg.ID)
+			dropped[id] = true
+			delete(_messageIDs, id)
+			delete(_history.Deleted, id)
+		}
+		_history.Messages[key] = append([]GroupMessage(nil), messages[len(messages)-max:]...)
+	}
+	orphans := 0
+	for _, action := range _history.Actions[key] {
+		if isOrphan(action) && !dropped[util.ToHexString(action.Target)] {
+			orphans++
+		}
+	}
+	excess := orphans - config.AttrInt("historyorphans", 200)
+	if len(dropped) == 0 && excess <= 0 {
+		return
+	}
+	actions := _history.Actions[key]
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].Timestamp < actions[j].Timestamp })
+	kept := make([]Action, 0, len(actions))
+	for _, action := range actions {
+		target := util.ToHexString(action.Target)
+		if dropped[target] {
+			continue
+		}
+		if excess > 0 && isOrphan(action) {
+			excess--
+			continue
+		}
+		kept = append(kept, action)
+	}
+	_history.Actions[key] = kept
+}
+
+//addMessage - keeps a group message. Returns false if it was known
+func addMessage(msg GroupMessage) bool {
+	group, _ := GetGroup(msg.GroupID)
+	key := util.ToHexString(msg.GroupID)
+	hmutex.Lock()
+	if findMessage(key, msg.ID) >= 0 {
+		hmutex.Unlock()
+		return false
+	}
+	_history.Messages[key] = append(_history.Messages[key], msg)
+	_messageIDs[util.ToHexString(msg.ID)] = true
+	waiting := make([]Action, 0)
+	for _, action := range _history.Actions[key] {
+		if bytes.Equal(action.Target, msg.ID) {
+			waiting = append(waiting, action)
+		}
+	}
+	decide(key, len(_history.Messages[key])-1, waiting, group.Log)
+	trim(key)
+	hmutex.Unlock()
+	saveHistorySoon()
+	return true
+}
+
+//addAction - keeps an action. Returns false if it was known
+func addAction(action Action) bool {
+	group, _ := GetGroup(action.GroupID)
+	key := util.ToHexString(action.GroupID)
+	hmutex.Lock()
+	for _, known := range _history.Actions[key] {
+		if bytes.Equal(known.ID, action.ID) {
+			hmutex.Unlock()
+			return false
+		}
+	}
+	_history.Actions[key] = append(_history.Actions[key], action)
+	if i := findMessage(key, action.Target); i >= 0 {
+		decide(key, i, []Action{action}, group.Log)
+	} else {
+		trim(key)
+	}
+	hmutex.Unlock()
+	saveHistorySoon()
+	return true
+}
+
+//actionBody - kind, target ID, data
+func actionBody(kind ActionKind, target []byte, data []byte) ([]byte, error) {
+	if len(target) != 32 {
+		return nil, errors.New("Invalid message ID")
+	}
+	if kind == ActionReact && len(data) > maxReaction {
+		return nil, errors.New("Reaction too long")
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(byte(kind))
+	buff.Write(target)
+	buff.Write(data)
+	return buff.Bytes(), nil
+}
+
+//handleGroupAction - returns false if the action can't be handled yet
+func handleGroupAction(env node.Envelope) bool {
+	body, ready, err := openGroupPayload(env)
+	if !ready {
+		return false
+	}
+	if err == nil && (len(body) < 1+32 || ActionKind(body[0]) < ActionEdit || ActionKind(body[0]) > ActionReact) {
+		err = errors.New("Malformed group action from " + util.ToHexString(env.Sender))
+	}
+	if err == nil && ActionKind(body[0]) == ActionReact && len(body) > 1+32+maxReaction {
+		err = errors.New("Reaction too long")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return true
+	}
+	action := Action{
+		ID:        env.ID,
+		Kind:      ActionKind(body[0]),
+		GroupID:   env.Payload[1:33],
+		Target:    body[1:33],
+		Sender:    env.Sender,
+		Timestamp: env.Timestamp,
+		Epoch:     keyEpoch(binary.BigEndian.Uint64(env.Payload[33:41])),
+		Data:      body[33:],
+	}
+	if !addAction(action) {
+		return true
+	}
+	hmutex.Lock()
+	handlers := _actionHandlers
+	hmutex.Unlock()
+	for _, handler := range handlers {
+		handler(action)
+	}
+	return true
+}
+
+//sendAction - sends an action to the group and applies it locally
+func sendAction(ctx context.Context, groupID []byte, kind ActionKind, target []byte, data []byte) error {
+	body, err := actionBody(kind, target, data)
+	if err != nil {
+		return err
+	}
+	group, exists := GetGroup(groupID)
+	if !exists {
+		return errors.New("Unknown group")
+	}
+	hmutex.Lock()
+	key := util.ToHexString(groupID)
+	var msg GroupMessage
+	i := findMessage(key, target)
+	if i >= 0 {
+		msg = _history.Messages[key][i]
+	}
+	hmutex.Unlock()
+	if i >= 0 && kind == ActionEdit && !bytes.Equal(msg.Sender, node.ID()) {
+		return errors.New("Only the sender can edit a message")
+	}
+	if i >= 0 && kind == ActionDelete && !bytes.Equal(msg.Sender, node.ID()) && !group.IsAdmin(node.ID()) {
+		return errors.New("Only the sender or an admin can delete a message")
+	}
+	sent, err := sendGroupPayload(ctx, commands.PayloadGroupAction, groupID, body)
+	if err != nil {
+		return err
+	}
+	addAction(Action{
+		ID:        sent.ID,
+		Kind:      kind,
+		GroupID:   groupID,
+		Target:    target,
+		Sender:    node.ID(),
+		Timestamp: sent.Timestamp,
+		Epoch:     sent.Epoch,
+		Data:      data,
+	})
+	return nil
+}
+
+//EditMessage - replaces the body of a message this node sent
+func EditMessage(ctx context.Context, groupID []byte, messageID []byte, body []byte) error {
+	return sendAction(ctx, groupID, ActionEdit, messageID, body)
+}
+
+//DeleteMessage - deletes a message for all members. Needs to be the sender
+//of the message or an admin
+func DeleteMessage(ctx context.Context, groupID []byte, messageID []byte) error {
+	return sendAction(ctx, groupID, ActionDelete, messageID, nil)
+}
+
+//React - reacts to a message with an emoji. An empty emoji takes the
+//reaction back
+func React(ctx context.Context, groupID []byte, messageID []byte, emoji string) error {
+	return sendAction(ctx, groupID, ActionReact, messageID, []byte(emoji))
+}
+
+//AddGroupActionHandler - registers a callback for incoming edits,
+//deletions and reactions
+func AddGroupActionHandler(handler func(Action)) {
+	hmutex.Lock()
+	_actionHandlers = append(_actionHandlers, handler)
+	hmutex.Unlock()
+}
+
+//entry - msg with the actions on it applied. Caller holds hmutex
+func entry(key string, msg GroupMessage) Entry {
+	e := Entry{GroupMessage: msg, Deleted: _history.Deleted[util.ToHexString(msg.ID)]}
+	reactions := make(map[string]Action)
+	for _, action := range _history.Actions[key] {
+		if !bytes.Equal(action.Target, msg.ID) {
+			continue
+		}
+		switch action.Kind {
+		case ActionEdit:
+			if bytes.Equal(action.Sender, msg.Sender) && action.Timestamp > e.Edited {
+				e.Edited = action.Timestamp
+				e.Body = action.Data
+			}
+		case ActionReact:
+			sender := util.ToHexString(action.Sender)
+			if newest, exists := reactions[sender]; !exists || action.Timestamp > newest.Timestamp {
+				reactions[sender] = action
+			}
+		}
+	}
+	if e.Deleted {
+		e.Body = nil
+		e.Edited = 0
+	}
+	for _, action := range reactions {
+		if len(action.Data) == 0 {
+			continue
+		}
+		if e.Reactions == nil {
+			e.Reactions = make(map[string][][]byte)
+		}
+		e.Reactions[string(action.Data)] = append(e.Reactions[string(action.Data)], action.Sender)
+	}
+	return e
+}
+
+//History - the messages of a group older than before, newest first, with
+//the edits, deletions and reactions applied. before 0 means now, limit 0
+//means all
+func History(groupID []byte, before uint64, limit int) []Entry {
+	key := util.ToHexString(groupID)
+	hmutex.Lock()
+	entries := make([]Entry, 0)
+	for _, msg := range _history.Messages[key] {
+		if before == 0 || msg.Timestamp < before {
+			entries = append(entries, entry(key, msg))
+		}
+	}
+	hmutex.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Timestamp > entries[j].Timestamp })
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+//GetEntry - a message of a group's history with the actions applied
+func GetEntry(groupID []byte, messageID []byte) (Entry, bool) {
+	key := util.ToHexString(groupID)
+	hmutex.Lock()
+	defer hmutex.Unlock()
+	i := findMessage(key, messageID)
+	if i < 0 {
+		return Entry{}, false
+	}
+	return entry(key, _history.Messages[key][i]), true
+}
+
+//saveHistorySoon - saves the history after historysaveinterval, together
+//with whatever else changes until then
+func saveHistorySoon() {
+	hmutex.Lock()
+	defer hmutex.Unlock()
+	if _savePending {
+		return
+	}
+	_savePending = true
+	time.AfterFunc(config.AttrDuration("historysaveinterval", 10*time.Second), func() {
+		err := saveHistory()
+		if err != nil {
+			fmt.Println(err)
+		}
+	})
+}
+
+func saveHistory() error {
+	hmutex.Lock()
+	defer hmutex.Unlock()
+	_savePending = false
+	return util.SaveGob(config.Attr("historyfile"), _history)
+}
+
+func loadHistory() error {
+	h := history{}
+	err := util.LoadGob(config.Attr("historyfile"), &h)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	hmutex.Lock()
+	if h.Messages != nil {
+		_history.Messages = h.Messages
+	}
+	if h.Actions != nil {
+		_history.Actions = h.Actions
+	}
+	if h.Deleted != nil {
+		_history.Deleted = h.Deleted
+	}
+	_messageIDs = make(map[string]bool)
+	for _, messages := range _history.Messages {
+		for _, msg := range messages {
+			_messageIDs[util.ToHexString(msg.ID)] = true
+		}
+	}
+	hmutex.Unlock()
+	return nil
+}
@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"mobchat/util"
+	"testing"
+)
+
+//testGroup - alice creates the group and adds bob and carol, then makes
+//carol admin at epoch 4. The history starts empty and isn't saved
+func testGroup(t *testing.T) (Group, map[string]testMember) {
+	t.Chdir(t.TempDir())
+	members := testMembers(t, "alice", "bob", "carol")
+	groupID := testID(t)
+	log := []Event{
+		signedEvent(t, members["alice"], EventCreate, groupID, members["alice"].id, 1),
+		signedEvent(t, members["alice"], EventAdd, groupID, members["bob"].id, 2),
+		signedEvent(t, members["alice"], EventAdd, groupID, members["carol"].id, 3),
+		signedEvent(t, members["alice"], EventAdminGrant, groupID, members["carol"].id, 4),
+	}
+	group, err := replay(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gmutex.Lock()
+	_groups[util.ToHexString(groupID)] = group
+	gmutex.Unlock()
+	hmutex.Lock()
+	_savePending = true
+	hmutex.Unlock()
+	t.Cleanup(func() {
+		gmutex.Lock()
+		delete(_groups, util.ToHexString(groupID))
+		gmutex.Unlock()
+		hmutex.Lock()
+		_savePending = false
+		hmutex.Unlock()
+	})
+	return *group, members
+}
+
+func resetHistory() {
+	hmutex.Lock()
+	_history = history{Messages: make(map[string][]GroupMessage), Actions: make(map[string][]Action), Deleted: make(map[string]bool)}
+	_messageIDs = make(map[string]bool)
+	hmutex.Unlock()
+}
+
+//permutations - every order of the indexes 0 to n-1
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	orders := make([][]int, 0)
+	for _, order := range permutations(n - 1) {
+		for i := 0; i <= len(order); i++ {
+			o := append(append(append([]int(nil), order[:i]...), n-1), order[i:]...)
+			orders = append(orders, o)
+		}
+	}
+	return orders
+}
+
+//TestHistoryOrder - a message from bob and actions on it arrive in every
+//order, and once more in reverse. The outcome is the same each time
+func TestHistoryOrder(t *testing.T) {
+	group, members := testGroup(t)
+
+	type act struct {
+		sender string
+		kind   ActionKind
+		ts     uint64
+		epoch  uint32
+		data   string
+	}
+	tests := []struct {
+		name      string
+		actions   []act
+		body      string
+		deleted   bool
+		reactions map[string]int
+	}{
+		{"no actions", nil, "hello", false, nil},
+		{"edit by the sender", []act{{"bob", ActionEdit, 2, 4, "edited"}}, "edited", false, nil},
+		{"edit by another member", []act{{"carol", ActionEdit, 2, 4, "edited"}}, "hello", false, nil},
+		{"newest edit wins", []act{{"bob", ActionEdit, 3, 4, "newer"}, {"bob", ActionEdit, 2, 4, "older"}},
+			"newer", false, nil},
+		{"deleted by the sender", []act{{"bob", ActionEdit, 2, 4, "edited"}, {"bob", ActionDelete, 3, 4, ""}},
+			"", true, nil},
+		{"deleted before an edit", []act{{"bob", ActionDelete, 2, 4, ""}, {"bob", ActionEdit, 3, 4, "edited"}},
+			"", true, nil},
+		{"deleted by an admin", []act{{"alice", ActionDelete, 2, 3, ""}}, "", true, nil},
+		{"deleted by a member", []act{{"carol", ActionDelete, 2, 3, ""}}, "hello", false, nil},
+		{"deleted by a later admin", []act{{"carol", ActionDelete, 2, 4, ""}}, "", true, nil},
+		{"deleted without an epoch", []act{{"alice", ActionDelete, 2, 0, ""}}, "hello", false, nil},
+		{"deleted at an unknown epoch", []act{{"carol", ActionDelete, 2, 9, ""}}, "hello", false, nil},
+		{"reactions", []act{{"bob", ActionReact, 2, 4, "+1"}, {"carol", ActionReact, 3, 4, "+1"},
+			{"alice", ActionReact, 4, 4, "<3"}}, "hello", false, map[string]int{"+1": 2, "<3": 1}},
+		{"newest reaction wins", []act{{"carol", ActionReact, 2, 4, "+1"}, {"carol", ActionReact, 3, 4, "<3"}},
+			"hello", false, map[string]int{"<3": 1}},
+		{"reaction taken back", []act{{"carol", ActionReact, 2, 4, "+1"}, {"carol", ActionReact, 3, 4, ""}},
+			"hello", false, nil},
+		{"reaction on a deleted message", []act{{"carol", ActionReact, 2, 4, "+1"}, {"bob", ActionDelete, 3, 4, ""}},
+			"", true, map[string]int{"+1": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := GroupMessage{
+				ID:        testID(t),
+				GroupID:   group.ID,
+				Sender:    members["bob"].id,
+				Timestamp: 1,
+				Body:      []byte("hello"),
+			}
+			actions := make([]Action, 0, len(tt.actions))
+			for _, a := range tt.actions {
+				actions = append(actions, Action{
+					ID:        testID(t),
+					Kind:      a.kind,
+					GroupID:   group.ID,
+					Target:    msg.ID,
+					Sender:    members[a.sender].id,
+					Timestamp: a.ts,
+					Epoch:     a.epoch,
+					Data:      []byte(a.data),
+				})
+			}
+			add := func(i int) {
+				if i == 0 {
+					addMessage(msg)
+				} else {
+					addAction(actions[i-1])
+				}
+			}
+
+			for _, order := range permutations(1 + len(actions)) {
+				resetHistory()
+				for _, i := range order {
+					add(i)
+				}
+				//duplicates change nothing
+				for j := len(order) - 1; j >= 0; j-- {
+					add(order[j])
+				}
+				e, ok := GetEntry(group.ID, msg.ID)
+				if !ok {
+					t.Fatalf("order %v: message missing", order)
+				}
+				if string(e.Body) != tt.body || e.Deleted != tt.deleted {
+					t.Fatalf("order %v: body %q, deleted %v", order, e.Body, e.Deleted)
+				}
+				if len(e.Reactions) != len(tt.reactions) {
+					t.Fatalf("order %v: reactions %d", order, len(e.Reactions))
+				}
+				for emoji, cnt := range tt.reactions {
+					if len(e.Reactions[emoji]) != cnt {
+						t.Fatalf("order %v: %d %s", order, len(e.Reactions[emoji]), emoji)
+					}
+				}
+			}
+		})
+	}
+	resetHistory()
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var conf map[string]string
@@ -15,6 +17,66 @@ func applyDefaults() {
 	conf["public"] = "true"
 	conf["maxincoming"] = "5"
 	conf["maxoutgoing"] = "5"
+	conf["pinginterval"] = "30s"
+	conf["maxmissedpongs"] = "3"
+	conf["sendqueuelen"] = "256"
+	conf["sendqueuepolicy"] = "dropoldest" //dropoldest, block or disconnect
+	conf["ratelimit"] = "50"               //messages per second per connection
+	conf["ratelimitburst"] = "100"
+	conf["banthreshold"] = "100"
+	conf["banduration"] = "24h"
+	conf["banfile"] = "bans.gob"
+	conf["maxdials"] = "3"
+	conf["dialtimeout"] = "10s"
+	conf["dialbackoff"] = "1s"
+	conf["dialbackoffmax"] = "5m"
+	conf["mailboxreplicas"] = "3"
+	conf["mailboxttl"] = "168h"
+	conf["mailboxquota"] = "500"          //messages per recipient
+	conf["mailboxquotabytes"] = "5242880" //bytes per recipient
+	conf["mailboxsenderquota"] = "100"    //messages per sender and recipient
+	conf["mailboxmaxbytes"] = "268435456" //bytes across all recipients
+	conf["mailboxfile"] = "mailbox.gob"
+	conf["retransmitbase"] = "5s"
+	conf["retransmitmax"] = "5m"
+	conf["messagettl"] = "24h"
+	conf["outboxfile"] = "outbox.gob"
+	conf["deliveredfile"] = "delivered.gob"
+	conf["prekeyfile"] = "prekeys.gob"
+	conf["groupsfile"] = "groups.gob"
+	conf["historyfile"] = "history.gob"
+	conf["historymax"] = "1000"
+	conf["historyorphans"] = "200"
+	conf["historysaveinterval"] = "10s"
+	conf["sessionfile"] = "sessions.gob"
+	conf["prekeybatch"] = "20"
+	conf["prekeyrotation"] = "168h"
+	conf["keyfile"] = "keystore.gob"
+	conf["keylabel"] = "node"
+	conf["revokedfile"] = "revoked.gob"
+	conf["keystatementsmax"] = "1000" //statements about unknown IDs held at once
+	conf["keystatementttl"] = "24h"
+	conf["contactsfile"] = "contacts.gob"
+	conf["recordfile"] = "records.gob"
+	conf["recordsmax"] = "10000"
+	conf["recordmissttl"] = "1m"
+	conf["dropfile"] = "drops.gob"
+	conf["dropfetchjitter"] = "1m"
+	conf["userfile"] = "user.gob"
+	conf["userlabel"] = "user"
+	conf["devicelistttl"] = "10m"
+	conf["profilefile"] = "profiles.gob"
+	conf["profilettl"] = "1h"
+	conf["invitefile"] = "invites.gob"
+	conf["invitettl"] = "168h"
+	conf["feedfile"] = "feed.gob"
+	conf["feedmaxposts"] = "5000"
+	conf["feedbatch"] = "50"
+	conf["feedpullinterval"] = "5m"
+	conf["feedmaxfollowers"] = "10000"
+	conf["feedmaxinteractions"] = "1000"
+	conf["feedmaxauthorinteractions"] = "50"
+	conf["linkto"] = "" //user ID to link this device to instead of creating a user
 }
 
 func initialize() {
@@ -37,3 +99,22 @@ func Attr(key string) string {
 	}
 	return conf[key]
 }
+
+//AttrInt - returns the attribute as an int, or def if unset or invalid
+func AttrInt(key string, def int) int {
+	i, err := strconv.Atoi(Attr(key))
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+//AttrDuration - returns the attribute as a duration (e.g. "30s"), or def if
+//unset or invalid
+func AttrDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(Attr(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
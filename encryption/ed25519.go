@@ -0,0 +1,167 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+//Ed25519 keys sign with Ed25519 and receive cypher keys over X25519: the
+//sender makes an ephemeral X25519 key, derives a wrapping key from the DH
+//with the recipient's box key and seals the cypher key with AES-GCM. The
+//wrapping key is used once, so the nonce can be fixed
+
+const (
+	wrapInfo     = "mobchat key wrap"
+	signSeedInfo = "mobchat ed25519 seed"
+	boxSeedInfo  = "mobchat x25519 seed"
+
+	//SeedLen - length of the seed an Ed25519 key is derived from
+	SeedLen = 16
+
+	//keyMarker - first byte after the checksum of a serialized key that has
+	//an algorithm tag. 1024 bit RSA keys have no marker, their first two
+	//bytes are 0x0000 (public) or the length of D (private)
+	keyMarker = 0xFF
+
+	ed25519KeyLen  = 2 + 3 + ed25519.PublicKeySize + 32
+	ed25519WrapLen = 32 + 32 + 16
+)
+
+//GenerateEd25519 - generates a new Ed25519 signing and X25519 encryption key
+//from a random seed, so it can be written down with Key.Mnemonic
+func GenerateEd25519() (Key, error) {
+	seed := make([]byte, SeedLen)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return Key{}, err
+	}
+	return KeyFromSeed(seed)
+}
+
+//KeyFromSeed - derives the signing and encryption keys from a seed. The
+//same seed always gives the same key and so the same ID
+func KeyFromSeed(seed []byte) (Key, error) {
+	if len(seed) != SeedLen {
+		return Key{}, errors.New("Invalid seed length")
+	}
+	signSeed, err := hkdf.Key(sha256.New, seed, nil, signSeedInfo, ed25519.SeedSize)
+	if err != nil {
+		return Key{}, err
+	}
+	boxPriv, err := hkdf.Key(sha256.New, seed, nil, boxSeedInfo, 32)
+	if err != nil {
+		return Key{}, err
+	}
+	boxPub, err := X25519Public(boxPriv)
+	if err != nil {
+		return Key{}, err
+	}
+	signPriv := ed25519.NewKeyFromSeed(signSeed)
+	return Key{
+		Algorithm:   AlgEd25519,
+		Seed:        append([]byte(nil), seed...),
+		SignPrivate: signPriv,
+		SignPublic:  signPriv.Public().(ed25519.PublicKey),
+		BoxPrivate:  boxPriv,
+		BoxPublic:   boxPub,
+	}, nil
+}
+
+//serializeEd25519 - marker, algorithm, kind, then the public keys, the
+//Ed25519 seed and the X25519 private key, or the seed both are derived from
+func serializeEd25519(key *Key) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{keyMarker, byte(AlgEd25519)})
+	if key.Seed != nil {
+		buf.WriteByte(0x02)
+		buf.Write(key.Seed)
+	} else if key.SignPrivate != nil {
+		buf.WriteByte(0x01)
+		buf.Write(key.SignPrivate.Seed())
+		buf.Write(key.BoxPrivate)
+	} else {
+		if key.SignPublic == nil {
+			return nil, errors.New("Need to have either a public or private key. Both can't be nil")
+		}
+		buf.WriteByte(0x00)
+		buf.Write(key.SignPublic)
+		buf.Write(key.BoxPublic)
+	}
+	return buf.Bytes(), nil
+}
+
+func deserializeEd25519(data []byte) (Key, error) {
+	if len(data) == 1+SeedLen && data[0] == 0x02 {
+		return KeyFromSeed(data[1:])
+	}
+	if len(data) != 1+ed25519.PublicKeySize+32 {
+		return Key{}, errors.New("Invalid Ed25519 key length")
+	}
+	key := Key{Algorithm: AlgEd25519}
+	if data[0] == 0x01 {
+		key.SignPrivate = ed25519.NewKeyFromSeed(data[1 : 1+ed25519.SeedSize])
+		key.SignPublic = key.SignPrivate.Public().(ed25519.PublicKey)
+		key.BoxPrivate = append([]byte(nil), data[1+ed25519.SeedSize:]...)
+		boxPub, err := X25519Public(key.BoxPrivate)
+		if err != nil {
+			return Key{}, err
+		}
+		key.BoxPublic = boxPub
+		return key, nil
+	}
+	key.SignPublic = append(ed25519.PublicKey(nil), data[1:1+ed25519.PublicKeySize]...)
+	key.BoxPublic = append([]byte(nil), data[1+ed25519.PublicKeySize:]...)
+	return key, nil
+}
+
+func wrapAEAD(dh []byte, ephPub []byte, recipientPub []byte) (cipher.AEAD, error) {
+	wrapKey, err := DeriveSecret(wrapInfo, dh, ephPub, recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+//wrapX25519 - ephemeral public key followed by the sealed cypher key
+func wrapX25519(recipientPub []byte, cipherKey []byte) ([]byte, error) {
+	ephPriv, ephPub, err := GenerateX25519()
+	if err != nil {
+		return nil, err
+	}
+	dh, err := X25519(ephPriv, recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := wrapAEAD(dh, ephPub, recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	return gcm.Seal(ephPub, nonce, cipherKey, nil), nil
+}
+
+func unwrapX25519(key Key, wrapped []byte) ([]byte, error) {
+	if len(wrapped) != ed25519WrapLen {
+		return nil, errors.New("Invalid wrapped key length")
+	}
+	dh, err := X25519(key.BoxPrivate, wrapped[:32])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := wrapAEAD(dh, wrapped[:32], key.BoxPublic)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	return gcm.Open(nil, nonce, wrapped[32:], nil)
+}
@@ -31,8 +31,11 @@ func SignAndEncrypt(body []byte, senderKey Key, recipientKey Key) ([]byte, error
 
 //ValidateSigAndDecrypt -
 func ValidateSigAndDecrypt(senderKey Key, recipientKey Key, body []byte) ([]byte, error) {
-	sig := body[0:SigLen]
-	msg := body[SigLen:]
+	if !senderKey.HasPublic() || len(body) < senderKey.SigLen() {
+		return nil, errors.New("Message too short")
+	}
+	sig := body[0:senderKey.SigLen()]
+	msg := body[senderKey.SigLen():]
 	isValid := ValidateSig(senderKey, sig, msg)
 	if !isValid {
 		return nil, errors.New("Invalid signature")
@@ -0,0 +1,110 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Fingerprints follow the Signal safety number scheme: the public key and ID
+//are hashed many times with SHA-512, which makes it expensive to search for
+//a second key with a similar fingerprint. The safety number of two keys is
+//both fingerprints in a fixed order, so both sides see the same digits
+
+const (
+	fingerprintVersion    = 0
+	fingerprintIterations = 5200
+	fingerprintLen        = 30
+	safetyNumberDigits    = 60
+)
+
+//Fingerprint - iterated hash of the public key and its ID
+func (key Key) Fingerprint() ([]byte, error) {
+	pub := key.PublicKey()
+	serialized, err := pub.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, fingerprintVersion)
+	hash := append(append(version, serialized...), key.ID()...)
+	for i := 0; i < fingerprintIterations; i++ {
+		h := sha512.New()
+		h.Write(hash)
+		h.Write(serialized)
+		hash = h.Sum(nil)
+	}
+	return hash[:fingerprintLen], nil
+}
+
+//FingerprintString - the fingerprint as groups of four hex characters
+func (key Key) FingerprintString() (string, error) {
+	fp, err := key.Fingerprint()
+	if err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(fp)
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+//digits - 30 digits for a fingerprint, 5 for each 5 byte chunk
+func digits(fp []byte) string {
+	var sb strings.Builder
+	for i := 0; i+5 <= len(fp); i += 5 {
+		chunk := uint64(0)
+		for _, b := range fp[i : i+5] {
+			chunk = chunk<<8 | uint64(b)
+		}
+		fmt.Fprintf(&sb, "%05d", chunk%100000)
+	}
+	return sb.String()
+}
+
+//SafetyNumber - 60 digits in groups of five that two parties can compare
+//out of band. It is the same whichever key is passed first
+func SafetyNumber(a Key, b Key) (string, error) {
+	fpA, err := a.Fingerprint()
+	if err != nil {
+		return "", err
+	}
+	fpB, err := b.Fingerprint()
+	if err != nil {
+		return "", err
+	}
+	if bytes.Compare(a.ID(), b.ID()) > 0 {
+		fpA, fpB = fpB, fpA
+	}
+	number := digits(fpA) + digits(fpB)
+	groups := make([]string, 0, safetyNumberDigits/5)
+	for i := 0; i < len(number); i += 5 {
+		groups = append(groups, number[i:i+5])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+//CompareSafetyNumber - checks a safety number read from the other party.
+//Spaces and other separators are ignored
+func CompareSafetyNumber(a Key, b Key, number string) error {
+	expected, err := SafetyNumber(a, b)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+		}
+	}
+	if sb.String() != strings.ReplaceAll(expected, " ", "") {
+		return errors.New("Safety number doesn't match")
+	}
+	return nil
+}
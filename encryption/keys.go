@@ -5,6 +5,7 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -15,17 +16,83 @@ import (
 )
 
 const (
-	//EncryptedCypherKeyLen -
-	EncryptedCypherKeyLen = 128
+	//rsaLegacyLen - modulus length of the 1024 bit RSA keys of existing
+	//IDs, whose public keys are serialized without a marker
+	rsaLegacyLen = 128
 
-	//SigLen -
-	SigLen = 128
+	//MinSigLen - length of the shortest signature of any algorithm
+	MinSigLen = ed25519.SignatureSize
 )
 
-//Key -
+//Algorithm - what a Key is used with
+type Algorithm byte
+
+const (
+	//AlgRSA - RSA-PSS signatures and RSA-OAEP key wrapping. Only kept for
+	//existing IDs
+	AlgRSA Algorithm = 0x00
+
+	//AlgEd25519 - Ed25519 signatures and X25519 key wrapping
+	AlgEd25519 Algorithm = 0x01
+)
+
+//Key - a signing and encryption key pair. Which fields are set depends on
+//Algorithm
 type Key struct {
+	Algorithm Algorithm
+
 	Private *rsa.PrivateKey
 	Public  *rsa.PublicKey
+
+	Seed        []byte //what the Ed25519 keys were derived from, if known
+	SignPrivate ed25519.PrivateKey
+	SignPublic  ed25519.PublicKey
+	BoxPrivate  []byte //X25519
+	BoxPublic   []byte //X25519
+}
+
+//PublicKey - the key without its private parts
+func (key Key) PublicKey() Key {
+	if key.Algorithm == AlgEd25519 {
+		return Key{
+			Algorithm:  AlgEd25519,
+			SignPublic: key.SignPublic,
+			BoxPublic:  key.BoxPublic,
+		}
+	}
+	return Key{Public: key.Public}
+}
+
+//HasPublic - whether the key can verify signatures and wrap cypher keys
+func (key Key) HasPublic() bool {
+	if key.Algorithm == AlgEd25519 {
+		return key.SignPublic != nil && key.BoxPublic != nil
+	}
+	return key.Public != nil
+}
+
+//ID - sha256 of the public key, used as node ID
+func (key Key) ID() []byte {
+	if key.Algorithm == AlgEd25519 {
+		return sha(append(append([]byte(nil), key.SignPublic...), key.BoxPublic...))
+	}
+	return sha(key.Public.N.Bytes())
+}
+
+//SigLen - length of the signatures made with this key
+func (key Key) SigLen() int {
+	if key.Algorithm == AlgEd25519 {
+		return ed25519.SignatureSize
+	}
+	return key.Public.Size()
+}
+
+//WrapLen - length of a cypher key wrapped for this key
+func (key Key) WrapLen() int {
+	if key.Algorithm == AlgEd25519 {
+		return ed25519WrapLen
+	}
+	return key.Public.Size()
 }
 
 func sha(b []byte) []byte {
@@ -108,15 +175,28 @@ func check(data []byte) (bool, []byte) {
 	return true, data[2:]
 }
 
-//Serialize -
+//Serialize - checksum followed by the key. Ed25519 keys start with a marker
+//and their algorithm, RSA keys keep their original untagged layout
 func (key *Key) Serialize() ([]byte, error) {
 	var buf bytes.Buffer
-	if key.Private == nil {
+	if key.Algorithm == AlgEd25519 {
+		data, err := serializeEd25519(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	} else if key.Private == nil {
 		if key.Public == nil {
 			return nil, errors.New("Need to have either a public or private key. Both can't be nil")
 		}
-		buf.Write([]byte{0x00, 0x00})
-		buf.Write(serializePub(key.Public))
+		n := serializePub(key.Public)
+		if len(n) == rsaLegacyLen {
+			buf.Write([]byte{0x00, 0x00})
+		} else {
+			//other sizes are tagged, so their length can be read
+			buf.Write([]byte{keyMarker, byte(AlgRSA), byte(len(n) >> 8), byte(len(n))})
+		}
+		buf.Write(n)
 	} else {
 		priv := serializePriv(key.Private)
 		buf.Write(priv)
@@ -127,12 +207,58 @@ func (key *Key) Serialize() ([]byte, error) {
 	return result, nil
 }
 
+//SerializedLen - length of the serialized public key at the start of data,
+//so keys can be embedded in other messages
+func SerializedLen(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, errors.New("Key too short")
+	}
+	ln := 2 + 2 + rsaLegacyLen
+	if data[2] == keyMarker {
+		switch Algorithm(data[3]) {
+		case AlgEd25519:
+			ln = ed25519KeyLen
+		case AlgRSA:
+			if len(data) < 6 {
+				return 0, errors.New("Key too short")
+			}
+			ln = 2 + 2 + 2 + int(binary.BigEndian.Uint16(data[4:6]))
+		default:
+			return 0, errors.New("Unknown key algorithm")
+		}
+	} else if data[2] != 0x00 || data[3] != 0x00 {
+		return 0, errors.New("Not a public key")
+	}
+	if len(data) < ln {
+		return 0, errors.New("Key too short")
+	}
+	return ln, nil
+}
+
 //Deserialize -
 func Deserialize(key []byte) (Key, error) {
+	if len(key) < 4 {
+		return Key{}, errors.New("Key too short")
+	}
 	valid, checked := check(key)
 	if !valid {
 		return Key{}, errors.New("Checksum not valid")
 	}
+	if checked[0] == keyMarker {
+		switch Algorithm(checked[1]) {
+		case AlgEd25519:
+			return deserializeEd25519(checked[2:])
+		case AlgRSA:
+			if len(checked) < 4 || len(checked) != 4+int(binary.BigEndian.Uint16(checked[2:4])) {
+				return Key{}, errors.New("Invalid RSA key length")
+			}
+			pubKey := deserializePub(checked[4:])
+			return Key{
+				Public: &pubKey,
+			}, nil
+		}
+		return Key{}, errors.New("Unknown key algorithm")
+	}
 	len := binary.BigEndian.Uint16(checked[0:2])
 	if len == 0 {
 		pubKey := deserializePub(checked[2:])
@@ -154,7 +280,7 @@ func Deserialize(key []byte) (Key, error) {
 	}, nil
 }
 
-//Generate - generates a new Key
+//Generate - generates a new RSA Key. New IDs use GenerateEd25519
 func Generate(bits int) (Key, error) {
 	privkey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
@@ -176,6 +302,9 @@ func GetCipherKey() []byte {
 
 //EncryptCypherKey -
 func EncryptCypherKey(recipientKey Key, cipherkey []byte) ([]byte, error) {
+	if recipientKey.Algorithm == AlgEd25519 {
+		return wrapX25519(recipientKey.BoxPublic, cipherkey)
+	}
 	hash := sha256.New()
 	label := []byte("")
 	return rsa.EncryptOAEP(hash, rand.Reader, recipientKey.Public, cipherkey, label)
@@ -213,6 +342,9 @@ func Encrypt(recipientKeys []Key, msg []byte, cipherKey []byte) ([]byte, error)
 		if err != nil {
 			return nil, err
 		}
+		ln := make([]byte, 2)
+		binary.BigEndian.PutUint16(ln, uint16(len(encryptedCypherKey)))
+		buf.Write(ln)
 		buf.Write(encryptedCypherKey)
 	}
 
@@ -228,6 +360,12 @@ func Encrypt(recipientKeys []Key, msg []byte, cipherKey []byte) ([]byte, error)
 
 //Sign -
 func Sign(senderKey Key, msg []byte) ([]byte, error) {
+	if senderKey.Algorithm == AlgEd25519 {
+		if senderKey.SignPrivate == nil {
+			return nil, errors.New("Missing private key")
+		}
+		return ed25519.Sign(senderKey.SignPrivate, msg), nil
+	}
 
 	var opts rsa.PSSOptions
 	opts.SaltLength = rsa.PSSSaltLengthEqualsHash
@@ -250,6 +388,9 @@ func Sign(senderKey Key, msg []byte) ([]byte, error) {
 
 //DecryptCypher -
 func DecryptCypher(recipientKey Key, encryptedCypherKey []byte) ([]byte, error) {
+	if recipientKey.Algorithm == AlgEd25519 {
+		return unwrapX25519(recipientKey, encryptedCypherKey)
+	}
 	hash := sha256.New()
 	label := []byte("")
 	cypher, err := rsa.DecryptOAEP(
@@ -265,6 +406,41 @@ func DecryptCypher(recipientKey Key, encryptedCypherKey []byte) ([]byte, error)
 	return cypher, nil
 }
 
+//DecryptMultiple - decrypts a message built by Encrypt using the cypher key
+//wrapped for the recipient at index idx
+func DecryptMultiple(key Key, idx int, msg []byte) ([]byte, error) {
+	if len(msg) < 2 {
+		return nil, errors.New("Message too short")
+	}
+	numKeys := int(binary.BigEndian.Uint16(msg[0:2]))
+	if idx < 0 || idx >= numKeys {
+		return nil, errors.New("Not a recipient of this message")
+	}
+	var wrap []byte
+	start := 2
+	for i := 0; i < numKeys; i++ {
+		if len(msg) < start+2 {
+			return nil, errors.New("Message too short")
+		}
+		ln := int(binary.BigEndian.Uint16(msg[start : start+2]))
+		if len(msg) < start+2+ln {
+			return nil, errors.New("Message too short")
+		}
+		if i == idx {
+			wrap = msg[start+2 : start+2+ln]
+		}
+		start += 2 + ln
+	}
+	if len(msg) <= start {
+		return nil, errors.New("Message too short")
+	}
+	cypher, err := DecryptCypher(key, wrap)
+	if err != nil {
+		return nil, errors.New("Key cannot unlock this message")
+	}
+	return DecryptMessage(cypher, msg[start:])
+}
+
 //DecryptMessage -
 func DecryptMessage(key []byte, encryptedMsg []byte) ([]byte, error) {
 	c, err := aes.NewCipher(sha(key))
@@ -276,6 +452,9 @@ func DecryptMessage(key []byte, encryptedMsg []byte) ([]byte, error) {
 		return nil, err
 	}
 	nonceSize := gcm.NonceSize()
+	if len(encryptedMsg) < nonceSize {
+		return nil, errors.New("Message too short")
+	}
 	nonce, encryptedMsg := encryptedMsg[:nonceSize], encryptedMsg[nonceSize:]
 	msg, err := gcm.Open(nil, nonce, encryptedMsg, nil)
 	if err != nil {
@@ -286,18 +465,25 @@ func DecryptMessage(key []byte, encryptedMsg []byte) ([]byte, error) {
 
 //Decrypt -
 func Decrypt(key Key, msg []byte) ([]byte, error) {
-	cypher, err := DecryptCypher(key, msg[0:EncryptedCypherKeyLen])
+	wrapLen := key.WrapLen()
+	if len(msg) <= wrapLen {
+		return nil, errors.New("Message too short")
+	}
+	cypher, err := DecryptCypher(key, msg[0:wrapLen])
 	if err != nil {
 		return nil, errors.New("Key cannot unlock this message")
 	}
-	return DecryptMessage(cypher, msg)
+	return DecryptMessage(cypher, msg[wrapLen:])
 }
 
 //ValidateSig -
 func ValidateSig(senderKey Key, sig []byte, msg []byte) bool {
-	if senderKey.Public == nil || len(sig) < SigLen {
+	if !senderKey.HasPublic() || len(sig) != senderKey.SigLen() {
 		return false
 	}
+	if senderKey.Algorithm == AlgEd25519 {
+		return ed25519.Verify(senderKey.SignPublic, msg, sig)
+	}
 	hash := crypto.SHA256
 	pssh := hash.New()
 	pssh.Write(msg)
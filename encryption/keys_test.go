@@ -0,0 +1,93 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeySerialization(t *testing.T) {
+	tests := []struct {
+		name     string
+		generate func() (Key, error)
+	}{
+		{"rsa 1024", func() (Key, error) { return Generate(1024) }},
+		{"rsa 2048", func() (Key, error) { return Generate(2048) }},
+		{"ed25519", GenerateEd25519},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := tt.generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := key.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv, err := Deserialize(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if priv.Algorithm != key.Algorithm || !bytes.Equal(priv.ID(), key.ID()) {
+				t.Fatal("private key changed in the round trip")
+			}
+			sig, err := Sign(priv, []byte("signed"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ValidateSig(key, sig, []byte("signed")) {
+				t.Fatal("restored key signs differently")
+			}
+
+			pub := key.PublicKey()
+			data, err = pub.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			//public keys are embedded in other messages
+			ln, err := SerializedLen(append(append([]byte(nil), data...), 0x01, 0x02, 0x03))
+			if err != nil || ln != len(data) {
+				t.Fatalf("SerializedLen %d, %v, want %d", ln, err, len(data))
+			}
+			restored, err := Deserialize(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !restored.HasPublic() || !bytes.Equal(restored.ID(), key.ID()) {
+				t.Fatal("public key changed in the round trip")
+			}
+			if !ValidateSig(restored, sig, []byte("signed")) {
+				t.Fatal("restored public key doesn't verify")
+			}
+
+			data[len(data)-1] ^= 0x01
+			_, err = Deserialize(data)
+			if err == nil {
+				t.Fatal("accepted a key with a bad checksum")
+			}
+		})
+	}
+}
+
+func TestSerializedLenRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"too short", []byte{0x00, 0x00, 0x00}},
+		{"private rsa", []byte{0x00, 0x00, 0x01, 0x00, 0x00}},
+		{"unknown algorithm", []byte{0x00, 0x00, keyMarker, 0x7F, 0x00}},
+		{"truncated ed25519", []byte{0x00, 0x00, keyMarker, byte(AlgEd25519), 0x00}},
+		{"truncated rsa", []byte{0x00, 0x00, keyMarker, byte(AlgRSA), 0x01, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SerializedLen(tt.data)
+			if err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math/bits"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+//The keystore keeps private keys on disk encrypted with a key derived from
+//a passphrase with scrypt. Public keys and metadata stay readable so the
+//keys can be listed without the passphrase. Each entry has its own salt,
+//so changing the passphrase of one entry doesn't touch the others
+
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	saltLen = 16
+
+	//maxScryptN - limit for entries from Import, whose parameters aren't ours
+	maxScryptN = 1 << 20
+)
+
+//KeyInfo - metadata of a keystore entry
+type KeyInfo struct {
+	Label     string
+	Algorithm Algorithm
+	Created   time.Time
+	ID        []byte
+}
+
+type keystoreEntry struct {
+	Info   KeyInfo
+	Public []byte //serialized public key
+	Salt   []byte
+	N      int
+	R      int
+	P      int
+	Sealed []byte //nonce followed by the encrypted serialized private key
+}
+
+//Keystore - passphrase protected private keys stored in a file
+type Keystore struct {
+	path    string
+	entries map[string]*keystoreEntry
+	mu      sync.Mutex
+}
+
+//OpenKeystore - loads the keystore at path. A missing file is an empty
+//keystore, it is created by the first Add
+func OpenKeystore(path string) (*Keystore, error) {
+	ks := &Keystore{
+		path:    path,
+		entries: make(map[string]*keystoreEntry),
+	}
+	err := util.LoadGob(path, &ks.entries)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func passphraseAEAD(passphrase string, entry *keystoreEntry) (cipher.AEAD, error) {
+	if entry.N > maxScryptN || entry.R*entry.P > 1<<10 {
+		return nil, errors.New("Keystore parameters out of range")
+	}
+	key, err := scrypt.Key([]byte(passphrase), entry.Salt, entry.N, entry.R, entry.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+//seal - encrypts the private key with a fresh salt and the current scrypt
+//parameters. The label is bound as additional data
+func (entry *keystoreEntry) seal(key Key, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("Passphrase can't be empty")
+	}
+	priv, err := key.Serialize()
+	if err != nil {
+		return err
+	}
+	entry.Salt = make([]byte, saltLen)
+	if _, err = io.ReadFull(rand.Reader, entry.Salt); err != nil {
+		return err
+	}
+	entry.N, entry.R, entry.P = scryptN, scryptR, scryptP
+	gcm, err := passphraseAEAD(passphrase, entry)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	entry.Sealed = gcm.Seal(nonce, nonce, priv, []byte(entry.Info.Label))
+	return nil
+}
+
+func (entry *keystoreEntry) open(passphrase string) (Key, error) {
+	gcm, err := passphraseAEAD(passphrase, entry)
+	if err != nil {
+		return Key{}, err
+	}
+	if len(entry.Sealed) < gcm.NonceSize() {
+		return Key{}, errors.New("Corrupt keystore entry")
+	}
+	nonce, sealed := entry.Sealed[:gcm.NonceSize()], entry.Sealed[gcm.NonceSize():]
+	priv, err := gcm.Open(nil, nonce, sealed, []byte(entry.Info.Label))
+	if err != nil {
+		return Key{}, errors.New("Wrong passphrase")
+	}
+	return Deserialize(priv)
+}
+
+//save - caller holds mu
+func (ks *Keystore) save() error {
+	return util.SaveGob(ks.path, ks.entries)
+}
+
+//Add - stores key under label, encrypted with passphrase
+func (ks *Keystore) Add(label string, key Key, passphrase string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, exists := ks.entries[label]; exists {
+		return errors.New("Key " + label + " already exists")
+	}
+	pub := key.PublicKey()
+	public, err := pub.Serialize()
+	if err != nil {
+		return err
+	}
+	entry := &keystoreEntry{
+		Info: KeyInfo{
+			Label:     label,
+			Algorithm: key.Algorithm,
+			Created:   time.Now(),
+			ID:        key.ID(),
+		},
+		Public: public,
+	}
+	err = entry.seal(key, passphrase)
+	if err != nil {
+		return err
+	}
+	ks.entries[label] = entry
+	return ks.save()
+}
+
+//Has - whether there is a key with this label
+func (ks *Keystore) Has(label string) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	_, exists := ks.entries[label]
+	return exists
+}
+
+//Keys - metadata of all stored keys
+func (ks *Keystore) Keys() []KeyInfo {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	infos := make([]KeyInfo, 0, len(ks.entries))
+	for _, entry := range ks.entries {
+		infos = append(infos, entry.Info)
+	}
+	return infos
+}
+
+//PublicKey - the public key stored under label, no passphrase needed
+func (ks *Keystore) PublicKey(label string) (Key, error) {
+	ks.mu.Lock()
+	entry, exists := ks.entries[label]
+	ks.mu.Unlock()
+	if !exists {
+		return Key{}, errors.New("No key " + label)
+	}
+	return Deserialize(entry.Public)
+}
+
+//Unlock - decrypts the key stored under label
+func (ks *Keystore) Unlock(label string, passphrase string) (Key, error) {
+	ks.mu.Lock()
+	entry, exists := ks.entries[label]
+	ks.mu.Unlock()
+	if !exists {
+		return Key{}, errors.New("No key " + label)
+	}
+	return entry.open(passphrase)
+}
+
+//ChangePassphrase - re-encrypts the key stored under label with a new
+//passphrase and salt
+func (ks *Keystore) ChangePassphrase(label string, oldPassphrase string, newPassphrase string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	entry, exists := ks.entries[label]
+	if !exists {
+		return errors.New("No key " + label)
+	}
+	key, err := entry.open(oldPassphrase)
+	if err != nil {
+		return err
+	}
+	changed := *entry
+	err = changed.seal(key, newPassphrase)
+	if err != nil {
+		return err
+	}
+	ks.entries[label] = &changed
+	err = ks.save()
+	if err != nil {
+		ks.entries[label] = entry
+	}
+	return err
+}
+
+//Remove - deletes the key stored under label. Needs the passphrase so a
+//key can't be thrown away by mistake
+func (ks *Keystore) Remove(label string, passphrase string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	entry, exists := ks.entries[label]
+	if !exists {
+		return errors.New("No key " + label)
+	}
+	if _, err := entry.open(passphrase); err != nil {
+		return err
+	}
+	delete(ks.entries, label)
+	return ks.save()
+}
+
+//Export - the entry stored under label, still encrypted with its
+//passphrase, to be moved to another keystore with Import
+func (ks *Keystore) Export(label string) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	entry, exists := ks.entries[label]
+	if !exists {
+		return nil, errors.New("No key " + label)
+	}
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(entry)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//Import - adds an entry made by Export. The passphrase is checked so a
+//corrupt or foreign export is rejected before it is stored
+func (ks *Keystore) Import(data []byte, passphrase string) (KeyInfo, error) {
+	entry := &keystoreEntry{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	key, err := entry.open(passphrase)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	if !bytes.Equal(key.ID(), entry.Info.ID) {
+		return KeyInfo{}, errors.New("Exported key doesn't match its metadata")
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, exists := ks.entries[entry.Info.Label]; exists {
+		return KeyInfo{}, errors.New("Key " + entry.Info.Label + " already exists")
+	}
+	ks.entries[entry.Info.Label] = entry
+	return entry.Info, ks.save()
+}
+
+//SealWithPassphrase - encrypts data for files outside the keystore, such as
+//backups. Salt, scrypt cost (log2 N) and nonce are stored with the data
+func SealWithPassphrase(passphrase string, data []byte) ([]byte, error) {
+	sealer, err := NewPassphraseSealer(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return sealer.Seal(data)
+}
+
+//PassphraseSealer - seals data like SealWithPassphrase, but derives the
+//key once, for files that are written often. OpenWithPassphrase opens it
+type PassphraseSealer struct {
+	salt []byte
+	gcm  cipher.AEAD
+}
+
+//NewPassphraseSealer -
+func NewPassphraseSealer(passphrase string) (*PassphraseSealer, error) {
+	if passphrase == "" {
+		return nil, errors.New("Passphrase can't be empty")
+	}
+	params := &keystoreEntry{Salt: make([]byte, saltLen), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := io.ReadFull(rand.Reader, params.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := passphraseAEAD(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	return &PassphraseSealer{salt: params.Salt, gcm: gcm}, nil
+}
+
+//Seal -
+func (sealer *PassphraseSealer) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, sealer.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	var buff bytes.Buffer
+	buff.Write(sealer.salt)
+	buff.WriteByte(byte(bits.Len(uint(scryptN)) - 1))
+	buff.Write(nonce)
+	return sealer.gcm.Seal(buff.Bytes(), nonce, data, nil), nil
+}
+
+//OpenWithPassphrase - decrypts data sealed with SealWithPassphrase
+func OpenWithPassphrase(passphrase string, sealed []byte) ([]byte, error) {
+	if len(sealed) < saltLen+1 {
+		return nil, errors.New("Sealed data too short")
+	}
+	params := &keystoreEntry{Salt: sealed[:saltLen], N: 1 << sealed[saltLen], R: scryptR, P: scryptP}
+	gcm, err := passphraseAEAD(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	start := saltLen + 1 + gcm.NonceSize()
+	if len(sealed) < start {
+		return nil, errors.New("Sealed data too short")
+	}
+	data, err := gcm.Open(nil, sealed[saltLen+1:start], sealed[start:], nil)
+	if err != nil {
+		return nil, errors.New("Wrong passphrase")
+	}
+	return data, nil
+}
@@ -0,0 +1,57 @@
+package encryption
+
+import (
+	"errors"
+	"strings"
+)
+
+//A mnemonic is the seed of a key written as words, one word per byte,
+//followed by two checksum words. Words can be shortened to their first four
+//letters
+
+const mnemonicChecksumLen = 2
+
+//Mnemonic - the key's seed as a phrase of words. Only keys made from a seed
+//have one
+func (key Key) Mnemonic() (string, error) {
+	if key.Seed == nil {
+		return "", errors.New("Key has no seed")
+	}
+	data := append(append([]byte(nil), key.Seed...), sha(key.Seed)[:mnemonicChecksumLen]...)
+	words := make([]string, len(data))
+	for i, b := range data {
+		words[i] = wordlist[b]
+	}
+	return strings.Join(words, " "), nil
+}
+
+func wordIndex(word string) (byte, bool) {
+	for i, w := range wordlist {
+		if w == word || (len(word) >= 4 && strings.HasPrefix(w, word)) {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+//KeyFromMnemonic - recreates the key written down with Mnemonic
+func KeyFromMnemonic(phrase string) (Key, error) {
+	words := strings.Fields(strings.ToLower(phrase))
+	if len(words) != SeedLen+mnemonicChecksumLen {
+		return Key{}, errors.New("Mnemonic needs to have 18 words")
+	}
+	data := make([]byte, len(words))
+	for i, word := range words {
+		b, ok := wordIndex(word)
+		if !ok {
+			return Key{}, errors.New("Unknown word " + word)
+		}
+		data[i] = b
+	}
+	seed := data[:SeedLen]
+	checksum := sha(seed)[:mnemonicChecksumLen]
+	if string(checksum) != string(data[SeedLen:]) {
+		return Key{}, errors.New("Invalid mnemonic checksum")
+	}
+	return KeyFromSeed(seed)
+}
@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMnemonic(t *testing.T) {
+	key, err := GenerateEd25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	phrase, err := key.Mnemonic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := strings.Fields(phrase)
+	swapped := append([]string(nil), words...)
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	changed := append([]string(nil), words...)
+	for _, w := range wordlist {
+		if w != changed[3] {
+			changed[3] = w
+			break
+		}
+	}
+	short := make([]string, len(words))
+	for i, w := range words {
+		if len(w) > 4 {
+			w = w[:4]
+		}
+		short[i] = w
+	}
+
+	tests := []struct {
+		name   string
+		phrase string
+		ok     bool
+	}{
+		{"as written", phrase, true},
+		{"upper case and spaces", "  " + strings.ToUpper(strings.Join(words, "   ")) + " ", true},
+		{"shortened words", strings.Join(short, " "), true},
+		{"swapped words", strings.Join(swapped, " "), words[0] == words[1]},
+		{"changed word", strings.Join(changed, " "), false},
+		{"missing word", strings.Join(words[1:], " "), false},
+		{"extra word", phrase + " " + words[0], false},
+		{"unknown word", strings.Join(append([]string{"xyzzy"}, words[1:]...), " "), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored, err := KeyFromMnemonic(tt.phrase)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored.ID(), key.ID()) {
+				t.Fatal("restored a different key")
+			}
+		})
+	}
+}
+
+func TestMnemonicNeedsSeed(t *testing.T) {
+	tests := []struct {
+		name string
+		key  func() (Key, error)
+	}{
+		{"rsa", func() (Key, error) { return Generate(1024) }},
+		{"public ed25519", func() (Key, error) {
+			key, err := GenerateEd25519()
+			return key.PublicKey(), err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := tt.key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = key.Mnemonic()
+			if err == nil {
+				t.Fatal("key without a seed has a mnemonic")
+			}
+		})
+	}
+}
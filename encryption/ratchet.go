@@ -0,0 +1,300 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+//Double Ratchet (https://signal.org/docs/specifications/doubleratchet/)
+//with X25519, HKDF-SHA256, HMAC-SHA256 chains and AES-GCM. Every message
+//gets its own key and keys are deleted once used, so a leaked state does
+//not expose earlier messages (forward secrecy), and the DH ratchet heals
+//the session after a compromise once both sides have sent again
+
+const (
+	//RatchetHeaderLen - ratchet public key, previous chain length, message number
+	RatchetHeaderLen = 32 + 4 + 4
+
+	//MaxSkip - most message keys kept for messages that haven't arrived yet
+	MaxSkip = 1000
+
+	rootInfo    = "mobchat ratchet root"
+	messageInfo = "mobchat ratchet message"
+)
+
+//Ratchet - Double Ratchet session state. Fields are exported so the state
+//can be persisted with gob
+type Ratchet struct {
+	DHs     []byte //own ratchet private key
+	DHr     []byte //remote ratchet public key
+	RK      []byte
+	CKs     []byte
+	CKr     []byte
+	Ns      uint32
+	Nr      uint32
+	PN      uint32
+	Skipped map[string][]byte //message keys by remote ratchet key and number
+}
+
+//GenerateX25519 - returns a new X25519 private key and its public key
+func GenerateX25519() ([]byte, []byte, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv.Bytes(), priv.PublicKey().Bytes(), nil
+}
+
+//X25519 - returns the shared secret of a private and a public key
+func X25519(priv []byte, pub []byte) ([]byte, error) {
+	privKey, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return privKey.ECDH(pubKey)
+}
+
+//X25519Public - returns the public key of an X25519 private key
+func X25519Public(priv []byte) ([]byte, error) {
+	privKey, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return privKey.PublicKey().Bytes(), nil
+}
+
+//DeriveSecret - HKDF-SHA256 of the concatenated inputs, used to turn one or
+//more DH outputs into a shared secret for a new ratchet
+func DeriveSecret(info string, inputs ...[]byte) ([]byte, error) {
+	var secret []byte
+	for _, input := range inputs {
+		secret = append(secret, input...)
+	}
+	return hkdf.Key(sha256.New, secret, nil, info, 32)
+}
+
+func kdfRK(rk []byte, dhOut []byte) ([]byte, []byte, error) {
+	out, err := hkdf.Key(sha256.New, dhOut, rk, rootInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+func kdfCK(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), mk
+}
+
+//messageAEAD - derives the AES-GCM key and nonce from a message key. Each
+//message key is used once, so the derived nonce never repeats
+func messageAEAD(mk []byte) (cipher.AEAD, []byte, error) {
+	out, err := hkdf.Key(sha256.New, mk, nil, messageInfo, 32+12)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := aes.NewCipher(out[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, out[32:], nil
+}
+
+//NewRatchetInitiator - starts a session as the side that knows the other's
+//ratchet public key. The initiator can send right away
+func NewRatchetInitiator(sharedSecret []byte, remotePub []byte) (*Ratchet, error) {
+	priv, _, err := GenerateX25519()
+	if err != nil {
+		return nil, err
+	}
+	dh, err := X25519(priv, remotePub)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks, err := kdfRK(sharedSecret, dh)
+	if err != nil {
+		return nil, err
+	}
+	return &Ratchet{
+		DHs:     priv,
+		DHr:     remotePub,
+		RK:      rk,
+		CKs:     cks,
+		Skipped: make(map[string][]byte),
+	}, nil
+}
+
+//NewRatchetResponder - starts a session as the side owning ownPriv, whose
+//public key the initiator used. Can send once it received a message
+func NewRatchetResponder(sharedSecret []byte, ownPriv []byte) *Ratchet {
+	return &Ratchet{
+		DHs:     ownPriv,
+		RK:      sharedSecret,
+		Skipped: make(map[string][]byte),
+	}
+}
+
+func skippedKey(dh []byte, n uint32) string {
+	return hex.EncodeToString(dh) + ":" + strconv.FormatUint(uint64(n), 10)
+}
+
+func (r *Ratchet) copy() *Ratchet {
+	c := *r
+	c.Skipped = make(map[string][]byte, len(r.Skipped))
+	for k, v := range r.Skipped {
+		c.Skipped[k] = v
+	}
+	return &c
+}
+
+//Encrypt - encrypts the plaintext with the next sending key. ad is
+//authenticated with the header but not sent
+func (r *Ratchet) Encrypt(plaintext []byte, ad []byte) ([]byte, error) {
+	if r.CKs == nil {
+		return nil, errors.New("Session can't send before receiving")
+	}
+	pub, err := X25519Public(r.DHs)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, RatchetHeaderLen)
+	copy(header, pub)
+	binary.BigEndian.PutUint32(header[32:36], r.PN)
+	binary.BigEndian.PutUint32(header[36:40], r.Ns)
+	ck, mk := kdfCK(r.CKs)
+	gcm, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	r.CKs = ck
+	r.Ns++
+	return gcm.Seal(header, nonce, plaintext, append(append([]byte(nil), ad...), header...)), nil
+}
+
+//Decrypt - decrypts a message from Encrypt. Handles skipped and out of
+//order messages. The state only changes if decryption succeeds
+func (r *Ratchet) Decrypt(msg []byte, ad []byte) ([]byte, error) {
+	if len(msg) < RatchetHeaderLen {
+		return nil, errors.New("Ratchet message too short")
+	}
+	header := msg[:RatchetHeaderLen]
+	dh := header[:32]
+	pn := binary.BigEndian.Uint32(header[32:36])
+	n := binary.BigEndian.Uint32(header[36:40])
+	fullAD := append(append([]byte(nil), ad...), header...)
+
+	if mk, exists := r.Skipped[skippedKey(dh, n)]; exists {
+		plain, err := open(mk, msg[RatchetHeaderLen:], fullAD)
+		if err != nil {
+			return nil, err
+		}
+		delete(r.Skipped, skippedKey(dh, n))
+		return plain, nil
+	}
+
+	state := r.copy()
+	if !hmac.Equal(dh, state.DHr) {
+		err := state.skip(pn)
+		if err != nil {
+			return nil, err
+		}
+		err = state.dhRatchet(dh)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := state.skip(n)
+	if err != nil {
+		return nil, err
+	}
+	ck, mk := kdfCK(state.CKr)
+	state.CKr = ck
+	state.Nr++
+	plain, err := open(mk, msg[RatchetHeaderLen:], fullAD)
+	if err != nil {
+		return nil, err
+	}
+	*r = *state
+	return plain, nil
+}
+
+func open(mk []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	gcm, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, ad)
+}
+
+//skip - stores the keys of messages up to until on the receiving chain
+func (r *Ratchet) skip(until uint32) error {
+	if r.CKr == nil {
+		return nil
+	}
+	if until > r.Nr+MaxSkip {
+		return errors.New("Too many skipped messages")
+	}
+	if r.Skipped == nil {
+		//gob decodes an empty map as nil
+		r.Skipped = make(map[string][]byte)
+	}
+	for r.Nr < until {
+		ck, mk := kdfCK(r.CKr)
+		r.Skipped[skippedKey(r.DHr, r.Nr)] = mk
+		r.CKr = ck
+		r.Nr++
+	}
+	for len(r.Skipped) > MaxSkip {
+		for k := range r.Skipped {
+			delete(r.Skipped, k)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *Ratchet) dhRatchet(remotePub []byte) error {
+	r.PN = r.Ns
+	r.Ns = 0
+	r.Nr = 0
+	r.DHr = append([]byte(nil), remotePub...)
+	dh, err := X25519(r.DHs, r.DHr)
+	if err != nil {
+		return err
+	}
+	r.RK, r.CKr, err = kdfRK(r.RK, dh)
+	if err != nil {
+		return err
+	}
+	r.DHs, _, err = GenerateX25519()
+	if err != nil {
+		return err
+	}
+	dh, err = X25519(r.DHs, r.DHr)
+	if err != nil {
+		return err
+	}
+	r.RK, r.CKs, err = kdfRK(r.RK, dh)
+	return err
+}
@@ -0,0 +1,152 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newRatchetPair(t *testing.T) (*Ratchet, *Ratchet) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, pub, err := GenerateX25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewRatchetInitiator(secret, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, NewRatchetResponder(secret, priv)
+}
+
+//TestRatchet - runs steps against a fresh pair. "a:1" encrypts message 1
+//on a for b, "+1" delivers message 1 to its recipient, "!1" delivers it
+//and expects it to be rejected
+func TestRatchet(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+	}{
+		{"in order", []string{"a:1", "+1", "a:2", "+2", "a:3", "+3"}},
+		{"reply", []string{"a:1", "+1", "b:2", "+2", "a:3", "+3", "b:4", "+4"}},
+		{"out of order", []string{"a:1", "a:2", "a:3", "+3", "+1", "+2"}},
+		{"skipped until the end", []string{"a:1", "a:2", "a:3", "+3", "b:4", "+4", "a:5", "+5", "+2", "+1"}},
+		{"skipped across ratchets", []string{"a:1", "+1", "b:2", "b:3", "+3", "a:4", "+4", "b:5", "+5", "+2"}},
+		{"replay", []string{"a:1", "+1", "!1"}},
+		{"replay of skipped", []string{"a:1", "a:2", "+2", "+1", "!1", "!2"}},
+		{"responder can't send first", []string{"!b:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newRatchetPair(t)
+			sides := map[string]*Ratchet{"a": a, "b": b}
+			other := map[string]string{"a": "b", "b": "a"}
+			sent := make(map[string][]byte)
+			from := make(map[string]string)
+			for _, step := range tt.steps {
+				switch {
+				case strings.HasPrefix(step, "!") && strings.Contains(step, ":"):
+					_, err := sides[step[1:2]].Encrypt([]byte(step), nil)
+					if err == nil {
+						t.Fatalf("%s: encrypted", step)
+					}
+				case strings.Contains(step, ":"):
+					sender, label := step[:1], step[2:]
+					ct, err := sides[sender].Encrypt([]byte("message "+label), []byte(sender))
+					if err != nil {
+						t.Fatalf("%s: %v", step, err)
+					}
+					sent[label] = ct
+					from[label] = sender
+				default:
+					label := step[1:]
+					sender := from[label]
+					plain, err := sides[other[sender]].Decrypt(sent[label], []byte(sender))
+					if step[0] == '!' {
+						if err == nil {
+							t.Fatalf("%s: decrypted again", step)
+						}
+						continue
+					}
+					if err != nil {
+						t.Fatalf("%s: %v", step, err)
+					}
+					if !bytes.Equal(plain, []byte("message "+label)) {
+						t.Fatalf("%s: got %q", step, plain)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRatchetRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(ct []byte) []byte
+		ad     []byte
+	}{
+		{"wrong associated data", func(ct []byte) []byte { return ct }, []byte("b")},
+		{"flipped ciphertext", func(ct []byte) []byte { ct[len(ct)-1] ^= 0x01; return ct }, []byte("a")},
+		{"flipped header", func(ct []byte) []byte { ct[RatchetHeaderLen-1] ^= 0x01; return ct }, []byte("a")},
+		{"too short", func(ct []byte) []byte { return ct[:RatchetHeaderLen-1] }, []byte("a")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newRatchetPair(t)
+			ct, err := a.Encrypt([]byte("hello"), []byte("a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = b.Decrypt(tt.mangle(append([]byte(nil), ct...)), tt.ad)
+			if err == nil {
+				t.Fatal("decrypted")
+			}
+			//a failed message leaves the state alone
+			plain, err := b.Decrypt(ct, []byte("a"))
+			if err != nil || string(plain) != "hello" {
+				t.Fatalf("got %q, %v", plain, err)
+			}
+		})
+	}
+}
+
+func TestRatchetMaxSkip(t *testing.T) {
+	tests := []struct {
+		skipped int
+		ok      bool
+	}{
+		{MaxSkip, true},
+		{MaxSkip + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.skipped), func(t *testing.T) {
+			a, b := newRatchetPair(t)
+			first, err := a.Encrypt([]byte("first"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = b.Decrypt(first, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ct []byte
+			for i := 0; i <= tt.skipped; i++ {
+				ct, err = a.Encrypt([]byte("later"), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = b.Decrypt(ct, nil)
+			if (err == nil) != tt.ok {
+				t.Fatalf("skipping %d: %v", tt.skipped, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package encryption
+
+//wordlist - 256 words for mnemonic phrases, one per byte. Sorted, and the
+//first four letters of each word are unique so abbreviations still work
+var wordlist = [256]string{
+	"able", "acid", "acorn", "actor", "adapt", "admit", "adult", "agent",
+	"alarm", "album", "alert", "alley", "amber", "angle", "ankle", "apple",
+	"april", "arena", "armor", "arrow", "atlas", "attic", "audio", "avoid",
+	"awake", "badge", "bagel", "baker", "bamboo", "banjo", "barn", "basil",
+	"beach", "beard", "berry", "bike", "birch", "bison", "blade", "blank",
+	"blast", "blaze", "blend", "bloom", "blue", "board", "boat", "bonus",
+	"book", "boost", "border", "bottle", "bounce", "boxer", "brain", "brave",
+	"bread", "brick", "bridge", "brown", "brush", "bubble", "bucket", "buddy",
+	"bugle", "bunny", "cabin", "cactus", "cake", "camel", "candy", "canoe",
+	"canyon", "card", "cargo", "carpet", "castle", "cattle", "cedar", "chalk",
+	"charm", "cheese", "cherry", "chess", "chief", "chimney", "cider", "cinema",
+	"circle", "citrus", "clay", "cliff", "clock", "cloud", "clover", "coach",
+	"cobra", "coconut", "coffee", "comet", "copper", "coral", "cotton", "couch",
+	"cousin", "crane", "crater", "crisp", "crown", "cube", "cupcake", "curtain",
+	"cycle", "daisy", "dance", "dawn", "deer", "delta", "denim", "desert",
+	"diary", "dinner", "dizzy", "dock", "dolphin", "donkey", "door", "dove",
+	"dragon", "drama", "dream", "drift", "drum", "duck", "dune", "eagle",
+	"earth", "easel", "echo", "eclipse", "elbow", "elder", "ember", "empty",
+	"engine", "enjoy", "equal", "erase", "error", "essay", "exact", "exile",
+	"fabric", "falcon", "fancy", "farm", "feather", "fence", "ferry", "fiber",
+	"field", "final", "flame", "flute", "focus", "forest", "fossil", "fox",
+	"frame", "frost", "fruit", "funny", "gadget", "galaxy", "garden", "garlic",
+	"gentle", "giant", "ginger", "glass", "globe", "glove", "goat", "gold",
+	"gorilla", "gospel", "grape", "gravel", "guitar", "habit", "hammer", "harbor",
+	"hazel", "helmet", "hero", "hiking", "honey", "hotel", "humor", "husky",
+	"icon", "igloo", "image", "index", "inkwell", "insect", "island", "ivory",
+	"jacket", "jaguar", "jelly", "jewel", "jockey", "joke", "judge", "juice",
+	"jungle", "kayak", "kettle", "kidney", "kind", "kitten", "koala", "ladder",
+	"lagoon", "lamp", "laser", "lemon", "leopard", "letter", "lilac", "lime",
+	"lion", "lizard", "lobster", "locket", "lunar", "lyric", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "mentor", "metal", "mirror", "mitten",
+	"monkey", "moose", "motor", "mural", "museum", "napkin", "nature", "nectar",
+}
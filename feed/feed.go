@@ -0,0 +1,563 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mobchat/backup"
+	"mobchat/config"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/user"
+	"mobchat/util"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//The feed is the social side of mobchat. An identity, the user or one of
+//its personas, follows authors by asking them to push their posts. Authors
+//push every new post to their followers and answer feed requests with the
+//posts since a timestamp, which followers send after routing syncs to catch
+//up on what they missed. Posts are records signed by the author, so they
+//can be checked whoever passes them on. The timeline merges the posts of
+//the followed authors with the identity's own. An identity takes at most
+//feedmaxfollowers followers, and blocked contacts can't follow it or get
+//its posts
+
+//peer - a follower or a followed author. Key is set for personas, which
+//are reached by key rather than through their devices
+type peer struct {
+	ID    []byte
+	Key   []byte
+	Since time.Time
+}
+
+type state struct {
+	Posts        map[string][]byte //serialized post records by ID
+	Following    map[string][]peer //by own identity
+	Followers    map[string][]peer //by own identity
+	Interactions map[string][]byte //serialized comment and reaction records by ID
+	Sharing      map[string]bool   //by own identity
+}
+
+var (
+	_posts               = make(map[string]Post)
+	_following           = make(map[string][]peer)
+	_followers           = make(map[string][]peer)
+	_postHandlers        []func(Post)
+	_interactions        = make(map[string]Interaction)
+	_postInteractions    = make(map[string]map[string]bool) //interaction keys by post
+	_authorInteractions  = make(map[string]int)             //count by post and author
+	_reactions           = make(map[string]string)          //interaction key by reactionKey
+	_sharing             = make(map[string]bool)
+	_interactionHandlers []func(Interaction)
+	_lastPull            time.Time
+	fmutex               = sync.Mutex{}
+)
+
+type handler struct{}
+
+//Handle - routes direct messages meant for the feed. The sender is the
+//user of the sending device, if known
+func (h handler) Handle(env node.Envelope) {
+	sender := env.Sender
+	if owner, ok := user.UserOf(sender); ok {
+		sender = owner
+	}
+	handle(nil, sender, nil, env.Payload)
+}
+
+func handlePersona(msg user.PersonaMessage) {
+	handle(msg.Persona, msg.Sender, msg.SenderKey, msg.Payload)
+}
+
+//handle - a feed payload to the identity as from sender
+func handle(as []byte, sender []byte, senderKey []byte, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	var err error
+	switch payload[0] {
+	case commands.PayloadFollow:
+		if user.IsBlocked(sender) {
+			err = errors.New("Follow from a blocked contact")
+			break
+		}
+		err = addPeer(_followers, as, peer{ID: sender, Key: senderKey, Since: time.Now()},
+			config.AttrInt("feedmaxfollowers", 10000))
+		if err == nil {
+			go backfill(as, sender, senderKey, 0)
+		}
+	case commands.PayloadUnfollow:
+		err = removePeer(_followers, as, sender)
+	case commands.PayloadPost:
+		err = handlePost(as, payload[1:])
+	case commands.PayloadFeedRequest:
+		if len(payload) != 1+8 {
+			err = errors.New("Malformed feed request")
+			break
+		}
+		if !hasPeer(_followers, as, sender) || user.IsBlocked(sender) {
+			err = errors.New("Feed request from a non follower")
+			break
+		}
+		go backfill(as, sender, senderKey, binary.BigEndian.Uint64(payload[1:9]))
+	case commands.PayloadInteraction:
+		err = handleInteraction(as, sender, payload[1:])
+	case commands.PayloadThreadRequest:
+		err = handleThreadRequest(as, sender, senderKey, payload[1:])
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Println("feed", util.ToHexString(sender), err)
+	}
+}
+
+func identityKey(as []byte) string {
+	return util.ToHexString(user.IdentityID(as))
+}
+
+func hasPeer(peers map[string][]peer, as []byte, id []byte) bool {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	for _, p := range peers[identityKey(as)] {
+		if bytes.Equal(p.ID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+//addPeer - adds p unless the identity already has max peers, 0 for no limit
+func addPeer(peers map[string][]peer, as []byte, p peer, max int) error {
+	if hasPeer(peers, as, p.ID) {
+		return nil
+	}
+	fmutex.Lock()
+	key := identityKey(as)
+	if max > 0 && len(peers[key]) >= max {
+		fmutex.Unlock()
+		return errors.New("Too many peers")
+	}
+	peers[key] = append(peers[key], p)
+	fmutex.Unlock()
+	return save()
+}
+
+func removePeer(peers map[string][]peer, as []byte, id []byte) error {
+	fmutex.Lock()
+	key := identityKey(as)
+	kept := make([]peer, 0, len(peers[key]))
+	for _, p := range peers[key] {
+		if !bytes.Equal(p.ID, id) {
+			kept = append(kept, p)
+		}
+	}
+	peers[key] = kept
+	fmutex.Unlock()
+	return save()
+}
+
+func peerIDs(peers map[string][]peer, as []byte) [][]byte {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	ids := make([][]byte, 0, len(peers[identityKey(as)]))
+	for _, p := range peers[identityKey(as)] {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+//handlePost - keeps a post of an author the identity follows
+func handlePost(as []byte, data []byte) error {
+	post, err := DecodePost(data)
+	if err != nil {
+		return err
+	}
+	if !hasPeer(_following, as, post.Author) {
+		return errors.New("Post of an author not followed")
+	}
+	if !store(post) {
+		return nil
+	}
+	fmutex.Lock()
+	handlers := _postHandlers
+	fmutex.Unlock()
+	for _, handler := range handlers {
+		handler(post)
+	}
+	return nil
+}
+
+//store - adds the post, dropping the oldest posts of others beyond
+//feedmaxposts. Returns false if the post was known
+func store(post Post) bool {
+	key := util.ToHexString(post.ID)
+	fmutex.Lock()
+	if _, exists := _posts[key]; exists {
+		fmutex.Unlock()
+		return false
+	}
+	_posts[key] = post
+	max := config.AttrInt("feedmaxposts", 5000)
+	if len(_posts) > max {
+		others := make([]Post, 0, len(_posts))
+		for _, p := range _posts {
+			if !user.IsIdentity(p.Author) {
+				others = append(others, p)
+			}
+		}
+		sort.Slice(others, func(i, j int) bool { return others[i].Timestamp < others[j].Timestamp })
+		for i := 0; i < len(others) && len(_posts) > max; i++ {
+			delete(_posts, util.ToHexString(others[i].ID))
+			dropInteractions(others[i].ID)
+		}
+	}
+	fmutex.Unlock()
+	err := save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
+
+//Publish - signs a post as the identity and pushes it to its followers
+func Publish(ctx context.Context, as []byte, text string, media []string) (Post, error) {
+	data, err := postData(text, media)
+	if err != nil {
+		return Post{}, err
+	}
+	rec, err := user.NewRecord(as, commands.RecordPost, uint64(time.Now().UnixNano()), data)
+	if err != nil {
+		return Post{}, err
+	}
+	post, err := postFromRecord(rec)
+	if err != nil {
+		return Post{}, err
+	}
+	store(post)
+	serialized, err := rec.Serialize()
+	if err != nil {
+		return Post{}, err
+	}
+	payload := append([]byte{commands.PayloadPost}, serialized...)
+	fmutex.Lock()
+	followers := append([]peer(nil), _followers[identityKey(as)]...)
+	fmutex.Unlock()
+	for _, follower := range followers {
+		if user.IsBlocked(follower.ID) {
+			continue
+		}
+		err = user.SendFrom(ctx, as, follower.ID, follower.Key, payload)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	return post, nil
+}
+
+//backfill - sends the identity's posts after since to a follower, oldest
+//first, at most feedbatch of them
+func backfill(as []byte, to []byte, toKey []byte, since uint64) {
+	posts := Posts(user.IdentityID(as), 0, 0)
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Timestamp < posts[j].Timestamp })
+	sent := 0
+	for _, post := range posts {
+		if post.Timestamp <= since {
+			continue
+		}
+		if sent >= config.AttrInt("feedbatch", 50) {
+			break
+		}
+		data, err := post.Record.Serialize()
+		if err == nil {
+			err = user.SendFrom(context.Background(), as, to, toKey, append([]byte{commands.PayloadPost}, data...))
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sent++
+	}
+}
+
+//Follow - asks author to push its posts to the identity. authorKey is
+//needed to follow a persona that isn't a persona contact of as
+func Follow(ctx context.Context, as []byte, author []byte, authorKey []byte) error {
+	if !user.IsIdentity(user.IdentityID(as)) {
+		return errors.New("Unknown identity")
+	}
+	err := user.SendFrom(ctx, as, author, authorKey, []byte{commands.PayloadFollow})
+	if err != nil {
+		return err
+	}
+	return addPeer(_following, as, peer{ID: author, Key: authorKey, Since: time.Now()}, 0)
+}
+
+//Unfollow - stops following author
+func Unfollow(ctx context.Context, as []byte, author []byte) error {
+	fmutex.Lock()
+	var key []byte
+	for _, p := range _following[identityKey(as)] {
+		if bytes.Equal(p.ID, author) {
+			key = p.Key
+		}
+	}
+	fmutex.Unlock()
+	err := removePeer(_following, as, author)
+	if err != nil {
+		return err
+	}
+	return user.SendFrom(ctx, as, author, key, []byte{commands.PayloadUnfollow})
+}
+
+//Following - the authors the identity follows
+func Following(as []byte) [][]byte {
+	return peerIDs(_following, as)
+}
+
+//Followers - the followers of the identity
+func Followers(as []byte) [][]byte {
+	return peerIDs(_followers, as)
+}
+
+//AddPostHandler - registers a callback for new posts of followed authors
+func AddPostHandler(handler func(Post)) {
+	fmutex.Lock()
+	_postHandlers = append(_postHandlers, handler)
+	fmutex.Unlock()
+}
+
+//GetPost - a post by its ID
+func GetPost(id []byte) (Post, bool) {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	post, exists := _posts[util.ToHexString(id)]
+	return post, exists
+}
+
+//collect - posts of the authors older than before, newest first. before 0
+//means now, limit 0 means all
+func collect(authors [][]byte, before uint64, limit int) []Post {
+	fmutex.Lock()
+	posts := make([]Post, 0)
+	for _, post := range _posts {
+		if before != 0 && post.Timestamp >= before {
+			continue
+		}
+		for _, author := range authors {
+			if bytes.Equal(post.Author, author) {
+				posts = append(posts, post)
+				break
+			}
+		}
+	}
+	fmutex.Unlock()
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Timestamp > posts[j].Timestamp })
+	if limit > 0 && len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts
+}
+
+//Posts - the known posts of an author older than before, newest first.
+//before 0 means now, limit 0 means all
+func Posts(author []byte, before uint64, limit int) []Post {
+	return collect([][]byte{author}, before, limit)
+}
+
+//Timeline - the posts of the identity and the authors it follows older
+//than before, newest first. Page with the timestamp of the last post
+func Timeline(as []byte, before uint64, limit int) []Post {
+	authors := append(Following(as), user.IdentityID(as))
+	return collect(authors, before, limit)
+}
+
+//newest - timestamp of the newest known post of the author
+func newest(author []byte) uint64 {
+	posts := Posts(author, 0, 1)
+	if len(posts) == 0 {
+		return 0
+	}
+	return posts[0].Timestamp
+}
+
+//pull - asks the followed authors for the posts since the newest known
+//one, at most every feedpullinterval
+func pull() {
+	fmutex.Lock()
+	if time.Since(_lastPull) < config.AttrDuration("feedpullinterval", 5*time.Minute) {
+		fmutex.Unlock()
+		return
+	}
+	_lastPull = time.Now()
+	following := make(map[string][]peer, len(_following))
+	for key, peers := range _following {
+		following[key] = append([]peer(nil), peers...)
+	}
+	fmutex.Unlock()
+	for key, peers := range following {
+		as, err := util.FromHexString(key)
+		if err != nil || !user.IsIdentity(as) {
+			continue
+		}
+		for _, p := range peers {
+			req := make([]byte, 1+8)
+			req[0] = commands.PayloadFeedRequest
+			binary.BigEndian.PutUint64(req[1:], newest(p.ID))
+			err = user.SendFrom(context.Background(), as, p.ID, p.Key, req)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+//Initialize - loads the feed and starts handling feed messages. Call after
+//user.Initialize
+func Initialize() error {
+	err := load()
+	if err != nil {
+		return err
+	}
+	node.AddMessageHandler(handler{})
+	user.AddPersonaMessageHandler(handlePersona)
+	node.AddSyncHook(pull)
+	node.AddShutdownHook(save)
+	backup.Register("feed", backup.Section{Export: export, Restore: restore})
+	return nil
+}
+
+//current - the state to persist. Caller holds fmutex
+func current() (state, error) {
+	s := state{
+		Posts:        make(map[string][]byte, len(_posts)),
+		Following:    _following,
+		Followers:    _followers,
+		Interactions: make(map[string][]byte, len(_interactions)),
+		Sharing:      _sharing,
+	}
+	for key, post := range _posts {
+		data, err := post.Record.Serialize()
+		if err != nil {
+			return state{}, err
+		}
+		s.Posts[key] = data
+	}
+	for key, i := range _interactions {
+		data, err := i.Record.Serialize()
+		if err != nil {
+			return state{}, err
+		}
+		s.Interactions[key] = data
+	}
+	return s, nil
+}
+
+func save() error {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	s, err := current()
+	if err != nil {
+		return err
+	}
+	return util.SaveGob(config.Attr("feedfile"), s)
+}
+
+//apply - adds the posts and peers of s that are missing. Caller holds fmutex
+func apply(s state) {
+	for key, data := range s.Posts {
+		if _, exists := _posts[key]; exists {
+			continue
+		}
+		post, err := DecodePost(data)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		_posts[key] = post
+	}
+	for key, data := range s.Interactions {
+		if _, exists := _interactions[key]; exists {
+			continue
+		}
+		i, err := DecodeInteraction(data)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		addInteraction(key, i)
+	}
+	for key, allow := range s.Sharing {
+		if _, exists := _sharing[key]; !exists {
+			_sharing[key] = allow
+		}
+	}
+	for _, m := range []struct{ from, to map[string][]peer }{{s.Following, _following}, {s.Followers, _followers}} {
+		for key, peers := range m.from {
+			for _, p := range peers {
+				known := false
+				for _, existing := range m.to[key] {
+					if bytes.Equal(existing.ID, p.ID) {
+						known = true
+						break
+					}
+				}
+				if !known {
+					m.to[key] = append(m.to[key], p)
+				}
+			}
+		}
+	}
+}
+
+func load() error {
+	s := state{}
+	err := util.LoadGob(config.Attr("feedfile"), &s)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	fmutex.Lock()
+	apply(s)
+	fmutex.Unlock()
+	fmt.Println("loaded", len(s.Posts), "posts")
+	return nil
+}
+
+//export - the feed section of a backup
+func export() ([]byte, error) {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	s, err := current()
+	if err != nil {
+		return nil, err
+	}
+	var buff bytes.Buffer
+	err = gob.NewEncoder(&buff).Encode(s)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//restore - adds the backed up posts and follows
+func restore(data []byte) error {
+	s := state{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s)
+	if err != nil {
+		return err
+	}
+	fmutex.Lock()
+	apply(s)
+	fmutex.Unlock()
+	return save()
+}
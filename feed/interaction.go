@@ -0,0 +1,459 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/user"
+	"mobchat/util"
+	"sort"
+	"time"
+)
+
+//Comments and reactions are records signed by their author that refer to a
+//post by its ID, and to a comment of the post's thread when they answer or
+//react to one. They are sent to the author of the post, who keeps them and,
+//if it shares interactions, passes them on to its followers and answers
+//their thread requests. A reaction replaces the earlier reaction of its
+//author to the same post or comment, and an empty one takes it back, so
+//the order they arrive in doesn't matter. At most feedmaxinteractions are
+//kept per post, feedmaxauthorinteractions of them by the same author
+
+const (
+	interactionFormat = 1
+	maxCommentText    = 4096
+	maxReaction       = 64
+)
+
+//Interaction - a signed comment or reaction
+type Interaction struct {
+	ID        []byte
+	Kind      byte //commands.RecordComment or commands.RecordReaction
+	Post      []byte
+	Parent    []byte //comment answered or reacted to, nil for the post itself
+	Author    []byte //user or persona ID
+	Timestamp uint64
+	Text      string //comment text or reaction emoji
+	Record    node.Record
+}
+
+//Reply - a comment with its reactions and answers
+type Reply struct {
+	Comment   Interaction
+	Reactions map[string]int //count by emoji
+	Replies   []Reply        //oldest first
+}
+
+//Thread - a post with its reactions and comments
+type Thread struct {
+	Post      Post
+	Reactions map[string]int //count by emoji
+	Replies   []Reply        //oldest first
+}
+
+//interactionData - format, post ID, parent length, parent ID, text length,
+//text
+func interactionData(kind byte, post []byte, parent []byte, text string) ([]byte, error) {
+	if len(post) != sha256.Size || (len(parent) != 0 && len(parent) != sha256.Size) {
+		return nil, errors.New("Invalid post or comment ID")
+	}
+	switch kind {
+	case commands.RecordComment:
+		if text == "" || len(text) > maxCommentText {
+			return nil, errors.New("Invalid comment length")
+		}
+	case commands.RecordReaction:
+		if len(text) > maxReaction {
+			return nil, errors.New("Reaction too long")
+		}
+	default:
+		return nil, errors.New("Not an interaction")
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(interactionFormat)
+	buff.Write(post)
+	buff.WriteByte(byte(len(parent)))
+	buff.Write(parent)
+	ln := make([]byte, 2)
+	binary.BigEndian.PutUint16(ln, uint16(len(text)))
+	buff.Write(ln)
+	buff.WriteString(text)
+	return buff.Bytes(), nil
+}
+
+//interactionFromRecord - the interaction a verified record holds
+func interactionFromRecord(rec node.Record) (Interaction, error) {
+	if rec.Kind != commands.RecordComment && rec.Kind != commands.RecordReaction {
+		return Interaction{}, errors.New("Not an interaction")
+	}
+	d := rec.Data
+	if len(d) < 1+sha256.Size+1 || d[0] != interactionFormat {
+		return Interaction{}, errors.New("Invalid interaction")
+	}
+	idx := 1 + sha256.Size
+	parentLen := int(d[idx])
+	idx++
+	if (parentLen != 0 && parentLen != sha256.Size) || len(d) < idx+parentLen+2 {
+		return Interaction{}, errors.New("Invalid interaction")
+	}
+	var parent []byte
+	if parentLen != 0 {
+		parent = d[idx : idx+parentLen]
+	}
+	idx += parentLen
+	ln := int(binary.BigEndian.Uint16(d[idx : idx+2]))
+	idx += 2
+	if len(d) != idx+ln {
+		return Interaction{}, errors.New("Invalid interaction length")
+	}
+	data, err := rec.Serialize()
+	if err != nil {
+		return Interaction{}, err
+	}
+	i := Interaction{
+		ID:        postID(data),
+		Kind:      rec.Kind,
+		Post:      d[1 : 1+sha256.Size],
+		Parent:    parent,
+		Author:    rec.Owner(),
+		Timestamp: rec.Seq,
+		Text:      string(d[idx:]),
+		Record:    rec,
+	}
+	_, err = interactionData(i.Kind, i.Post, i.Parent, i.Text)
+	if err != nil {
+		return Interaction{}, err
+	}
+	return i, nil
+}
+
+//DecodeInteraction - reads and verifies a serialized comment or reaction
+func DecodeInteraction(data []byte) (Interaction, error) {
+	rec, err := node.DeserializeRecord(data)
+	if err == nil {
+		err = rec.Verify()
+	}
+	if err != nil {
+		return Interaction{}, err
+	}
+	return interactionFromRecord(rec)
+}
+
+//reactionKey - the author and target of a reaction, which has one
+//reaction per author
+func reactionKey(i Interaction) string {
+	return util.ToHexString(i.Author) + util.ToHexString(i.Post) + string(i.Parent)
+}
+
+//addInteraction - adds i unless it is over the caps of its post, or a
+//reaction not newer than the one its author has on the target. Caller holds
+//fmutex
+func addInteraction(key string, i Interaction) bool {
+	if _, exists := _interactions[key]; exists {
+		return false
+	}
+	replaced := ""
+	if i.Kind == commands.RecordReaction {
+		if k, exists := _reactions[reactionKey(i)]; exists {
+			if _interactions[k].Timestamp >= i.Timestamp {
+				return false
+			}
+			replaced = k
+		}
+	}
+	post := util.ToHexString(i.Post)
+	author := post + util.ToHexString(i.Author)
+	if replaced == "" && (len(_postInteractions[post]) >= config.AttrInt("feedmaxinteractions", 1000) ||
+		_authorInteractions[author] >= config.AttrInt("feedmaxauthorinteractions", 50)) {
+		return false
+	}
+	removeInteraction(replaced)
+	_interactions[key] = i
+	if _postInteractions[post] == nil {
+		_postInteractions[post] = make(map[string]bool)
+	}
+	_postInteractions[post][key] = true
+	_authorInteractions[author]++
+	if i.Kind == commands.RecordReaction {
+		_reactions[reactionKey(i)] = key
+	}
+	return true
+}
+
+//removeInteraction - caller holds fmutex
+func removeInteraction(key string) {
+	i, exists := _interactions[key]
+	if !exists {
+		return
+	}
+	delete(_interactions, key)
+	post := util.ToHexString(i.Post)
+	author := post + util.ToHexString(i.Author)
+	delete(_postInteractions[post], key)
+	if len(_postInteractions[post]) == 0 {
+		delete(_postInteractions, post)
+	}
+	_authorInteractions[author]--
+	if _authorInteractions[author] <= 0 {
+		delete(_authorInteractions, author)
+	}
+	if i.Kind == commands.RecordReaction && _reactions[reactionKey(i)] == key {
+		delete(_reactions, reactionKey(i))
+	}
+}
+
+//keep - adds the interaction. Returns false if it wasn't added
+func keep(i Interaction) bool {
+	fmutex.Lock()
+	added := addInteraction(util.ToHexString(i.ID), i)
+	fmutex.Unlock()
+	if !added {
+		return false
+	}
+	err := save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
+
+//dropInteractions - removes the interactions on a post. Caller holds fmutex
+func dropInteractions(post []byte) {
+	for key := range _postInteractions[util.ToHexString(post)] {
+		removeInteraction(key)
+	}
+}
+
+//handleInteraction - keeps a comment or reaction on a post of the identity,
+//or one shared by the author of a followed post
+func handleInteraction(as []byte, sender []byte, data []byte) error {
+	i, err := DecodeInteraction(data)
+	if err != nil {
+		return err
+	}
+	if user.IsBlocked(i.Author) {
+		return errors.New("Interaction of a blocked author")
+	}
+	post, exists := GetPost(i.Post)
+	if !exists {
+		return errors.New("Interaction on an unknown post")
+	}
+	own := bytes.Equal(post.Author, user.IdentityID(as))
+	if !own && (!bytes.Equal(sender, post.Author) || !hasPeer(_following, as, post.Author)) {
+		return errors.New("Unexpected interaction")
+	}
+	if !keep(i) {
+		return nil
+	}
+	fmutex.Lock()
+	handlers := _interactionHandlers
+	fmutex.Unlock()
+	for _, handler := range handlers {
+		handler(i)
+	}
+	if own {
+		go share(as, i)
+	}
+	return nil
+}
+
+//handleThreadRequest - sends a follower the interactions on a post of the
+//identity, if it shares them
+func handleThreadRequest(as []byte, sender []byte, senderKey []byte, data []byte) error {
+	if len(data) != sha256.Size {
+		return errors.New("Malformed thread request")
+	}
+	if !hasPeer(_followers, as, sender) {
+		return errors.New("Thread request from a non follower")
+	}
+	post, exists := GetPost(data)
+	if !exists || !bytes.Equal(post.Author, user.IdentityID(as)) || !Sharing(as) {
+		return nil
+	}
+	for _, i := range interactionsOn(data) {
+		serialized, err := i.Record.Serialize()
+		if err == nil {
+			err = user.SendFrom(context.Background(), as, sender, senderKey, append([]byte{commands.PayloadInteraction}, serialized...))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//share - passes an interaction on a post of the identity on to its
+//followers, if it shares them
+func share(as []byte, i Interaction) {
+	if !Sharing(as) {
+		return
+	}
+	serialized, err := i.Record.Serialize()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	payload := append([]byte{commands.PayloadInteraction}, serialized...)
+	fmutex.Lock()
+	followers := append([]peer(nil), _followers[identityKey(as)]...)
+	fmutex.Unlock()
+	for _, follower := range followers {
+		if bytes.Equal(follower.ID, i.Author) {
+			continue
+		}
+		err = user.SendFrom(context.Background(), as, follower.ID, follower.Key, payload)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+//followKey - the key the identity reaches a followed author by, nil if it
+//goes through the author's devices or persona contact
+func followKey(as []byte, author []byte) []byte {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	for _, p := range _following[identityKey(as)] {
+		if bytes.Equal(p.ID, author) {
+			return p.Key
+		}
+	}
+	return nil
+}
+
+//interact - signs an interaction as the identity and sends it to the
+//author of the post, or shares it when the post is the identity's own
+func interact(ctx context.Context, as []byte, kind byte, postID []byte, parent []byte, text string) (Interaction, error) {
+	post, exists := GetPost(postID)
+	if !exists {
+		return Interaction{}, errors.New("Unknown post")
+	}
+	data, err := interactionData(kind, postID, parent, text)
+	if err != nil {
+		return Interaction{}, err
+	}
+	rec, err := user.NewRecord(as, kind, uint64(time.Now().UnixNano()), data)
+	if err != nil {
+		return Interaction{}, err
+	}
+	i, err := interactionFromRecord(rec)
+	if err != nil {
+		return Interaction{}, err
+	}
+	keep(i)
+	if bytes.Equal(post.Author, user.IdentityID(as)) {
+		go share(as, i)
+		return i, nil
+	}
+	serialized, err := rec.Serialize()
+	if err != nil {
+		return Interaction{}, err
+	}
+	payload := append([]byte{commands.PayloadInteraction}, serialized...)
+	return i, user.SendFrom(ctx, as, post.Author, followKey(as, post.Author), payload)
+}
+
+//Comment - comments on a post as the identity, or answers a comment of
+//the post's thread if parent is set
+func Comment(ctx context.Context, as []byte, postID []byte, parent []byte, text string) (Interaction, error) {
+	return interact(ctx, as, commands.RecordComment, postID, parent, text)
+}
+
+//React - reacts to a post as the identity, or to a comment of the post's
+//thread if parent is set. An empty emoji takes the reaction back
+func React(ctx context.Context, as []byte, postID []byte, parent []byte, emoji string) (Interaction, error) {
+	return interact(ctx, as, commands.RecordReaction, postID, parent, emoji)
+}
+
+//SetSharing - whether the identity passes the interactions on its posts on
+//to its followers
+func SetSharing(as []byte, allow bool) error {
+	fmutex.Lock()
+	_sharing[identityKey(as)] = allow
+	fmutex.Unlock()
+	return save()
+}
+
+//Sharing - whether the identity shares the interactions on its posts
+func Sharing(as []byte) bool {
+	fmutex.Lock()
+	defer fmutex.Unlock()
+	return _sharing[identityKey(as)]
+}
+
+//AddInteractionHandler - registers a callback for new comments and
+//reactions
+func AddInteractionHandler(handler func(Interaction)) {
+	fmutex.Lock()
+	_interactionHandlers = append(_interactionHandlers, handler)
+	fmutex.Unlock()
+}
+
+//RequestThread - asks the author of a followed post for the interactions
+//on it. They arrive like shared ones
+func RequestThread(ctx context.Context, as []byte, postID []byte) error {
+	post, exists := GetPost(postID)
+	if !exists {
+		return errors.New("Unknown post")
+	}
+	if bytes.Equal(post.Author, user.IdentityID(as)) {
+		return nil
+	}
+	req := append([]byte{commands.PayloadThreadRequest}, postID...)
+	return user.SendFrom(ctx, as, post.Author, followKey(as, post.Author), req)
+}
+
+//interactionsOn - the interactions on a post, oldest first
+func interactionsOn(postID []byte) []Interaction {
+	fmutex.Lock()
+	keys := _postInteractions[util.ToHexString(postID)]
+	found := make([]Interaction, 0, len(keys))
+	for key := range keys {
+		found = append(found, _interactions[key])
+	}
+	fmutex.Unlock()
+	sort.Slice(found, func(a, b int) bool { return found[a].Timestamp < found[b].Timestamp })
+	return found
+}
+
+//GetThread - a post with the known reactions and comments on it. Answers
+//to comments that aren't known yet are left out
+func GetThread(postID []byte) (Thread, bool) {
+	post, exists := GetPost(postID)
+	if !exists {
+		return Thread{}, false
+	}
+	//by the raw ID of the comment, "" for the post
+	reactions := make(map[string]map[string]int)
+	comments := make(map[string][]Interaction)
+	for _, i := range interactionsOn(postID) {
+		parent := string(i.Parent)
+		if i.Kind == commands.RecordComment {
+			comments[parent] = append(comments[parent], i)
+			continue
+		}
+		if i.Text == "" {
+			continue
+		}
+		if reactions[parent] == nil {
+			reactions[parent] = make(map[string]int)
+		}
+		reactions[parent][i.Text]++
+	}
+	var replies func(parent string) []Reply
+	replies = func(parent string) []Reply {
+		list := make([]Reply, 0, len(comments[parent]))
+		for _, c := range comments[parent] {
+			id := string(c.ID)
+			list = append(list, Reply{Comment: c, Reactions: reactions[id], Replies: replies(id)})
+		}
+		return list
+	}
+	return Thread{Post: post, Reactions: reactions[""], Replies: replies("")}, true
+}
@@ -0,0 +1,118 @@
+package feed
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"mobchat/node"
+	"mobchat/node/commands"
+)
+
+const (
+	postFormat   = 1
+	maxPostText  = 16 * 1024
+	maxPostMedia = 16
+	maxMediaRef  = 1024
+)
+
+//Post - a signed post. The ID is the sha256 of the serialized record, so a
+//post can be referred to and checked by its content
+type Post struct {
+	ID        []byte
+	Author    []byte //user or persona ID
+	Timestamp uint64
+	Text      string
+	Media     []string //references to media, such as content hashes or URLs
+	Record    node.Record
+}
+
+//postData - format, text length, text, media count, (length, reference)...
+func postData(text string, media []string) ([]byte, error) {
+	if len(text) > maxPostText || len(media) > maxPostMedia {
+		return nil, errors.New("Post too large")
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(postFormat)
+	ln := make([]byte, 4)
+	binary.BigEndian.PutUint32(ln, uint32(len(text)))
+	buff.Write(ln)
+	buff.WriteString(text)
+	buff.WriteByte(byte(len(media)))
+	for _, ref := range media {
+		if len(ref) > maxMediaRef {
+			return nil, errors.New("Media reference too long")
+		}
+		refLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(refLen, uint16(len(ref)))
+		buff.Write(refLen)
+		buff.WriteString(ref)
+	}
+	return buff.Bytes(), nil
+}
+
+//postID - sha256 of the serialized record
+func postID(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+//postFromRecord - the post a verified record holds
+func postFromRecord(rec node.Record) (Post, error) {
+	if rec.Kind != commands.RecordPost {
+		return Post{}, errors.New("Not a post")
+	}
+	d := rec.Data
+	if len(d) < 1+4 || d[0] != postFormat {
+		return Post{}, errors.New("Invalid post")
+	}
+	ln := int(binary.BigEndian.Uint32(d[1:5]))
+	if ln > maxPostText || len(d) < 5+ln+1 {
+		return Post{}, errors.New("Invalid post")
+	}
+	data, err := rec.Serialize()
+	if err != nil {
+		return Post{}, err
+	}
+	post := Post{
+		ID:        postID(data),
+		Author:    rec.Owner(),
+		Timestamp: rec.Seq,
+		Text:      string(d[5 : 5+ln]),
+		Record:    rec,
+	}
+	idx := 5 + ln
+	cnt := int(d[idx])
+	idx++
+	if cnt > maxPostMedia {
+		return Post{}, errors.New("Invalid post")
+	}
+	for i := 0; i < cnt; i++ {
+		if len(d) < idx+2 {
+			return Post{}, errors.New("Invalid post")
+		}
+		refLen := int(binary.BigEndian.Uint16(d[idx : idx+2]))
+		idx += 2
+		if len(d) < idx+refLen {
+			return Post{}, errors.New("Invalid post")
+		}
+		post.Media = append(post.Media, string(d[idx:idx+refLen]))
+		idx += refLen
+	}
+	if idx != len(d) {
+		return Post{}, errors.New("Invalid post length")
+	}
+	return post, nil
+}
+
+//DecodePost - reads and verifies a serialized post
+func DecodePost(data []byte) (Post, error) {
+	rec, err := node.DeserializeRecord(data)
+	if err == nil {
+		err = rec.Verify()
+	}
+	if err != nil {
+		return Post{}, err
+	}
+	return postFromRecord(rec)
+}
@@ -1,11 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"mobchat/backup"
+	"mobchat/chat"
 	"mobchat/config"
+	"mobchat/feed"
 	"mobchat/node"
+	"mobchat/session"
+	"mobchat/user"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	shutdownTimeout = 10 * time.Second
+
+	//passphraseEnv - environment variable with the keystore passphrase. The
+	//passphrase is asked for on stdin if it isn't set
+	passphraseEnv = "MOBCHAT_PASSPHRASE"
 )
 
 type addr struct {
@@ -29,21 +47,149 @@ func getCheckin() []addr {
 func makeClientConnections() {
 	addresses := getCheckin()
 	for _, address := range addresses {
-		go node.Connect(address.address, address.port)
+		node.Dial(address.address, address.port)
+	}
+}
+
+var _stdin = bufio.NewReader(os.Stdin)
+
+func readLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := _stdin.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readPassphrase() (string, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
 	}
+	return readLine("passphrase: ")
+}
+
+//restore - restores the node key, and the user's root key if it is given,
+//with restore=mnemonic or restore=<backup file>. Returns the backup whose
+//sections still need to be restored once the packages are initialized
+func restore(passphrase string) (*backup.Backup, error) {
+	from := config.Attr("restore")
+	if from == "" {
+		return nil, nil
+	}
+	if from == "mnemonic" {
+		phrase, err := readLine("mnemonic: ")
+		if err != nil {
+			return nil, err
+		}
+		err = node.RestoreMnemonic(phrase)
+		if err != nil {
+			return nil, err
+		}
+		phrase, err = readLine("user mnemonic (empty if this wasn't the root device): ")
+		if err != nil || phrase == "" {
+			return nil, err
+		}
+		return nil, user.RestoreMnemonic(phrase)
+	}
+	b, err := backup.Read(from, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return b, b.RestoreKey()
+}
+
+//showMnemonics - prints the words that restore the node key and, on the
+//root device, the user's root key
+func showMnemonics() {
+	mnemonic, err := node.Mnemonic()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("write down these words to restore the node key:", mnemonic)
+	if !user.IsRoot() {
+		return
+	}
+	mnemonic, err = user.Mnemonic()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("and these to restore the user:", mnemonic)
 }
 
 func main() {
 
-	err := node.Initialize()
+	passphrase, err := readPassphrase()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	node.SetPassphrase(passphrase)
+	restored, err := restore(passphrase)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = node.Initialize()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = chat.Initialize()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	err = session.Initialize()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = user.Initialize()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = feed.Initialize()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if restored != nil {
+		err = restored.RestoreSections()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	if config.Attr("showmnemonic") == "true" {
+		showMnemonics()
+		return
+	}
+	if path := config.Attr("backup"); path != "" {
+		err = backup.Write(path, passphrase)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("backup written to", path)
+		}
+		return
+	}
 	sigs := make(chan os.Signal, 1)
-	port := config.Attr("port")
-	go node.Listen(port)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	err = node.Start(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	makeClientConnections()
 
 	<-sigs
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = node.Shutdown(ctx)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
@@ -0,0 +1,145 @@
+package node
+
+import (
+	"fmt"
+	"mobchat/config"
+	"mobchat/util"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//misbehaviour scores. A peer reaching banthreshold gets banned
+const (
+	scoreRateLimited  = 5
+	scoreJunk         = 10
+	scoreMalformed    = 20
+	scoreUnsolicited  = 20
+	scoreBadSignature = 50
+)
+
+//Ban - a temporary ban of a node ID or an IP
+type Ban struct {
+	Key    string //"id:<hex id>" or "ip:<ip>"
+	Until  time.Time
+	Reason string
+}
+
+var (
+	_bans    = make(map[string]Ban)
+	banmutex = sync.RWMutex{}
+)
+
+func banKeyID(id []byte) string {
+	return "id:" + util.ToHexString(id)
+}
+
+func banKeyIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "ip:" + host
+}
+
+func isBanned(key string) bool {
+	banmutex.RLock()
+	b, exists := _bans[key]
+	banmutex.RUnlock()
+	return exists && time.Now().Before(b.Until)
+}
+
+func isBannedID(id []byte) bool {
+	return id != nil && isBanned(banKeyID(id))
+}
+
+func isBannedAddr(addr net.Addr) bool {
+	return isBanned(banKeyIP(addr))
+}
+
+//misbehaving - adds to the misbehaviour score of the connection and bans the
+//peer once the score reaches banthreshold
+func misbehaving(con *Connection, reason string, score int) {
+	threshold, err := strconv.Atoi(config.Attr("banthreshold"))
+	if err != nil || threshold <= 0 {
+		threshold = 100
+	}
+	mutex.Lock()
+	con.score += score
+	total := con.score
+	id := con.id
+	mutex.Unlock()
+	fmt.Println("Misbehaving peer", con.addr.String(), "-", reason, "score", total)
+	if total < threshold {
+		return
+	}
+	banPeer(id, con.addr, reason)
+	con.close()
+}
+
+func banPeer(id []byte, addr net.Addr, reason string) {
+	dur, err := time.ParseDuration(config.Attr("banduration"))
+	if err != nil {
+		dur = 24 * time.Hour
+	}
+	until := time.Now().Add(dur)
+	banmutex.Lock()
+	if id != nil {
+		_bans[banKeyID(id)] = Ban{Key: banKeyID(id), Until: until, Reason: reason}
+	}
+	_bans[banKeyIP(addr)] = Ban{Key: banKeyIP(addr), Until: until, Reason: reason}
+	banmutex.Unlock()
+	fmt.Println("Banned", addr.String(), "until", until)
+	err = saveBans()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//Bans - returns all active bans
+func Bans() []Ban {
+	now := time.Now()
+	banmutex.RLock()
+	defer banmutex.RUnlock()
+	bans := make([]Ban, 0, len(_bans))
+	for _, b := range _bans {
+		if now.Before(b.Until) {
+			bans = append(bans, b)
+		}
+	}
+	return bans
+}
+
+//Unban - lifts a ban by its key
+func Unban(key string) error {
+	banmutex.Lock()
+	delete(_bans, key)
+	banmutex.Unlock()
+	return saveBans()
+}
+
+func saveBans() error {
+	return util.SaveGob(config.Attr("banfile"), Bans())
+}
+
+func loadBans() error {
+	var bans []Ban
+	err := util.LoadGob(config.Attr("banfile"), &bans)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	now := time.Now()
+	banmutex.Lock()
+	for _, b := range bans {
+		if now.Before(b.Until) {
+			_bans[b.Key] = b
+		}
+	}
+	banmutex.Unlock()
+	return nil
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"mobchat/config"
-	"mobchat/encryption"
 	"mobchat/node/commands"
 	"net"
 	"time"
@@ -26,18 +25,21 @@ func listen(conn *Connection) {
 				conn.c.Close()
 				go _connections.RemoveAndRetry(*conn)
 			}
+			conn.stop()
 			sendPeerDisconnected(conn.id)
 			break
 		}
+		if len(m) < 9 {
+			misbehaving(conn, "malformed frame", scoreMalformed)
+			continue
+		}
 		HandleMessage(DeserializeMessage(m), conn)
 
 	}
 }
 
 func doHandshake(conn *Connection) {
-	pubKey := encryption.Key{
-		Public: _me.Key.Public,
-	}
+	pubKey := _me.Key.PublicKey()
 	timer := time.NewTimer(100 * time.Millisecond)
 	<-timer.C
 	hs := commands.NewHandshake(_me.ID(), pubKey, _me.Address)
@@ -51,20 +53,24 @@ func Connect(address string, port string) error {
 	if address == "127.0.0.1" && port == config.Attr("port") {
 		return errors.New("Cannot connect to self")
 	}
+	if stopping() {
+		return errors.New("Node is shutting down")
+	}
+	if isBanned("ip:" + address) {
+		return errors.New("Address is banned")
+	}
 	fmt.Println("connecting to " + address + ":" + port)
-	c, err := net.Dial("tcp", address+":"+port)
+	d := net.Dialer{Timeout: config.AttrDuration("dialtimeout", 10*time.Second)}
+	c, err := d.DialContext(_ctx, "tcp", net.JoinHostPort(address, port))
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
-	conn := Connection{
-		c:      c,
-		addr:   c.RemoteAddr(),
-		server: true,
-	}
-	_connections.Add(&conn)
+	conn := newConnection(c, true)
+	_connections.Add(conn)
 	go conn.startHandshakeTimeout()
-	go listen(&conn)
-	go doHandshake(&conn)
+	go conn.keepalive()
+	go listen(conn)
+	go doHandshake(conn)
 	return nil
 }
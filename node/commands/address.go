@@ -7,6 +7,9 @@ import (
 	"strings"
 )
 
+//AddressLen - length of a serialized address, IPv4 and port
+const AddressLen = 4 + 8
+
 //Address -
 type Address struct {
 	IP   string
@@ -39,7 +42,7 @@ func deserializeIP(ip []byte) string {
 //Serialize -
 func (address *Address) Serialize() []byte {
 	if len(address.IP) == 0 && len(address.Port) == 0 {
-		return make([]byte, 12)
+		return make([]byte, AddressLen)
 	}
 	var buff bytes.Buffer
 	port, _ := strconv.ParseUint(address.Port, 10, 64)
@@ -44,4 +44,61 @@ const (
 
 	//CmdGeneric - is a generic message
 	CmdGeneric = 0x13
+
+	//CmdPing - keepalive probe carrying a nonce to be echoed back
+	CmdPing = 0x14
+
+	//CmdPong - response to a ping, echoes the ping nonce
+	CmdPong = 0x15
+
+	//CmdMailboxStore - asks a server node to hold a direct message for an offline recipient
+	CmdMailboxStore = 0x16
+
+	//CmdMailboxFetch - signed request by a recipient for its stored messages
+	CmdMailboxFetch = 0x17
+
+	//CmdMailboxFetchResp - stored messages for the recipient
+	CmdMailboxFetchResp = 0x18
+
+	//CmdMailboxDelete - signed request by a recipient to delete fetched messages
+	CmdMailboxDelete = 0x19
+
+	//CmdReceipt - signed delivery or read receipt for a direct message
+	CmdReceipt = 0x1A
+
+	//CmdGenericMulti - a generic message sealed once for several recipients
+	CmdGenericMulti = 0x1B
+
+	//CmdPrekeyPublish - signed upload of a prekey bundle to a server node
+	CmdPrekeyPublish = 0x1C
+
+	//CmdPrekeyFetch - asks a server node for a prekey bundle, consuming a one time prekey
+	CmdPrekeyFetch = 0x1D
+
+	//CmdPrekeyFetchResp - prekey bundle for the requested node
+	CmdPrekeyFetchResp = 0x1E
+
+	//CmdKeyStatement - flooded succession or revocation of a node key
+	CmdKeyStatement = 0x1F
+
+	//CmdRecordStore - signed record to keep on a server node
+	CmdRecordStore = 0x20
+
+	//CmdRecordFetch - asks a server node for the record of an owner and kind
+	CmdRecordFetch = 0x21
+
+	//CmdRecordFetchResp - the requested record
+	CmdRecordFetchResp = 0x22
+
+	//CmdDropStore - asks a server node to hold a sealed blob for a drop box
+	CmdDropStore = 0x23
+
+	//CmdDropFetch - request signed by the key of a drop box for its blobs
+	CmdDropFetch = 0x24
+
+	//CmdDropFetchResp - stored blobs of the drop box
+	CmdDropFetchResp = 0x25
+
+	//CmdDropDelete - request signed by the key of a drop box to delete fetched blobs
+	CmdDropDelete = 0x26
 )
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"mobchat/encryption"
 )
@@ -35,22 +36,37 @@ func (hs *Handshake) Serialize() []byte {
 //NewHandshake -
 func NewHandshake(ID []byte, key encryption.Key, address Address) Handshake {
 	return Handshake{
-		ID: ID,
-		PubKey: encryption.Key{
-			Public: key.Public,
-		},
+		ID:      ID,
+		PubKey:  key.PublicKey(),
 		Address: address,
 	}
 }
 
+//handshakeKey - the key of a handshake or handshake response and where the
+//address that follows it starts
+func handshakeKey(hs []byte) (encryption.Key, int, error) {
+	if len(hs) < 34 {
+		return encryption.Key{}, 0, errors.New("Invalid handshake length")
+	}
+	keyLen, err := encryption.SerializedLen(hs[34:])
+	if err != nil {
+		return encryption.Key{}, 0, err
+	}
+	if len(hs) < 34+keyLen+AddressLen {
+		return encryption.Key{}, 0, errors.New("Invalid handshake length")
+	}
+	key, err := encryption.Deserialize(hs[34 : 34+keyLen])
+	return key, 34 + keyLen, err
+}
+
 //DeserializeHandshake -
 func DeserializeHandshake(hs []byte) (Handshake, error) {
-	id := hs[2:34]
-	key, err := encryption.Deserialize(hs[34:166])
+	key, idx, err := handshakeKey(hs)
 	if err != nil {
 		return Handshake{}, err
 	}
-	address, err := DeserializeAddress(hs[166:])
+	id := hs[2:34]
+	address, err := DeserializeAddress(hs[idx:])
 	if err != nil {
 		fmt.Println("address error")
 		return Handshake{}, err
@@ -90,13 +106,13 @@ func NewHandshakeResponse(ID []byte, pubKey encryption.Key, address Address) Han
 
 //DeserializeHandshakeResponse -
 func DeserializeHandshakeResponse(hsr []byte) (HandshakeResponse, error) {
-	id := hsr[2:34]
-
-	key, err := encryption.Deserialize(hsr[34:166])
+	key, idx, err := handshakeKey(hsr)
 	if err != nil {
 		return HandshakeResponse{}, err
 	}
-	address, err := DeserializeAddress(hsr[166:])
+	id := hsr[2:34]
+
+	address, err := DeserializeAddress(hsr[idx:])
 	if err != nil {
 		fmt.Println("address error")
 		return HandshakeResponse{}, err
@@ -0,0 +1,60 @@
+package commands
+
+//Payload codes - first byte of the payload of a direct message
+//(node.SendDirect / node.SendMulti). They tell the packages built on top
+//of the node which of them a message is for
+const (
+	//PayloadGroupLog - signed membership event log of a group
+	PayloadGroupLog = 0x01
+
+	//PayloadGroupMessage - message to all members of a group
+	PayloadGroupMessage = 0x02
+
+	//PayloadGroupKey - new group key wrapped for each member
+	PayloadGroupKey = 0x03
+
+	//PayloadSessionInit - asks to start a forward secret session
+	PayloadSessionInit = 0x04
+
+	//PayloadSessionAccept - accepts a session and carries the first ratchet message
+	PayloadSessionAccept = 0x05
+
+	//PayloadSessionMessage - message encrypted with a session ratchet
+	PayloadSessionMessage = 0x06
+
+	//PayloadSessionPrekey - starts a session from a published prekey bundle and carries the first message
+	PayloadSessionPrekey = 0x07
+
+	//PayloadDeviceLink - signed device list sent by the root key holder to the user's devices
+	PayloadDeviceLink = 0x08
+
+	//PayloadDeviceSync - copy of a message sent to another user, for the sender's other devices
+	PayloadDeviceSync = 0x09
+
+	//PayloadProfile - signed profile record pushed to contacts when it changes
+	PayloadProfile = 0x0A
+
+	//PayloadInvite - answer to a contact card with a one time invite token, carries the card of the invitee
+	PayloadInvite = 0x0B
+
+	//PayloadFollow - asks an author to push new posts to the sender
+	PayloadFollow = 0x0C
+
+	//PayloadUnfollow - asks an author to stop pushing posts to the sender
+	PayloadUnfollow = 0x0D
+
+	//PayloadPost - a signed post, pushed by the author or sent on request
+	PayloadPost = 0x0E
+
+	//PayloadFeedRequest - asks an author for the posts since a timestamp
+	PayloadFeedRequest = 0x0F
+
+	//PayloadInteraction - a signed comment or reaction, sent to the author of the post and shared by it with its followers
+	PayloadInteraction = 0x10
+
+	//PayloadThreadRequest - asks the author of a post for the comments and reactions on it
+	PayloadThreadRequest = 0x11
+
+	//PayloadGroupAction - edit, deletion or reaction referring to a group message, encrypted like one
+	PayloadGroupAction = 0x12
+)
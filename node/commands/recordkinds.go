@@ -0,0 +1,22 @@
+package commands
+
+//Record kinds - what a record published with node.PublishRecord holds
+const (
+	//RecordDevices - the devices certified by a user's root key
+	RecordDevices = 0x01
+
+	//RecordProfile - display name, status, bio and avatar of a user or persona
+	RecordProfile = 0x02
+
+	//RecordCard - contact card, handed out as a link or QR code rather than published
+	RecordCard = 0x03
+
+	//RecordPost - post of a feed, passed to followers rather than published
+	RecordPost = 0x04
+
+	//RecordComment - comment on a post or answer to a comment, sent to the author of the post
+	RecordComment = 0x05
+
+	//RecordReaction - emoji reaction to a post or comment, sent to the author of the post
+	RecordReaction = 0x06
+)
@@ -2,14 +2,12 @@ package node
 
 import (
 	"bytes"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"mobchat/encryption"
 	"mobchat/node/routing"
 	"net"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -36,6 +34,16 @@ type Connection struct {
 	id             []byte
 	pubKey         encryption.Key
 	timer          *time.Timer
+	done           chan struct{}
+	flushed        chan struct{} //closed once the writer has exited
+	pingNonce      uint64
+	pingSent       time.Time
+	awaitingPong   bool
+	missedPongs    int
+	rtt            time.Duration
+	queue          *sendQueue
+	limiter        *rateLimiter
+	score          int //misbehaviour score
 }
 
 //Connections -
@@ -67,27 +75,64 @@ func (cons *Connections) countOutgoing() int64 {
 	return cnt
 }
 
+func newConnection(c net.Conn, server bool) *Connection {
+	con := &Connection{
+		c:       c,
+		addr:    c.RemoteAddr(),
+		server:  server,
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+		queue:   newSendQueue(),
+		limiter: newRateLimiter(),
+	}
+	go con.writer()
+	return con
+}
+
+//sendMessage - queues the message on the lane matching its command
 func (con *Connection) sendMessage(msg Message) error {
-	encoder := gob.NewEncoder(con.c)
-	err := encoder.Encode(msg.Serialize())
+	return con.sendMessageWithPriority(msg, priorityOf(msg))
+}
+
+func (con *Connection) sendMessageWithPriority(msg Message, prio Priority) error {
+	err := con.queue.push(msg, prio)
+	if err == errQueueFull {
+		fmt.Println("Send queue full for", con.addr.String(), "- disconnecting")
+		con.close()
+	}
 	return err
 }
 
+//stop - called once the reader loop exits
+func (con *Connection) stop() {
+	close(con.done)
+	con.queue.close()
+}
+
 func (con *Connection) startHandshakeTimeout() {
 	dur, _ := time.ParseDuration(strconv.FormatInt(handshakeTimeout, 10) + "s")
 	con.timer = time.NewTimer(dur)
 
-	<-con.timer.C
-	if !con.handshake {
-		con.c.Close()
-	}
+	con.waitTimeout()
 }
 
 func (con *Connection) startTimeout() {
 	dur, _ := time.ParseDuration(strconv.FormatInt(handshakeTimeout, 30) + "s")
 	con.timer = time.NewTimer(dur)
 
-	<-con.timer.C
+	con.waitTimeout()
+}
+
+//waitTimeout - closes the connection when the timer fires before the
+//handshake is done. Gives up when the connection closes or the node stops
+func (con *Connection) waitTimeout() {
+	select {
+	case <-con.timer.C:
+	case <-con.done:
+		return
+	case <-_ctx.Done():
+		return
+	}
 	if !con.handshake {
 		con.c.Close()
 	}
@@ -154,39 +199,56 @@ func (cons *Connections) Contains(node *routing.Node, lock bool) bool {
 	return false
 }
 
-//RemoveAndRetry -
+func (cons *Connections) countPeers() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	cnt := 0
+	for _, c := range cons._lst {
+		if c.isPeer {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (cons *Connections) containsAddr(addr string) bool {
+	mutex.Lock()
+	_, exists := cons._lst[addr]
+	mutex.Unlock()
+	return exists
+}
+
+//RemoveAndRetry - removes the connection and redials it through the dialer
+//if it was an established peer. Free outgoing slots are refilled either way
 func (cons *Connections) RemoveAndRetry(con Connection) {
 	fmt.Println("Removing " + con.addr.String())
 	cons.Remove(con)
-	if !con.isPeer {
-		return
-	}
-	retries := 0
-	for retries < retryMax {
-		retries++
-		secs, _ := time.ParseDuration(strconv.FormatInt(int64(retries*10), 10) + "s")
-		fmt.Println("Retrying in", secs)
-		timer := time.NewTimer(secs)
-		<-timer.C
-		mutex.Lock()
-		_, exists := _connections._lst[con.addr.String()]
-		if !exists {
-			a := strings.Split(con.addr.String(), ":")
-			go Connect(a[0], a[1])
-			mutex.Unlock()
-			break
+	if con.isPeer && !stopping() {
+		host, port, err := net.SplitHostPort(con.addr.String())
+		if err == nil {
+			_dialer.failed(con.addr.String())
+			_dialer.dial(host, port, retryMax)
 		}
-		mutex.Unlock()
 	}
+	findPeers()
 }
 
 //SendMessage -
 func (cons *Connections) SendMessage(msg Message) {
+	cons.SendMessageWithPriority(msg, priorityOf(msg))
+}
+
+//SendMessageWithPriority - sends the message to all peers on the given lane
+func (cons *Connections) SendMessageWithPriority(msg Message, prio Priority) {
 	mutex.Lock()
+	peers := make([]*Connection, 0, len(cons._lst))
 	for _, con := range cons._lst {
 		if con.isPeer {
-			go con.sendMessage(msg)
+			peers = append(peers, con)
 		}
 	}
 	mutex.Unlock()
+	for _, con := range peers {
+		con.sendMessageWithPriority(msg, prio)
+	}
 }
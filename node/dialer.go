@@ -0,0 +1,162 @@
+package node
+
+import (
+	"fmt"
+	"math/rand"
+	"mobchat/config"
+	"net"
+	"sync"
+	"time"
+)
+
+const refillInterval = 30 * time.Second
+
+//dialer - central place for outgoing connections. Caps the number of
+//concurrent dials, deduplicates dials to the same address and backs off
+//exponentially (with jitter) per address after failures
+type dialer struct {
+	mu       sync.Mutex
+	sem      chan struct{}
+	inflight map[string]bool
+	failures map[string]int
+	next     map[string]time.Time
+}
+
+var _dialer = newDialer()
+
+func newDialer() *dialer {
+	return &dialer{
+		inflight: make(map[string]bool),
+		failures: make(map[string]int),
+		next:     make(map[string]time.Time),
+	}
+}
+
+func (d *dialer) slots() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sem == nil {
+		max := config.AttrInt("maxdials", 3)
+		if max <= 0 {
+			max = 1
+		}
+		d.sem = make(chan struct{}, max)
+	}
+	return d.sem
+}
+
+//Dial - connects to the address through the dialer, retrying with backoff
+func Dial(address string, port string) {
+	_dialer.dial(address, port, retryMax)
+}
+
+//dial - dials in the background unless a dial to the address is already in
+//flight. Gives up after attempts failed dials
+func (d *dialer) dial(address string, port string, attempts int) {
+	addr := net.JoinHostPort(address, port)
+	d.mu.Lock()
+	if d.inflight[addr] {
+		d.mu.Unlock()
+		return
+	}
+	d.inflight[addr] = true
+	d.mu.Unlock()
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.inflight, addr)
+			d.mu.Unlock()
+		}()
+		sem := d.slots()
+		for attempt := 0; attempt < attempts; attempt++ {
+			wait := d.waitTime(addr)
+			if wait > 0 {
+				fmt.Println("Dialing", addr, "in", wait)
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-_ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+			if _connections.containsAddr(addr) {
+				return
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-_ctx.Done():
+				return
+			}
+			err := Connect(address, port)
+			<-sem
+			if err == nil {
+				return
+			}
+			d.failed(addr)
+		}
+	}()
+}
+
+func (d *dialer) waitTime(addr string) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Until(d.next[addr])
+}
+
+func (d *dialer) backingOff(addr string) bool {
+	return d.waitTime(addr) > 0
+}
+
+func (d *dialer) inflightCount() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return int64(len(d.inflight))
+}
+
+func (d *dialer) isInflight(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inflight[addr]
+}
+
+//failed - pushes the next allowed dial out by base*2^failures, capped at
+//dialbackoffmax, using "equal jitter" so a fleet restarting at once spreads out
+func (d *dialer) failed(addr string) {
+	base := config.AttrDuration("dialbackoff", time.Second)
+	max := config.AttrDuration("dialbackoffmax", 5*time.Minute)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[addr]++
+	backoff := base
+	for i := 1; i < d.failures[addr] && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	d.next[addr] = time.Now().Add(backoff)
+}
+
+//succeeded - resets the backoff once a handshake completes
+func (d *dialer) succeeded(addr string) {
+	d.mu.Lock()
+	delete(d.failures, addr)
+	delete(d.next, addr)
+	d.mu.Unlock()
+}
+
+//run - periodically tops up outgoing connections until the node stops
+func (d *dialer) run() {
+	ticker := time.NewTicker(refillInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+			findPeers()
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/node/routing"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	_delivered       = newIDSet(messageIDsMax / 32)
+	_deliveryFilters []func(sender []byte) bool
+	filtermutex      = sync.RWMutex{}
+)
+
+//saveDelivered - keeps the IDs of delivered messages across restarts, so
+//a message retransmitted after a restart isn't handled twice
+func saveDelivered() error {
+	return util.SaveGob(config.Attr("deliveredfile"), _delivered.list())
+}
+
+func loadDelivered() error {
+	keys := make([]string, 0)
+	err := util.LoadGob(config.Attr("deliveredfile"), &keys)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_delivered.restore(keys)
+	return nil
+}
+
+//Envelope - a verified and decrypted direct message
+type Envelope struct {
+	ID        []byte //ID of the sealed message, stable across relays
+	Sender    []byte
+	Timestamp uint64
+	Payload   []byte
+}
+
+//lookupKey - returns the public key of a node from the routing table
+func lookupKey(id []byte) (encryption.Key, error) {
+	if IsRevoked(id) {
+		return encryption.Key{}, errors.New("Revoked node " + util.ToHexString(id))
+	}
+	node := routing.Table.Get(id)
+	if node == nil {
+		return encryption.Key{}, errors.New("Unknown node " + util.ToHexString(id))
+	}
+	return node.PubKey, nil
+}
+
+//SendDirect - seals the payload for the recipient and sends it directly, via
+//relay or to the recipient's mailboxes. The message is retransmitted until a
+//delivery receipt arrives. Returns the ID handlers will see as Envelope.ID,
+//which is also the ID passed to status handlers
+func SendDirect(ctx context.Context, recipientID []byte, payload []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(recipientID, _me.ID()) {
+		return nil, errors.New("Cannot send to self")
+	}
+	recipientKey, err := lookupKey(recipientID)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := sealDirect(recipientKey, payload)
+	if err != nil {
+		return nil, err
+	}
+	err = queueDirect(recipientID, inner)
+	if err != nil {
+		//stays queued and is retried by the outbox
+		fmt.Println(err)
+	}
+	return inner.ID(), nil
+}
+
+//SendMulti - seals the payload once for all recipients (one ciphertext, a
+//wrapped key per recipient) and sends the same message to each of them.
+//Delivery is tracked per recipient, see Status. Recipients whose key isn't
+//known are skipped and reported as StatusFailed
+func SendMulti(ctx context.Context, recipientIDs [][]byte, payload []byte) ([]byte, error) {
+	id, _, err := SendMultiStamped(ctx, recipientIDs, payload)
+	return id, err
+}
+
+//SendMultiStamped - SendMulti that also returns the timestamp sealed into
+//the message, which the recipients get as Envelope.Timestamp
+func SendMultiStamped(ctx context.Context, recipientIDs [][]byte, payload []byte) ([]byte, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	ids := make([][]byte, 0, len(recipientIDs))
+	keys := make([]encryption.Key, 0, len(recipientIDs))
+	skipped := make([][]byte, 0)
+	for _, id := range recipientIDs {
+		if bytes.Equal(id, _me.ID()) {
+			continue
+		}
+		key, err := lookupKey(id)
+		if err != nil {
+			fmt.Println(err)
+			skipped = append(skipped, id)
+			continue
+		}
+		ids = append(ids, id)
+		keys = append(keys, key)
+	}
+	if len(ids) == 0 {
+		if len(skipped) > 0 {
+			return nil, 0, errors.New("No recipient with a known key")
+		}
+		return nil, 0, errors.New("No recipients")
+	}
+	inner, err := sealMulti(ids, keys, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, id := range skipped {
+		failDirect(id, inner.ID())
+	}
+	for _, id := range ids {
+		err = queueDirect(id, inner)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	return inner.ID(), inner.Timestamp, nil
+}
+
+//sealMulti - builds Version, CmdGenericMulti, sig, count, recipient IDs,
+//Encrypt(timestamp, payload). The signature covers everything after it
+func sealMulti(ids [][]byte, keys []encryption.Key, payload []byte) (Message, error) {
+	ts := uint64(time.Now().UnixNano())
+	plain := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint64(plain, ts)
+	plain = append(plain, payload...)
+	encrypted, err := encryption.Encrypt(keys, plain, encryption.GetCipherKey())
+	if err != nil {
+		return Message{}, err
+	}
+	var signed bytes.Buffer
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(ids)))
+	signed.Write(cnt)
+	for _, id := range ids {
+		signed.Write(id)
+	}
+	signed.Write(encrypted)
+	sig, err := encryption.Sign(_me.Key, signed.Bytes())
+	if err != nil {
+		return Message{}, err
+	}
+	body := []byte{commands.Version, commands.CmdGenericMulti}
+	body = append(body, sig...)
+	body = append(body, signed.Bytes()...)
+	return Message{Body: body, Timestamp: ts}, nil
+}
+
+func openMulti(senderKey encryption.Key, body []byte) ([]byte, error) {
+	if len(body) < senderKey.SigLen()+2 {
+		return nil, errors.New("Direct message too short")
+	}
+	sig := body[:senderKey.SigLen()]
+	signed := body[senderKey.SigLen():]
+	if !encryption.ValidateSig(senderKey, sig, signed) {
+		return nil, errors.New("Invalid signature")
+	}
+	cnt := int(binary.BigEndian.Uint16(signed[0:2]))
+	if len(signed) < 2+32*cnt {
+		return nil, errors.New("Direct message too short")
+	}
+	me := _me.ID()
+	for i := 0; i < cnt; i++ {
+		if bytes.Equal(signed[2+32*i:2+32*(i+1)], me) {
+			return encryption.DecryptMultiple(_me.Key, i, signed[2+32*cnt:])
+		}
+	}
+	return nil, errors.New("Not a recipient of this message")
+}
+
+//sealDirect - builds Version, CmdGeneric, SignAndEncrypt(timestamp, payload)
+func sealDirect(recipientKey encryption.Key, payload []byte) (Message, error) {
+	ts := uint64(time.Now().UnixNano())
+	plain := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint64(plain, ts)
+	plain = append(plain, payload...)
+	sealed, err := encryption.SignAndEncrypt(plain, _me.Key, recipientKey)
+	if err != nil {
+		return Message{}, err
+	}
+	body := append([]byte{commands.Version, commands.CmdGeneric}, sealed...)
+	return Message{Body: body, Timestamp: ts}, nil
+}
+
+//verifyDirect - checks the sender's signature on a CmdGeneric or
+//CmdGenericMulti message without decrypting it
+func verifyDirect(sender []byte, inner Message) error {
+	senderKey, err := lookupKey(sender)
+	if err != nil {
+		return err
+	}
+	if !senderKey.HasPublic() || len(inner.Body) <= 2+senderKey.SigLen() {
+		return errors.New("Direct message too short")
+	}
+	sig := inner.Body[2 : 2+senderKey.SigLen()]
+	if !encryption.ValidateSig(senderKey, sig, inner.Body[2+senderKey.SigLen():]) {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
+
+//openDirect - verifies and decrypts a CmdGeneric or CmdGenericMulti
+//message from sender
+func openDirect(sender []byte, inner Message) (Envelope, error) {
+	senderKey, err := lookupKey(sender)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if len(inner.Body) <= 2+senderKey.SigLen() {
+		return Envelope{}, errors.New("Direct message too short")
+	}
+	var plain []byte
+	if inner.Body[1] == commands.CmdGenericMulti {
+		plain, err = openMulti(senderKey, inner.Body[2:])
+	} else {
+		plain, err = encryption.ValidateSigAndDecrypt(senderKey, _me.Key, inner.Body[2:])
+	}
+	if err != nil {
+		return Envelope{}, err
+	}
+	if len(plain) < 8 {
+		return Envelope{}, errors.New("Direct message too short")
+	}
+	return Envelope{
+		ID:        inner.ID(),
+		Sender:    sender,
+		Timestamp: binary.BigEndian.Uint64(plain[0:8]),
+		Payload:   plain[8:],
+	}, nil
+}
+
+//AddDeliveryFilter - registers a check run before a direct message is
+//opened. If any filter returns false the message is dropped without a
+//receipt, so the sender's outbox keeps it until it expires
+func AddDeliveryFilter(filter func(sender []byte) bool) {
+	filtermutex.Lock()
+	_deliveryFilters = append(_deliveryFilters, filter)
+	filtermutex.Unlock()
+}
+
+func accepted(sender []byte) bool {
+	filtermutex.RLock()
+	defer filtermutex.RUnlock()
+	for _, filter := range _deliveryFilters {
+		if !filter(sender) {
+			return false
+		}
+	}
+	return true
+}
+
+//handleDirect - opens and dispatches a direct message. Returns an error if
+//it couldn't be opened, nil if it was handled, filtered or seen before
+func handleDirect(sender []byte, inner Message) error {
+	if !accepted(sender) {
+		return nil
+	}
+	//the same message can arrive by relay, from several mailboxes and by
+	//retransmission. Only the receipt is repeated, once the signature shows
+	//the claimed sender really sent it
+	if _delivered.has(inner.ID()) {
+		err := verifyDirect(sender, inner)
+		if err != nil {
+			return err
+		}
+		ackDirect(sender, inner.ID())
+		return nil
+	}
+	env, err := openDirect(sender, inner)
+	if err != nil {
+		return err
+	}
+	ackDirect(sender, env.ID)
+	if _delivered.add(env.ID) {
+		return nil
+	}
+	go dispatch(env)
+	return nil
+}
+
+func ackDirect(sender []byte, id []byte) {
+	err := sendReceipt(sender, receiptDelivered, id)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//dispatch - hands the envelope to the registered handlers in order
+func dispatch(env Envelope) {
+	for _, handler := range _messageHandlers {
+		handler.Handle(env)
+	}
+}
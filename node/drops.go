@@ -0,0 +1,411 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//Drop boxes are mailboxes for keys that don't belong to a node, such as
+//personas. A blob dropped into a box is stored on the servers closest to
+//the box ID without a sender, and the fetcher only gets the blobs, so the
+//recipient can't tell which node dropped them. Fetch and delete requests
+//carry the box key and are signed with it. The servers still see which
+//nodes drop into and fetch from a box, the recipient of a blob does not.
+//Fetches and deletes are sent with the box ID as sender, each box at its
+//own random time, and always through another peer, so a server can't tie
+//the boxes to the node fetching them. The peers next to this node still
+//see the requests leave it, and a server that is also such a peer can
+//match them by timing. Answers are only taken from servers that were asked
+
+const (
+	maxDropSize   = 256 * 1024
+	dropFetchWait = time.Minute
+)
+
+//DropHandler - gets the blobs fetched from a drop box
+type DropHandler func(box []byte, blob []byte)
+
+type dropBox struct {
+	key     encryption.Key
+	handler DropHandler
+}
+
+var (
+	_drops = mailboxStore{
+		boxes:     make(map[string][]mailboxItem),
+		lastFetch: make(map[string]uint64),
+	}
+	_dropBoxes = make(map[string]dropBox)
+	_dropsSeen = newIDSet(messageIDsMax / 32)
+	//box and server of fetches waiting for an answer
+	_dropFetches = make(map[string]time.Time)
+	dropmutex    = sync.Mutex{}
+)
+
+//AddDropBox - fetches the drop box of key whenever mailboxes are drained and
+//passes its blobs to handler
+func AddDropBox(key encryption.Key, handler DropHandler) {
+	dropmutex.Lock()
+	_dropBoxes[util.ToHexString(key.ID())] = dropBox{key: key, handler: handler}
+	dropmutex.Unlock()
+}
+
+//RemoveDropBox - stops fetching the drop box
+func RemoveDropBox(box []byte) {
+	dropmutex.Lock()
+	delete(_dropBoxes, util.ToHexString(box))
+	dropmutex.Unlock()
+}
+
+func getDropBox(box []byte) (dropBox, bool) {
+	dropmutex.Lock()
+	defer dropmutex.Unlock()
+	db, exists := _dropBoxes[util.ToHexString(box)]
+	return db, exists
+}
+
+//expectDrops - notes a fetch so its answer is taken
+func expectDrops(box []byte, server []byte) {
+	dropmutex.Lock()
+	defer dropmutex.Unlock()
+	for k, sent := range _dropFetches {
+		if time.Since(sent) > dropFetchWait {
+			delete(_dropFetches, k)
+		}
+	}
+	_dropFetches[util.ToHexString(box)+util.ToHexString(server)] = time.Now()
+}
+
+//expectedDrops - whether the server was asked for the box and hasn't
+//answered yet. Each fetch takes one answer
+func expectedDrops(box []byte, server []byte) bool {
+	key := util.ToHexString(box) + util.ToHexString(server)
+	dropmutex.Lock()
+	defer dropmutex.Unlock()
+	sent, exists := _dropFetches[key]
+	delete(_dropFetches, key)
+	return exists && time.Since(sent) <= dropFetchWait
+}
+
+func dropID(blob []byte) []byte {
+	h := sha256.Sum256(blob)
+	return h[:]
+}
+
+//Drop - hands the blob to the servers of the drop box. The blob should be
+//sealed for the box key, the servers can read it otherwise
+func Drop(box []byte, blob []byte) error {
+	if len(blob) == 0 || len(blob) > maxDropSize {
+		return errors.New("Invalid drop size")
+	}
+	servers := mailboxServers(box)
+	if len(servers) == 0 {
+		return errors.New("No mailbox servers available")
+	}
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdDropStore})
+	buff.Write(box)
+	buff.Write(blob)
+	store := NewMessage(buff.Bytes(), false)
+	sent := 0
+	for _, server := range servers {
+		if bytes.Equal(server.ID(), _me.ID()) {
+			handleDropStore(_me.ID(), store)
+			sent++
+			continue
+		}
+		err := sendTo(server.ID(), store)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return errors.New("Could not reach any mailbox server")
+	}
+	return nil
+}
+
+func handleDropStore(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	body := inner.Body
+	if len(body) <= 2+32 || len(body) > 2+32+maxDropSize {
+		fmt.Println("Malformed drop from", util.ToHexString(from))
+		return
+	}
+	blob := append([]byte(nil), body[34:]...)
+	err := _drops.add(body[2:34], mailboxItem{
+		ID:      dropID(blob),
+		Message: blob,
+		Stored:  time.Now(),
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//dropRequest - Version, cmd, box, timestamp, box key, extra, sig
+func dropRequest(cmd byte, key encryption.Key, extra []byte) (Message, error) {
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, cmd})
+	buff.Write(key.ID())
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	buff.Write(ts)
+	pub := key.PublicKey()
+	serialized, err := pub.Serialize()
+	if err != nil {
+		return Message{}, err
+	}
+	buff.Write(serialized)
+	buff.Write(extra)
+	sig, err := encryption.Sign(key, buff.Bytes())
+	if err != nil {
+		return Message{}, err
+	}
+	buff.Write(sig)
+	return NewMessage(buff.Bytes(), false), nil
+}
+
+//verifyDropRequest - checks a request built by dropRequest. Returns the box
+//and the extra data
+func verifyDropRequest(body []byte) ([]byte, []byte, error) {
+	if len(body) < 2+32+8 {
+		return nil, nil, errors.New("Signed request too short")
+	}
+	box := body[2:34]
+	keyLen, err := encryption.SerializedLen(body[42:])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := encryption.Deserialize(body[42 : 42+keyLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(key.ID(), box) {
+		return nil, nil, errors.New("Key does not match drop box")
+	}
+	if len(body) < 42+keyLen+key.SigLen() {
+		return nil, nil, errors.New("Signed request too short")
+	}
+	sigStart := len(body) - key.SigLen()
+	if !encryption.ValidateSig(key, body[sigStart:], body[:sigStart]) {
+		return nil, nil, errors.New("Invalid request signature")
+	}
+	_drops.mu.Lock()
+	err = _drops.checkFetchTime(box, binary.BigEndian.Uint64(body[34:42]))
+	_drops.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return box, body[42+keyLen : sigStart], nil
+}
+
+//drainDrops - fetches all registered drop boxes
+func drainDrops() {
+	dropmutex.Lock()
+	boxes := make([]dropBox, 0, len(_dropBoxes))
+	for _, db := range _dropBoxes {
+		boxes = append(boxes, db)
+	}
+	dropmutex.Unlock()
+	for _, db := range boxes {
+		go func(db dropBox) {
+			wait := time.Duration(rand.Int63n(int64(config.AttrDuration("dropfetchjitter", time.Minute)) + 1))
+			select {
+			case <-time.After(wait):
+			case <-_ctx.Done():
+				return
+			}
+			for _, server := range mailboxServers(db.key.ID()) {
+				fetchDrops(server.ID(), db.key)
+			}
+		}(db)
+	}
+}
+
+func fetchDrops(server []byte, key encryption.Key) {
+	req, err := dropRequest(commands.CmdDropFetch, key, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	expectDrops(key.ID(), server)
+	if bytes.Equal(server, _me.ID()) {
+		handleDropFetch(_me.ID(), req)
+		return
+	}
+	err = sendAs(key.ID(), server, req, PriorityBulk)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleDropFetch(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	box, _, err := verifyDropRequest(inner.Body)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	items, more := _drops.fetch(box, 0, mailboxFetchMax)
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdDropFetchResp})
+	buff.Write(box)
+	if more {
+		buff.WriteByte(0x01)
+	} else {
+		buff.WriteByte(0x00)
+	}
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(items)))
+	buff.Write(cnt)
+	for _, item := range items {
+		ln := make([]byte, 4)
+		binary.BigEndian.PutUint32(ln, uint32(len(item.Message)))
+		buff.Write(ln)
+		buff.Write(item.Message)
+	}
+	resp := NewMessage(buff.Bytes(), false)
+	if bytes.Equal(from, _me.ID()) {
+		handleDropFetchResp(from, resp)
+		return
+	}
+	err = sendToWithPriority(from, resp, PriorityBulk)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleDropFetchResp(from []byte, inner Message) {
+	body := inner.Body
+	if len(body) < 2+32+1+2 {
+		fmt.Println("Malformed drop response from", util.ToHexString(from))
+		return
+	}
+	db, exists := getDropBox(body[2:34])
+	if !exists || !expectedDrops(db.key.ID(), from) {
+		return
+	}
+	more := body[34] == 0x01
+	cnt := int(binary.BigEndian.Uint16(body[35:37]))
+	idx := 37
+	ids := make([][]byte, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		if len(body) < idx+4 {
+			break
+		}
+		ln := int(binary.BigEndian.Uint32(body[idx : idx+4]))
+		idx += 4
+		if ln == 0 || len(body) < idx+ln {
+			break
+		}
+		blob := body[idx : idx+ln]
+		idx += ln
+		id := dropID(blob)
+		ids = append(ids, id)
+		//every replica holds a copy
+		if _dropsSeen.add(id) {
+			continue
+		}
+		go db.handler(db.key.ID(), blob)
+	}
+	if len(ids) > 0 {
+		deleteDrops(from, db.key, ids)
+	}
+	if more {
+		fetchDrops(from, db.key)
+	}
+}
+
+func deleteDrops(server []byte, key encryption.Key, ids [][]byte) {
+	var buff bytes.Buffer
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(ids)))
+	buff.Write(cnt)
+	for _, id := range ids {
+		buff.Write(id)
+	}
+	req, err := dropRequest(commands.CmdDropDelete, key, buff.Bytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if bytes.Equal(server, _me.ID()) {
+		handleDropDelete(_me.ID(), req)
+		return
+	}
+	err = sendAs(key.ID(), server, req, PriorityBulk)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleDropDelete(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	box, extra, err := verifyDropRequest(inner.Body)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(extra) < 2 {
+		return
+	}
+	cnt := int(binary.BigEndian.Uint16(extra[0:2]))
+	if len(extra) != 2+32*cnt {
+		fmt.Println("Malformed drop delete from", util.ToHexString(from))
+		return
+	}
+	ids := make([][]byte, cnt)
+	for i := range ids {
+		ids[i] = extra[2+32*i : 2+32*(i+1)]
+	}
+	_drops.remove(box, ids)
+}
+
+func saveDrops() error {
+	_drops.mu.Lock()
+	_drops.expire()
+	boxes := _drops.boxes
+	err := util.SaveGob(config.Attr("dropfile"), boxes)
+	_drops.mu.Unlock()
+	return err
+}
+
+func loadDrops() error {
+	boxes := make(map[string][]mailboxItem)
+	err := util.LoadGob(config.Attr("dropfile"), &boxes)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_drops.mu.Lock()
+	_drops.boxes = boxes
+	_drops.size = 0
+	for _, items := range boxes {
+		_drops.size += itemsSize(items)
+	}
+	_drops.expire()
+	_drops.mu.Unlock()
+	return nil
+}
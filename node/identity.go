@@ -0,0 +1,31 @@
+package node
+
+import (
+	"mobchat/encryption"
+)
+
+//ID - returns the ID of this node
+func ID() []byte {
+	return _me.ID()
+}
+
+//PublicKey - returns the public part of this node's key
+func PublicKey() encryption.Key {
+	return _me.Key.PublicKey()
+}
+
+//Sign - signs data with this node's key
+func Sign(data []byte) ([]byte, error) {
+	return encryption.Sign(_me.Key, data)
+}
+
+//DecryptCypher - unwraps a cypher key that was wrapped for this node with
+//encryption.EncryptCypherKey
+func DecryptCypher(wrapped []byte) ([]byte, error) {
+	return encryption.DecryptCypher(_me.Key, wrapped)
+}
+
+//KeyOf - returns the public key of a known node
+func KeyOf(id []byte) (encryption.Key, error) {
+	return lookupKey(id)
+}
@@ -0,0 +1,68 @@
+package node
+
+import (
+	"mobchat/util"
+	"sync"
+)
+
+//idSet - remembers the last max IDs, forgetting the oldest first
+type idSet struct {
+	mu    sync.Mutex
+	max   int
+	ids   map[string]bool
+	order []string
+}
+
+func newIDSet(max int) *idSet {
+	return &idSet{
+		max: max,
+		ids: make(map[string]bool),
+	}
+}
+
+func (set *idSet) has(id []byte) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.ids[util.ToHexString(id)]
+}
+
+//add - adds the ID and reports whether it was already present
+func (set *idSet) add(id []byte) bool {
+	key := util.ToHexString(id)
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.ids[key] {
+		return true
+	}
+	set.ids[key] = true
+	set.order = append(set.order, key)
+	if len(set.order) > set.max {
+		delete(set.ids, set.order[0])
+		set.order = set.order[1:]
+	}
+	return false
+}
+
+//list - the IDs, oldest first
+func (set *idSet) list() []string {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return append([]string(nil), set.order...)
+}
+
+//restore - adds IDs saved with list
+func (set *idSet) restore(keys []string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for _, key := range keys {
+		if set.ids[key] {
+			continue
+		}
+		set.ids[key] = true
+		set.order = append(set.order, key)
+	}
+	for len(set.order) > set.max {
+		delete(set.ids, set.order[0])
+		set.order = set.order[1:]
+	}
+}
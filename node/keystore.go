@@ -0,0 +1,210 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/util"
+	"sync"
+)
+
+//The node key lives in the keystore file so the node keeps its ID across
+//restarts. It is created on the first start and unlocked with the
+//passphrase given to SetPassphrase on every later one
+
+var (
+	_passphrase string
+	_keystore   *encryption.Keystore
+	_sealer     *encryption.PassphraseSealer //for SealState, derived once
+	ksmutex     = sync.Mutex{}
+)
+
+//SetPassphrase - sets the passphrase that protects the node key. Call before
+//Initialize
+func SetPassphrase(passphrase string) {
+	ksmutex.Lock()
+	_passphrase = passphrase
+	_sealer = nil
+	ksmutex.Unlock()
+}
+
+//SealState - encrypts local state that must not sit on disk in the clear,
+//such as session keys, with the keystore passphrase
+func SealState(data []byte) ([]byte, error) {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	if _sealer == nil {
+		sealer, err := encryption.NewPassphraseSealer(_passphrase)
+		if err != nil {
+			return nil, err
+		}
+		_sealer = sealer
+	}
+	return _sealer.Seal(data)
+}
+
+//OpenState - decrypts data sealed with SealState
+func OpenState(sealed []byte) ([]byte, error) {
+	ksmutex.Lock()
+	passphrase := _passphrase
+	ksmutex.Unlock()
+	return encryption.OpenWithPassphrase(passphrase, sealed)
+}
+
+//openKeystore - caller holds ksmutex
+func openKeystore() (*encryption.Keystore, error) {
+	if _passphrase == "" {
+		return nil, errors.New("No passphrase for the keystore")
+	}
+	if _keystore != nil {
+		return _keystore, nil
+	}
+	ks, err := encryption.OpenKeystore(config.Attr("keyfile"))
+	if err != nil {
+		return nil, err
+	}
+	_keystore = ks
+	return ks, nil
+}
+
+//loadKey - unlocks the node key, creating it on first start
+func loadKey() (encryption.Key, error) {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	if err != nil {
+		return encryption.Key{}, err
+	}
+	label := config.Attr("keylabel")
+	if ks.Has(label) {
+		return ks.Unlock(label, _passphrase)
+	}
+	key, err := encryption.GenerateEd25519()
+	if err != nil {
+		return encryption.Key{}, err
+	}
+	err = ks.Add(label, key, _passphrase)
+	if err != nil {
+		return encryption.Key{}, err
+	}
+	fmt.Println("created new identity", util.ToHexString(key.ID()))
+	fmt.Println("start with showmnemonic=true to write down the words that restore it")
+	return key, nil
+}
+
+//RestoreMnemonic - recreates the node key from its mnemonic and stores it
+//in the keystore. Call after SetPassphrase and before Initialize
+func RestoreMnemonic(phrase string) error {
+	key, err := encryption.KeyFromMnemonic(phrase)
+	if err != nil {
+		return err
+	}
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	if err != nil {
+		return err
+	}
+	return ks.Add(config.Attr("keylabel"), key, _passphrase)
+}
+
+//ImportKey - stores a key made by ExportKey or ExportStoredKey under its
+//label. Call after SetPassphrase, and before Initialize for the node key.
+//The export must be protected by the same passphrase
+func ImportKey(data []byte) error {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	if err != nil {
+		return err
+	}
+	_, err = ks.Import(data, _passphrase)
+	return err
+}
+
+//Mnemonic - the node key as words for KeyFromMnemonic
+func Mnemonic() (string, error) {
+	return _me.Key.Mnemonic()
+}
+
+//ChangePassphrase - re-encrypts the node key with a new passphrase
+func ChangePassphrase(oldPassphrase string, newPassphrase string) error {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	if _keystore == nil {
+		return errors.New("Keystore not open")
+	}
+	err := _keystore.ChangePassphrase(config.Attr("keylabel"), oldPassphrase, newPassphrase)
+	if err != nil {
+		return err
+	}
+	_passphrase = newPassphrase
+	_sealer = nil
+	return nil
+}
+
+//ExportKey - the node key, still encrypted with its passphrase, for
+//encryption.Keystore.Import on another machine
+func ExportKey() ([]byte, error) {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	if _keystore == nil {
+		return nil, errors.New("Keystore not open")
+	}
+	return _keystore.Export(config.Attr("keylabel"))
+}
+
+//LoadKey - unlocks a key other than the node key from the node's keystore,
+//such as a user root key
+func LoadKey(label string) (encryption.Key, error) {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	if err != nil {
+		return encryption.Key{}, err
+	}
+	return ks.Unlock(label, _passphrase)
+}
+
+//StoreKey - adds a key to the node's keystore, protected by the node
+//passphrase
+func StoreKey(label string, key encryption.Key) error {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	if err != nil {
+		return err
+	}
+	return ks.Add(label, key, _passphrase)
+}
+
+//HasKey - whether the node's keystore has a key under label
+func HasKey(label string) bool {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	return err == nil && ks.Has(label)
+}
+
+//ExportStoredKey - like ExportKey for a key stored with StoreKey
+func ExportStoredKey(label string) ([]byte, error) {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	if err != nil {
+		return nil, err
+	}
+	return ks.Export(label)
+}
+
+//DeleteKey - removes a key stored with StoreKey
+func DeleteKey(label string) error {
+	ksmutex.Lock()
+	defer ksmutex.Unlock()
+	ks, err := openKeystore()
+	if err != nil {
+		return err
+	}
+	return ks.Remove(label, _passphrase)
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"net"
+	"sync"
+)
+
+var (
+	//_ctx is created once and never reassigned, so it can be read without
+	//holding lifemutex. Start ties it to the caller's context
+	_ctx, _cancel  = context.WithCancel(context.Background())
+	_listener      net.Listener
+	_shutdownHooks []func() error
+	_syncHooks     []func()
+	lifemutex      = sync.Mutex{}
+)
+
+//Start - initializes the node if needed and starts accepting connections on
+//the configured port. Cancelling ctx stops the node without the graceful
+//steps of Shutdown
+func Start(ctx context.Context) error {
+	if !_initialized {
+		err := Initialize()
+		if err != nil {
+			return err
+		}
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			_cancel()
+		case <-_ctx.Done():
+		}
+	}()
+	ln, err := net.Listen("tcp", ":"+config.Attr("port"))
+	if err != nil {
+		return err
+	}
+	go accept(ln)
+	go func() {
+		<-_ctx.Done()
+		ln.Close()
+	}()
+	return nil
+}
+
+//AddShutdownHook - registers a function to persist state during Shutdown
+func AddShutdownHook(hook func() error) {
+	lifemutex.Lock()
+	_shutdownHooks = append(_shutdownHooks, hook)
+	lifemutex.Unlock()
+}
+
+//AddSyncHook - registers a function to run each time the routing table was
+//synced with the network. Hooks run in their own goroutine
+func AddSyncHook(hook func()) {
+	lifemutex.Lock()
+	_syncHooks = append(_syncHooks, hook)
+	lifemutex.Unlock()
+}
+
+func synced() {
+	lifemutex.Lock()
+	hooks := _syncHooks
+	lifemutex.Unlock()
+	go DrainMailboxes()
+	for _, hook := range hooks {
+		go hook()
+	}
+}
+
+//Shutdown - announces the disconnect to all peers, drains the send queues,
+//persists state and closes the listener and all connections. Returns
+//ctx.Err() if the queues could not be drained in time
+func Shutdown(ctx context.Context) error {
+	fmt.Println("shutting down")
+	mutex.Lock()
+	cons := make([]*Connection, 0, len(_connections._lst))
+	for _, con := range _connections._lst {
+		cons = append(cons, con)
+	}
+	mutex.Unlock()
+
+	for _, con := range cons {
+		if con.isPeer && con.id != nil {
+			sendPeerDisconnected(con.id)
+		}
+	}
+
+	lifemutex.Lock()
+	_cancel()
+	if _listener != nil {
+		_listener.Close()
+	}
+	hooks := _shutdownHooks
+	lifemutex.Unlock()
+
+	//let the writers flush what is queued, including the announcements
+	for _, con := range cons {
+		con.queue.close()
+	}
+	var drainErr error
+	for _, con := range cons {
+		select {
+		case <-con.flushed:
+		case <-ctx.Done():
+			drainErr = ctx.Err()
+		}
+		if drainErr != nil {
+			break
+		}
+	}
+	for _, con := range cons {
+		con.close()
+	}
+
+	errs := []error{drainErr}
+	errs = append(errs, saveBans(), saveOutbox(), saveDelivered())
+	if _me.IsServer() {
+		errs = append(errs, saveMailboxes(), savePrekeys(), saveRecords(), saveDrops())
+	}
+	for _, hook := range hooks {
+		errs = append(errs, hook())
+	}
+	return errors.Join(errs...)
+}
+
+//stopping - reports whether the node is shutting down
+func stopping() bool {
+	return _ctx.Err() != nil
+}
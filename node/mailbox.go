@@ -0,0 +1,494 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/node/routing"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//Server nodes hold sealed direct messages for recipients that are offline.
+//Messages are stored on the mailboxreplicas server nodes closest (by XOR)
+//to the recipient ID, and the recipient drains those mailboxes when it
+//reconnects. Fetch and delete requests are signed by the recipient so only
+//the key holder can read or clear its mailbox. The stored messages stay
+//sealed end to end, the server only sees sender and recipient IDs. The
+//server checks the sender's signature on the sealed message before it
+//stores it, and a sender can only fill mailboxsenderquota of a
+//recipient's mailbox. Fetched items are only sent to the recipient. The
+//recipient only deletes what it could open, anything else stays until it
+//can, for instance once the sender is in the routing table again, and is
+//skipped by later fetches of the same drain
+
+const (
+	mailboxFetchMax  = 50
+	mailboxClockSkew = 5 * time.Minute
+	drainInterval    = 10 * time.Second
+)
+
+type mailboxItem struct {
+	ID      []byte
+	From    []byte
+	Message []byte //serialized CmdGeneric message
+	Stored  time.Time
+}
+
+type mailboxStore struct {
+	mu        sync.Mutex
+	boxes     map[string][]mailboxItem
+	lastFetch map[string]uint64
+	size      int
+}
+
+var (
+	_mailboxes = mailboxStore{
+		boxes:     make(map[string][]mailboxItem),
+		lastFetch: make(map[string]uint64),
+	}
+	_lastDrain   time.Time
+	_mailboxSkip = make(map[string]int) //items kept on each server this drain
+	drainmutex   = sync.Mutex{}
+)
+
+func itemsSize(items []mailboxItem) int {
+	size := 0
+	for _, item := range items {
+		size += len(item.Message)
+	}
+	return size
+}
+
+//expire - drops items older than mailboxttl. Caller holds mu
+func (store *mailboxStore) expire() {
+	cutoff := time.Now().Add(-config.AttrDuration("mailboxttl", 7*24*time.Hour))
+	for key, items := range store.boxes {
+		kept := items[:0]
+		for _, item := range items {
+			if item.Stored.After(cutoff) {
+				kept = append(kept, item)
+			} else {
+				store.size -= len(item.Message)
+			}
+		}
+		if len(kept) == 0 {
+			delete(store.boxes, key)
+		} else {
+			store.boxes[key] = kept
+		}
+	}
+}
+
+func (store *mailboxStore) add(recipient []byte, item mailboxItem) error {
+	key := util.ToHexString(recipient)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.expire()
+	items := store.boxes[key]
+	for _, existing := range items {
+		if bytes.Equal(existing.ID, item.ID) {
+			return nil
+		}
+	}
+	if item.From != nil {
+		fromSender := 0
+		for _, existing := range items {
+			if bytes.Equal(existing.From, item.From) {
+				fromSender++
+			}
+		}
+		if fromSender >= config.AttrInt("mailboxsenderquota", 100) {
+			return errors.New("Mailbox quota of sender reached for " + key)
+		}
+	}
+	if len(items) >= config.AttrInt("mailboxquota", 500) ||
+		itemsSize(items)+len(item.Message) > config.AttrInt("mailboxquotabytes", 5<<20) {
+		return errors.New("Mailbox full for " + key)
+	}
+	if store.size+len(item.Message) > config.AttrInt("mailboxmaxbytes", 256<<20) {
+		return errors.New("Mailbox storage full")
+	}
+	store.boxes[key] = append(items, item)
+	store.size += len(item.Message)
+	return nil
+}
+
+//fetch - returns up to max items after the first skip and whether more
+//are waiting
+func (store *mailboxStore) fetch(recipient []byte, skip int, max int) ([]mailboxItem, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.expire()
+	items := store.boxes[util.ToHexString(recipient)]
+	if skip >= len(items) {
+		return nil, false
+	}
+	items = items[skip:]
+	if len(items) > max {
+		return append([]mailboxItem(nil), items[:max]...), true
+	}
+	return append([]mailboxItem(nil), items...), false
+}
+
+func (store *mailboxStore) remove(recipient []byte, ids [][]byte) {
+	key := util.ToHexString(recipient)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	items := store.boxes[key]
+	kept := items[:0]
+	for _, item := range items {
+		removed := false
+		for _, id := range ids {
+			if bytes.Equal(item.ID, id) {
+				removed = true
+				break
+			}
+		}
+		if removed {
+			store.size -= len(item.Message)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == 0 {
+		delete(store.boxes, key)
+	} else {
+		store.boxes[key] = kept
+	}
+}
+
+//checkFetchTime - rejects stale or replayed signed requests. Caller holds mu
+func (store *mailboxStore) checkFetchTime(recipient []byte, ts uint64) error {
+	t := time.Unix(0, int64(ts))
+	if time.Since(t) > mailboxClockSkew || time.Until(t) > mailboxClockSkew {
+		return errors.New("Request timestamp out of range")
+	}
+	key := util.ToHexString(recipient)
+	if ts <= store.lastFetch[key] {
+		return errors.New("Replayed request")
+	}
+	store.lastFetch[key] = ts
+	return nil
+}
+
+func saveMailboxes() error {
+	_mailboxes.mu.Lock()
+	_mailboxes.expire()
+	boxes := _mailboxes.boxes
+	err := util.SaveGob(config.Attr("mailboxfile"), boxes)
+	_mailboxes.mu.Unlock()
+	return err
+}
+
+func loadMailboxes() error {
+	boxes := make(map[string][]mailboxItem)
+	err := util.LoadGob(config.Attr("mailboxfile"), &boxes)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_mailboxes.mu.Lock()
+	_mailboxes.boxes = boxes
+	_mailboxes.size = 0
+	for _, items := range boxes {
+		_mailboxes.size += itemsSize(items)
+	}
+	_mailboxes.expire()
+	_mailboxes.mu.Unlock()
+	return nil
+}
+
+//isOnline - best guess whether a node is reachable right now
+func isOnline(id []byte) bool {
+	return connectionTo(id) != nil || routing.Table.IsConnected(id)
+}
+
+//mailboxServers - the server nodes responsible for the recipient's mailbox
+func mailboxServers(recipient []byte) []*routing.Node {
+	return routing.Table.Closest(recipient, config.AttrInt("mailboxreplicas", 3))
+}
+
+//MailboxAddresses - addresses of the server nodes that keep the mailbox,
+//records and drop box of id
+func MailboxAddresses(id []byte) []commands.Address {
+	servers := mailboxServers(id)
+	addresses := make([]commands.Address, 0, len(servers))
+	for _, server := range servers {
+		addresses = append(addresses, server.Address)
+	}
+	return addresses
+}
+
+//storeInMailboxes - hands a sealed direct message to the recipient's
+//mailbox servers
+func storeInMailboxes(recipient []byte, inner Message) error {
+	servers := mailboxServers(recipient)
+	if len(servers) == 0 {
+		return errors.New("No mailbox servers available")
+	}
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdMailboxStore})
+	buff.Write(recipient)
+	buff.Write(inner.Serialize())
+	store := NewMessage(buff.Bytes(), false)
+	sent := 0
+	for _, server := range servers {
+		if bytes.Equal(server.ID(), _me.ID()) {
+			handleMailboxStore(_me.ID(), store)
+			sent++
+			continue
+		}
+		err := sendTo(server.ID(), store)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return errors.New("Could not reach any mailbox server")
+	}
+	return nil
+}
+
+func handleMailboxStore(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	body := inner.Body
+	if len(body) < 2+32+9+2 {
+		fmt.Println("Malformed mailbox store from", util.ToHexString(from))
+		return
+	}
+	recipient := body[2:34]
+	msg := DeserializeMessage(body[34:])
+	//the relay sender is not authenticated, the sealed message is
+	err := verifyDirect(from, msg)
+	if err != nil {
+		fmt.Println("Mailbox store from", util.ToHexString(from)+":", err)
+		return
+	}
+	err = _mailboxes.add(recipient, mailboxItem{
+		ID:      msg.ID(),
+		From:    from,
+		Message: body[34:],
+		Stored:  time.Now(),
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//signedRequest - Version, cmd, recipient, timestamp, extra, sig
+func signedRequest(cmd byte, extra []byte) (Message, error) {
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, cmd})
+	buff.Write(_me.ID())
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	buff.Write(ts)
+	buff.Write(extra)
+	sig, err := encryption.Sign(_me.Key, buff.Bytes())
+	if err != nil {
+		return Message{}, err
+	}
+	buff.Write(sig)
+	return NewMessage(buff.Bytes(), false), nil
+}
+
+//verifyRequest - checks a request built by signedRequest, including that it
+//is fresh and not replayed. Returns the signer and the extra data
+func verifyRequest(body []byte) ([]byte, []byte, error) {
+	if len(body) < 2+32+8 {
+		return nil, nil, errors.New("Signed request too short")
+	}
+	recipient := body[2:34]
+	key, err := lookupKey(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) < 2+32+8+key.SigLen() {
+		return nil, nil, errors.New("Signed request too short")
+	}
+	sigStart := len(body) - key.SigLen()
+	if !encryption.ValidateSig(key, body[sigStart:], body[:sigStart]) {
+		return nil, nil, errors.New("Invalid request signature")
+	}
+	_mailboxes.mu.Lock()
+	err = _mailboxes.checkFetchTime(recipient, binary.BigEndian.Uint64(body[34:42]))
+	_mailboxes.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return recipient, body[42:sigStart], nil
+}
+
+//DrainMailboxes - fetches messages held for this node by its mailbox servers,
+//and the blobs of registered drop boxes
+func DrainMailboxes() {
+	drainmutex.Lock()
+	if time.Since(_lastDrain) < drainInterval {
+		drainmutex.Unlock()
+		return
+	}
+	_lastDrain = time.Now()
+	drainmutex.Unlock()
+	for _, server := range mailboxServers(_me.ID()) {
+		if bytes.Equal(server.ID(), _me.ID()) {
+			continue
+		}
+		fetchMailbox(server.ID(), 0)
+	}
+	drainDrops()
+}
+
+//fetchMailbox - asks the server for the items after the first skip
+func fetchMailbox(server []byte, skip int) {
+	drainmutex.Lock()
+	_mailboxSkip[util.ToHexString(server)] = skip
+	drainmutex.Unlock()
+	extra := make([]byte, 2)
+	binary.BigEndian.PutUint16(extra, uint16(skip))
+	req, err := signedRequest(commands.CmdMailboxFetch, extra)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = sendTo(server, req)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleMailboxFetch(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	recipient, extra, err := verifyRequest(inner.Body)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	skip := 0
+	if len(extra) >= 2 {
+		skip = int(binary.BigEndian.Uint16(extra[0:2]))
+	}
+	items, more := _mailboxes.fetch(recipient, skip, mailboxFetchMax)
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdMailboxFetchResp})
+	buff.Write(recipient)
+	if more {
+		buff.WriteByte(0x01)
+	} else {
+		buff.WriteByte(0x00)
+	}
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(items)))
+	buff.Write(cnt)
+	for _, item := range items {
+		buff.Write(item.From)
+		ln := make([]byte, 4)
+		binary.BigEndian.PutUint32(ln, uint32(len(item.Message)))
+		buff.Write(ln)
+		buff.Write(item.Message)
+	}
+	//reply to the signer, not to the unauthenticated relay sender
+	err = sendToWithPriority(recipient, NewMessage(buff.Bytes(), false), PriorityBulk)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleMailboxFetchResp(from []byte, inner Message) {
+	body := inner.Body
+	if len(body) < 2+32+1+2 || !bytes.Equal(body[2:34], _me.ID()) {
+		fmt.Println("Malformed mailbox response from", util.ToHexString(from))
+		return
+	}
+	more := body[34] == 0x01
+	cnt := int(binary.BigEndian.Uint16(body[35:37]))
+	idx := 37
+	ids := make([][]byte, 0, cnt)
+	kept := 0
+	for i := 0; i < cnt; i++ {
+		if len(body) < idx+36 {
+			break
+		}
+		sender := body[idx : idx+32]
+		ln := int(binary.BigEndian.Uint32(body[idx+32 : idx+36]))
+		idx += 36
+		if ln < 9 || len(body) < idx+ln {
+			break
+		}
+		msg := DeserializeMessage(body[idx : idx+ln])
+		idx += ln
+		err := handleDirect(sender, msg)
+		if err != nil {
+			fmt.Println(err)
+			kept++
+			continue
+		}
+		ids = append(ids, msg.ID())
+	}
+	if len(ids) > 0 {
+		deleteFromMailbox(from, ids)
+	}
+	if more {
+		drainmutex.Lock()
+		skip := _mailboxSkip[util.ToHexString(from)]
+		drainmutex.Unlock()
+		fetchMailbox(from, skip+kept)
+	}
+}
+
+func deleteFromMailbox(server []byte, ids [][]byte) {
+	var buff bytes.Buffer
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(ids)))
+	buff.Write(cnt)
+	for _, id := range ids {
+		buff.Write(id)
+	}
+	req, err := signedRequest(commands.CmdMailboxDelete, buff.Bytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = sendTo(server, req)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleMailboxDelete(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	recipient, extra, err := verifyRequest(inner.Body)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(extra) < 2 {
+		return
+	}
+	cnt := int(binary.BigEndian.Uint16(extra[0:2]))
+	if len(extra) != 2+32*cnt {
+		fmt.Println("Malformed mailbox delete from", util.ToHexString(from))
+		return
+	}
+	ids := make([][]byte, cnt)
+	for i := range ids {
+		ids[i] = extra[2+32*i : 2+32*(i+1)]
+	}
+	_mailboxes.remove(recipient, ids)
+}
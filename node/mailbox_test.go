@@ -0,0 +1,220 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/node/routing"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//testNode - a node key for this node, with the state files in a temporary
+//directory and no key statements
+func testNode(t *testing.T) {
+	t.Chdir(t.TempDir())
+	_me = Me{Key: generateKey(t)}
+	revmutex.Lock()
+	_keyStatements = make(map[string][]byte)
+	_strayStatements = make(map[string]strayStatement)
+	_keyChangeHandlers = nil
+	_knownIDChecks = nil
+	revmutex.Unlock()
+}
+
+func generateKey(t *testing.T) encryption.Key {
+	key, err := encryption.GenerateEd25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newMailboxStore() *mailboxStore {
+	return &mailboxStore{
+		boxes:     make(map[string][]mailboxItem),
+		lastFetch: make(map[string]uint64),
+	}
+}
+
+func randomID(t *testing.T) []byte {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func testItem(t *testing.T, from []byte, size int) mailboxItem {
+	return mailboxItem{
+		ID:      randomID(t),
+		From:    from,
+		Message: make([]byte, size),
+		Stored:  time.Now(),
+	}
+}
+
+//TestMailboxQuota - fills a mailbox with count items of size bytes from
+//senders senders, in turn, then checks whether one more from the first
+//sender and one from a new sender fit. Quotas are the defaults
+func TestMailboxQuota(t *testing.T) {
+	tests := []struct {
+		name      string
+		senders   int
+		count     int
+		size      int
+		same      bool //another item from the first sender
+		other     bool //an item from a new sender
+		storeSize int  //bytes already held for other recipients
+	}{
+		{"empty", 1, 0, 10, true, true, 0},
+		{"below sender quota", 1, 99, 10, true, true, 0},
+		{"sender quota", 1, 100, 10, false, true, 0},
+		{"below mailbox quota", 6, 498, 10, true, true, 0},
+		{"mailbox quota", 5, 500, 10, false, false, 0},
+		{"mailbox bytes", 5, 5, 1 << 20, false, false, 0},
+		{"below mailbox bytes", 5, 3, 1 << 20, true, true, 0},
+		{"storage full", 1, 0, 10, false, false, 256<<20 - 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMailboxStore()
+			store.size = tt.storeSize
+			recipient := randomID(t)
+			senders := make([][]byte, tt.senders)
+			for i := range senders {
+				senders[i] = randomID(t)
+			}
+			for i := 0; i < tt.count; i++ {
+				err := store.add(recipient, testItem(t, senders[i%tt.senders], tt.size))
+				if err != nil {
+					t.Fatalf("item %d: %v", i, err)
+				}
+			}
+			err := store.add(recipient, testItem(t, senders[0], tt.size))
+			if (err == nil) != tt.same {
+				t.Fatalf("item from the same sender: %v", err)
+			}
+			err = store.add(recipient, testItem(t, randomID(t), tt.size))
+			if (err == nil) != tt.other {
+				t.Fatalf("item from another sender: %v", err)
+			}
+		})
+	}
+}
+
+func TestMailboxQuotaReleased(t *testing.T) {
+	tests := []struct {
+		name    string
+		release func(store *mailboxStore, recipient []byte)
+	}{
+		{"fetched and deleted", func(store *mailboxStore, recipient []byte) {
+			for {
+				fetched, more := store.fetch(recipient, 0, mailboxFetchMax)
+				ids := make([][]byte, 0, len(fetched))
+				for _, item := range fetched {
+					ids = append(ids, item.ID)
+				}
+				store.remove(recipient, ids)
+				if !more {
+					return
+				}
+			}
+		}},
+		{"expired", func(store *mailboxStore, recipient []byte) {
+			for _, items := range store.boxes {
+				for i := range items {
+					items[i].Stored = time.Now().Add(-8 * 24 * time.Hour)
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMailboxStore()
+			recipient := randomID(t)
+			sender := randomID(t)
+			first := testItem(t, sender, 10)
+			err := store.add(recipient, first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < 100; i++ {
+				err = store.add(recipient, testItem(t, sender, 10))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			//the same item again is not counted
+			err = store.add(recipient, first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.add(recipient, testItem(t, sender, 10))
+			if err == nil {
+				t.Fatal("sender quota not enforced")
+			}
+			tt.release(store, recipient)
+			err = store.add(recipient, testItem(t, sender, 10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if store.size != 10 {
+				t.Fatalf("store holds %d bytes", store.size)
+			}
+		})
+	}
+}
+
+//TestMailboxStoreSignature - servers only store messages signed by the
+//sender they are relayed from
+func TestMailboxStoreSignature(t *testing.T) {
+	testNode(t)
+	_mailboxes = *newMailboxStore()
+	me := routing.NewNode(_me.Key, commands.NewAddress("127.0.0.1", "1"), nil)
+	routing.Table.AddNode(&me)
+	defer routing.Table.RemoveNode(&me)
+	other := routing.NewNode(generateKey(t), commands.NewAddress("127.0.0.1", "2"), nil)
+	routing.Table.AddNode(&other)
+	defer routing.Table.RemoveNode(&other)
+	recipient := routing.NewNode(generateKey(t), commands.NewAddress("127.0.0.1", "3"), nil)
+
+	tests := []struct {
+		name   string
+		from   []byte
+		mangle func(body []byte)
+		stored bool
+	}{
+		{"signed by the sender", _me.ID(), func(body []byte) {}, true},
+		{"claims another sender", other.ID(), func(body []byte) {}, false},
+		{"unknown sender", randomID(t), func(body []byte) {}, false},
+		{"changed message", _me.ID(), func(body []byte) { body[len(body)-1] ^= 0x01 }, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := sealDirect(recipient.PubKey, []byte("payload "+strconv.Itoa(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.mangle(inner.Body)
+			var buff bytes.Buffer
+			buff.Write([]byte{commands.Version, commands.CmdMailboxStore})
+			buff.Write(recipient.ID())
+			buff.Write(inner.Serialize())
+			handleMailboxStore(tt.from, NewMessage(buff.Bytes(), false))
+			items, _ := _mailboxes.fetch(recipient.ID(), 0, mailboxFetchMax)
+			stored := false
+			for _, item := range items {
+				if bytes.Equal(item.ID, inner.ID()) {
+					stored = true
+				}
+			}
+			if stored != tt.stored {
+				t.Fatalf("stored %v", stored)
+			}
+		})
+	}
+}
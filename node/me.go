@@ -1,7 +1,6 @@
 package node
 
 import (
-	"crypto/sha256"
 	"fmt"
 	"mobchat/config"
 	"mobchat/encryption"
@@ -28,7 +27,39 @@ func Initialize() error {
 	fmt.Println("initializing")
 	_connections = Connections{_lst: make(map[string]*Connection)}
 	_initialized = true
-	key, err := encryption.Generate(1024)
+	err := loadBans()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = loadMailboxes()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = loadOutbox()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = loadDelivered()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = loadPrekeys()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = loadKeyStatements()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = loadRecords()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = loadDrops()
+	if err != nil {
+		fmt.Println(err)
+	}
+	key, err := loadKey()
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -37,15 +68,20 @@ func Initialize() error {
 		Key:     key,
 		Address: commands.NewAddress(config.Attr("address"), config.Attr("port")),
 	}
-	node := routing.NewNode(encryption.Key{Public: _me.Key.Public}, _me.Address, nil)
+	node := routing.NewNode(_me.Key.PublicKey(), _me.Address, nil)
 	routing.Table.AddNode(&node)
+	go _dialer.run()
+	go runOutbox()
 	return nil
 }
 
+//IsServer - whether this node accepts incoming connections and so offers
+//services such as mailboxes
+func (me *Me) IsServer() bool {
+	return config.Attr("public") == "true" && me.Address.IP != "0.0.0.0"
+}
+
 //ID -
 func (me *Me) ID() []byte {
-	h := sha256.New()
-	id := me.Key.Public.N.Bytes()
-	h.Write(id)
-	return h.Sum(nil)
+	return me.Key.ID()
 }
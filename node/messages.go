@@ -28,9 +28,9 @@ var (
 	cbmutex           = sync.RWMutex{}
 )
 
-//MessageHandler - for handling generic and relay messages from another package
+//MessageHandler - for handling direct messages from another package
 type MessageHandler interface {
-	Handle(msg Message)
+	Handle(env Envelope)
 }
 
 //MessageCallbacks - used to wait for returning messages
@@ -46,7 +46,8 @@ type Message struct {
 	Encrypted bool
 }
 
-//Add - adds a callback
+//Add - adds a callback. The callback is dropped after callbackTimeout or when
+//the node shuts down
 func (msgCBs *MessageCallbacks) Add(ID []byte, callback func(Message)) {
 	idStr := util.ToHexString(ID)
 	cbmutex.Lock()
@@ -57,11 +58,17 @@ func (msgCBs *MessageCallbacks) Add(ID []byte, callback func(Message)) {
 	msgCBs.callbacks[idStr] = callback
 	dur, _ := time.ParseDuration(callbackTimeout)
 	cbmutex.Unlock()
-	t := time.NewTimer(dur)
-	<-t.C
-	cbmutex.Lock()
-	delete(msgCBs.callbacks, idStr)
-	cbmutex.Unlock()
+	go func() {
+		t := time.NewTimer(dur)
+		select {
+		case <-t.C:
+		case <-_ctx.Done():
+			t.Stop()
+		}
+		cbmutex.Lock()
+		delete(msgCBs.callbacks, idStr)
+		cbmutex.Unlock()
+	}()
 }
 
 //Call -
@@ -171,18 +178,28 @@ func HandleMessage(msg Message, con *Connection) {
 		body, err = encryption.Decrypt(_me.Key, msg.Body)
 		if err != nil {
 			fmt.Println(err)
+			misbehaving(con, "undecryptable message", scoreMalformed)
 			return
 		}
 	} else {
 		body = msg.Body
 	}
+	if len(body) < 2 {
+		misbehaving(con, "malformed message", scoreMalformed)
+		return
+	}
 	cmd := body[1]
+	if !con.limiter.allow(cmd) {
+		misbehaving(con, "rate limited", scoreRateLimited)
+		return
+	}
 	switch cmd {
 	case commands.CmdHandshake:
 		hs, err := commands.DeserializeHandshake(body)
 		if err != nil {
 			fmt.Println(err)
-			//respond with error message
+			misbehaving(con, "malformed handshake", scoreMalformed)
+			return
 		}
 		handleHandshake(hs, con)
 		break
@@ -190,7 +207,8 @@ func HandleMessage(msg Message, con *Connection) {
 		hsr, err := commands.DeserializeHandshakeResponse(body)
 		if err != nil {
 			fmt.Println(err)
-			//respond with error message
+			misbehaving(con, "malformed handshake response", scoreMalformed)
+			return
 		}
 		handleHandshakeResp(hsr, con)
 		break
@@ -207,21 +225,49 @@ func HandleMessage(msg Message, con *Connection) {
 		handleGetRoutingResp(body[2:], con)
 		break
 	case commands.CmdPeerConnected:
-		handlePeerConnected(msg)
+		handlePeerConnected(msg, con)
 		break
 	case commands.CmdPeerDisconnected:
-		handlePeerDisconnected(msg)
+		handlePeerDisconnected(msg, con)
 		break
 	case commands.CmdGetRoute:
 		handleGetRoute(msg, con)
 		break
+	case commands.CmdRelayMessage:
+		handleRelay(msg, con)
+		break
+	case commands.CmdKeyStatement:
+		handleKeyStatement(msg, con)
+		break
+	case commands.CmdPing:
+		handlePing(body[2:], con)
+		break
+	case commands.CmdPong:
+		handlePong(body[2:], con)
+		break
 	default:
 		fmt.Println("Junk message")
-		//is junk message - need to decide how to respond
+		misbehaving(con, "junk command", scoreJunk)
 	}
 }
 
 func handleHandshake(hs commands.Handshake, con *Connection) {
+	if isBannedID(hs.ID) {
+		fmt.Println("Refusing banned node", util.ToHexString(hs.ID))
+		con.close()
+		return
+	}
+	if IsRevoked(hs.ID) || IsRevoked(hs.PubKey.ID()) {
+		fmt.Println("Refusing revoked node", util.ToHexString(hs.ID))
+		con.close()
+		return
+	}
+	//the ID is the hash of the key, anything else is an impersonation
+	if !bytes.Equal(hs.ID, hs.PubKey.ID()) {
+		misbehaving(con, "handshake ID doesn't match key", scoreBadSignature)
+		con.close()
+		return
+	}
 	mutex.Lock()
 	isConnection := true
 	con.id = hs.ID
@@ -238,31 +284,49 @@ func handleHandshake(hs commands.Handshake, con *Connection) {
 		con.id = hs.ID
 
 	}
-	pubKey := encryption.Key{Public: _me.Key.Public}
+	pubKey := _me.Key.PublicKey()
 	hsr := commands.NewHandshakeResponse(_me.ID(), pubKey, address)
 
 	msg := NewMessage(hsr.Serialize(), false)
 	mutex.Lock()
 	con.stopHandshakeTimeout()
+	mutex.Unlock()
 	err := con.sendMessage(msg)
 	if err != nil {
 		fmt.Println(err)
 	}
-	mutex.Unlock()
 	if isConnection {
 		n := routing.NewNode(hs.PubKey, hs.Address, nil)
 		routing.Table.AddNode(&n)
 		go sendConnectionMessage(&n)
+		go sendKeyStatements(con)
 	}
 }
 
 func handleHandshakeResp(hsr commands.HandshakeResponse, con *Connection) {
+	if isBannedID(hsr.ID) {
+		fmt.Println("Refusing banned node", util.ToHexString(hsr.ID))
+		con.close()
+		return
+	}
+	if IsRevoked(hsr.ID) || IsRevoked(hsr.PubKey.ID()) {
+		fmt.Println("Refusing revoked node", util.ToHexString(hsr.ID))
+		con.close()
+		return
+	}
+	if !bytes.Equal(hsr.ID, hsr.PubKey.ID()) {
+		misbehaving(con, "handshake ID doesn't match key", scoreBadSignature)
+		con.close()
+		return
+	}
 	con.stopHandshakeTimeout()
+	_dialer.succeeded(con.addr.String())
 	if hsr.IsConnection() {
 		n := routing.NewNode(hsr.PubKey, hsr.Address, nil)
 		routing.Table.AddNode(&n)
 		con.isPeer = true
 		con.id = n.ID()
+		go sendKeyStatements(con)
 	}
 	//do routing check
 	mutex.Lock()
@@ -305,6 +369,7 @@ func handleRoutingCheckResp(data []byte, con *Connection) {
 			con.close()
 		}
 		go findPeers()
+		synced()
 		return
 	}
 	cmd := []byte{commands.Version, commands.CmdGetRouting}
@@ -334,6 +399,7 @@ func handleGetRouting(con *Connection) {
 
 func handleGetRoutingResp(data []byte, con *Connection) {
 	if !con.sentGetRouting {
+		misbehaving(con, "unsolicited routing table", scoreUnsolicited)
 		con.close()
 		go findPeers()
 		return
@@ -344,6 +410,9 @@ func handleGetRoutingResp(data []byte, con *Connection) {
 		fmt.Println(err)
 	}
 	for key := range route.Nodes {
+		if IsRevoked(route.Nodes[key].ID()) {
+			continue
+		}
 		routing.Table.AddNode(route.Nodes[key])
 	}
 
@@ -352,13 +421,14 @@ func handleGetRoutingResp(data []byte, con *Connection) {
 	}
 
 	go findPeers()
+	synced()
 }
 
 func sendConnectionMessage(node *routing.Node) {
 	var buff bytes.Buffer
 	buff.Write([]byte{commands.Version, commands.CmdPeerConnected})
 	buff.Write(_me.ID())
-	buff.Write(node.Serialize()) //len 144
+	buff.Write(node.Serialize())
 	sig, err := encryption.Sign(_me.Key, buff.Bytes())
 
 	if err != nil {
@@ -370,8 +440,17 @@ func sendConnectionMessage(node *routing.Node) {
 	_connections.SendMessage(msg)
 }
 
-func handlePeerConnected(msg Message) {
+func handlePeerConnected(msg Message, con *Connection) {
+	if len(msg.Body) <= 2+32 {
+		misbehaving(con, "malformed peer connected", scoreMalformed)
+		return
+	}
 	data := msg.Body[2:]
+	nodeLen, err := routing.NodeLen(data[32:])
+	if err != nil || len(data) <= 32+nodeLen {
+		misbehaving(con, "malformed peer connected", scoreMalformed)
+		return
+	}
 	id := util.ToHexString(data[0:32])
 	mutex.Lock()
 	node, exists := routing.Table.Nodes[id]
@@ -381,26 +460,33 @@ func handlePeerConnected(msg Message) {
 		//TODO: ask for routing from a peer..
 		return
 	}
-	n, err := routing.DeserializeNode(data[32:176])
+	n, err := routing.DeserializeNode(data[32 : 32+nodeLen])
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	sig := data[176:]
+	sig := data[32+nodeLen:]
 
-	if !encryption.ValidateSig(node.PubKey, sig, msg.Body[0:178]) {
+	if !encryption.ValidateSig(node.PubKey, sig, msg.Body[0:2+32+nodeLen]) {
 		fmt.Println("Invalid sig for peer connection")
+		misbehaving(con, "invalid signature", scoreBadSignature)
 		return
 	}
 	go _connections.SendMessage(msg)
 
+	if IsRevoked(n.ID()) {
+		return
+	}
 	routing.Table.AddNode(&n)
 	node.AddConnection(&n)
 
 }
 
-func handlePeerDisconnected(msg Message) {
-
+func handlePeerDisconnected(msg Message, con *Connection) {
+	if len(msg.Body) <= 66 {
+		misbehaving(con, "malformed peer disconnected", scoreMalformed)
+		return
+	}
 	data := msg.Body[2:]
 	id1 := util.ToHexString(data[0:32])
 	mutex.Lock()
@@ -423,6 +509,7 @@ func handlePeerDisconnected(msg Message) {
 
 	if !encryption.ValidateSig(node1.PubKey, sig, msg.Body[0:66]) {
 		fmt.Println("Invalid sig for peer connection")
+		misbehaving(con, "invalid signature", scoreBadSignature)
 		return
 	}
 	go _connections.SendMessage(msg)
@@ -449,15 +536,19 @@ func getRoutes(ID []byte, getRoutesReply func(msg Message)) {
 	//get random connection
 	idx := int(rand.Uint32()) % len(_connections._lst)
 	cnt := 0
+	var target *Connection
 	mutex.Lock()
 	for _, con := range _connections._lst {
 		if cnt == idx {
-			go con.sendMessage(msg)
+			target = con
 			break
 		}
 		cnt++
 	}
 	mutex.Unlock()
+	if target != nil {
+		target.sendMessage(msg)
+	}
 
 }
 
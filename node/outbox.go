@@ -0,0 +1,299 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//MessageStatus - delivery state of a message sent with SendDirect
+type MessageStatus int
+
+const (
+	//StatusQueued - not handed to the network yet
+	StatusQueued MessageStatus = iota
+	//StatusSent - relayed or stored in mailboxes, no receipt yet
+	StatusSent
+	//StatusDelivered - the recipient acknowledged delivery
+	StatusDelivered
+	//StatusRead - the recipient marked the message read
+	StatusRead
+	//StatusFailed - expired before a delivery receipt arrived
+	StatusFailed
+)
+
+func (status MessageStatus) String() string {
+	switch status {
+	case StatusQueued:
+		return "queued"
+	case StatusSent:
+		return "sent"
+	case StatusDelivered:
+		return "delivered"
+	case StatusRead:
+		return "read"
+	case StatusFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+//receipt kinds
+const (
+	receiptDelivered = 0x01
+	receiptRead      = 0x02
+)
+
+//receipt body: Version, CmdReceipt, kind, message ID (32), timestamp, sig
+const receiptLen = 2 + 1 + 32 + 8
+
+//outboxEntry - one message to one recipient. A message sent to several
+//recipients has an entry per recipient
+type outboxEntry struct {
+	ID        []byte
+	Recipient []byte
+	Message   []byte //serialized inner message
+	Status    MessageStatus
+	Attempts  int
+	Next      time.Time
+	Expires   time.Time
+}
+
+//StatusHandler - called when the status of a message changes for one of
+//its recipients
+type StatusHandler func(id []byte, recipient []byte, status MessageStatus)
+
+var (
+	_outbox         = make(map[string]*outboxEntry)
+	_statusHandlers []StatusHandler
+	obmutex         = sync.Mutex{}
+)
+
+func outboxKey(id []byte, recipient []byte) string {
+	return util.ToHexString(id) + util.ToHexString(recipient)
+}
+
+//AddStatusHandler - registers a callback for message status changes
+func AddStatusHandler(handler StatusHandler) {
+	obmutex.Lock()
+	_statusHandlers = append(_statusHandlers, handler)
+	obmutex.Unlock()
+}
+
+//Status - returns the status of a message sent with SendDirect or
+//SendMulti. With several recipients it is the least advanced status, so a
+//message only counts as delivered once every recipient acknowledged it
+func Status(id []byte) (MessageStatus, bool) {
+	obmutex.Lock()
+	defer obmutex.Unlock()
+	found := false
+	status := StatusRead
+	for _, entry := range _outbox {
+		if !bytes.Equal(entry.ID, id) {
+			continue
+		}
+		found = true
+		if entry.Status == StatusFailed {
+			return StatusFailed, true
+		}
+		if entry.Status < status {
+			status = entry.Status
+		}
+	}
+	return status, found
+}
+
+//setStatus - moves an entry forward and notifies handlers. Statuses never
+//move backwards. Caller holds obmutex
+func setStatus(entry *outboxEntry, status MessageStatus) {
+	if status <= entry.Status && status != StatusFailed {
+		return
+	}
+	entry.Status = status
+	handlers := _statusHandlers
+	id := entry.ID
+	recipient := entry.Recipient
+	go func() {
+		for _, handler := range handlers {
+			handler(id, recipient, status)
+		}
+	}()
+}
+
+func retransmitBackoff(attempts int) time.Duration {
+	backoff := config.AttrDuration("retransmitbase", 5*time.Second)
+	max := config.AttrDuration("retransmitmax", 5*time.Minute)
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+//queueDirect - adds a sealed message to the outbox and makes the first
+//delivery attempt
+func queueDirect(recipient []byte, inner Message) error {
+	id := inner.ID()
+	entry := &outboxEntry{
+		ID:        id,
+		Recipient: recipient,
+		Message:   inner.Serialize(),
+		Status:    StatusQueued,
+		Expires:   time.Now().Add(config.AttrDuration("messagettl", 24*time.Hour)),
+	}
+	obmutex.Lock()
+	_outbox[outboxKey(id, recipient)] = entry
+	obmutex.Unlock()
+	return transmit(entry)
+}
+
+//failDirect - records a message that couldn't be sent to recipient at all,
+//so status handlers hear about it
+func failDirect(recipient []byte, id []byte) {
+	entry := &outboxEntry{
+		ID:        id,
+		Recipient: recipient,
+		Status:    StatusQueued,
+		Expires:   time.Now().Add(config.AttrDuration("messagettl", 24*time.Hour)),
+	}
+	obmutex.Lock()
+	_outbox[outboxKey(id, recipient)] = entry
+	setStatus(entry, StatusFailed)
+	obmutex.Unlock()
+}
+
+func transmit(entry *outboxEntry) error {
+	inner := DeserializeMessage(entry.Message)
+	var err error
+	if isOnline(entry.Recipient) {
+		err = sendTo(entry.Recipient, inner)
+	} else {
+		err = storeInMailboxes(entry.Recipient, inner)
+	}
+	obmutex.Lock()
+	entry.Attempts++
+	entry.Next = time.Now().Add(retransmitBackoff(entry.Attempts))
+	if err == nil {
+		setStatus(entry, StatusSent)
+	}
+	obmutex.Unlock()
+	return err
+}
+
+//runOutbox - retransmits unacknowledged messages until they are delivered
+//or expire
+func runOutbox() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		due := make([]*outboxEntry, 0)
+		obmutex.Lock()
+		for key, entry := range _outbox {
+			if now.After(entry.Expires) {
+				if entry.Status < StatusDelivered {
+					setStatus(entry, StatusFailed)
+				}
+				delete(_outbox, key)
+				continue
+			}
+			if entry.Status < StatusDelivered && now.After(entry.Next) {
+				due = append(due, entry)
+			}
+		}
+		obmutex.Unlock()
+		for _, entry := range due {
+			err := transmit(entry)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+func sendReceipt(to []byte, kind byte, id []byte) error {
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdReceipt, kind})
+	buff.Write(id)
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	buff.Write(ts)
+	sig, err := encryption.Sign(_me.Key, buff.Bytes())
+	if err != nil {
+		return err
+	}
+	buff.Write(sig)
+	return sendTo(to, NewMessage(buff.Bytes(), false))
+}
+
+//MarkRead - sends a read receipt for a delivered envelope
+func MarkRead(env Envelope) error {
+	if len(env.Sender) != 32 || len(env.ID) != 32 {
+		return errors.New("Invalid envelope")
+	}
+	return sendReceipt(env.Sender, receiptRead, env.ID)
+}
+
+func handleReceipt(from []byte, inner Message) {
+	body := inner.Body
+	if len(body) <= receiptLen {
+		fmt.Println("Malformed receipt from", util.ToHexString(from))
+		return
+	}
+	key, err := lookupKey(from)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !encryption.ValidateSig(key, body[receiptLen:], body[:receiptLen]) {
+		fmt.Println("Invalid receipt signature from", util.ToHexString(from))
+		return
+	}
+	id := body[3:35]
+	status := StatusDelivered
+	if body[2] == receiptRead {
+		status = StatusRead
+	}
+	obmutex.Lock()
+	entry, exists := _outbox[outboxKey(id, from)]
+	if exists {
+		setStatus(entry, status)
+	}
+	obmutex.Unlock()
+}
+
+func saveOutbox() error {
+	obmutex.Lock()
+	defer obmutex.Unlock()
+	return util.SaveGob(config.Attr("outboxfile"), _outbox)
+}
+
+func loadOutbox() error {
+	outbox := make(map[string]*outboxEntry)
+	err := util.LoadGob(config.Attr("outboxfile"), &outbox)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	obmutex.Lock()
+	_outbox = outbox
+	obmutex.Unlock()
+	return nil
+}
@@ -1,32 +1,33 @@
 package node
 
 import (
-	"fmt"
 	"mobchat/config"
 	"mobchat/node/routing"
-	"strconv"
+	"net"
 )
 
+//findPeers - dials server nodes from the routing table until the outgoing
+//slots (maxoutgoing) are filled
 func findPeers() {
-	maxOutgoing, _ := strconv.ParseInt(config.Attr("maxoutgoing"), 10, 64)
-	if _connections.countOutgoing() >= maxOutgoing {
+	if stopping() {
 		return
 	}
-	mutex.Lock()
-	fmt.Println(len(routing.Table.Nodes))
-	for key := range routing.Table.Nodes {
-		node := routing.Table.Nodes[key]
-		if _connections.Contains(node, false) || node.RequestedPeer || _me.Address.String() == node.Address.String() {
-			continue
-		}
-		if node.IsServer() {
-
-			node.RequestedPeer = true
-			go Connect(node.Address.IP, node.Address.Port)
-
+	free := int64(config.AttrInt("maxoutgoing", 5)) - _connections.countOutgoing() - _dialer.inflightCount()
+	if free <= 0 {
+		return
+	}
+	nodes := routing.Table.ServerNodes()
+	for _, node := range nodes {
+		if free <= 0 {
 			break
-
 		}
+		addr := net.JoinHostPort(node.Address.IP, node.Address.Port)
+		if _me.Address.String() == node.Address.String() || _connections.Contains(node, true) ||
+			_dialer.isInflight(addr) || _dialer.backingOff(addr) {
+			continue
+		}
+		node.RequestedPeer = true
+		_dialer.dial(node.Address.IP, node.Address.Port, 1)
+		free--
 	}
-	mutex.Unlock()
 }
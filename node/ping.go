@@ -0,0 +1,117 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"mobchat/config"
+	"mobchat/node/commands"
+	"mobchat/node/routing"
+	"strconv"
+	"time"
+)
+
+//keepalive - pings the connection every pinginterval and closes it once
+//maxmissedpongs pings in a row have gone unanswered. Closing the socket
+//makes the reader loop fail, which removes (and retries) the connection.
+func (con *Connection) keepalive() {
+	interval, err := time.ParseDuration(config.Attr("pinginterval"))
+	if err != nil || interval <= 0 {
+		fmt.Println("Invalid pinginterval - keepalive disabled")
+		return
+	}
+	maxMissed, err := strconv.Atoi(config.Attr("maxmissedpongs"))
+	if err != nil || maxMissed <= 0 {
+		maxMissed = 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-con.done:
+			return
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mutex.Lock()
+		if con.awaitingPong {
+			con.missedPongs++
+		}
+		missed := con.missedPongs
+		mutex.Unlock()
+		if missed >= maxMissed {
+			fmt.Println("No pong from", con.addr.String(), "- closing connection")
+			con.close()
+			return
+		}
+		con.sendPing()
+	}
+}
+
+func (con *Connection) sendPing() {
+	nonce := rand.Uint64()
+	mutex.Lock()
+	con.pingNonce = nonce
+	con.pingSent = time.Now()
+	con.awaitingPong = true
+	mutex.Unlock()
+	body := make([]byte, 10)
+	body[0] = commands.Version
+	body[1] = commands.CmdPing
+	binary.BigEndian.PutUint64(body[2:], nonce)
+	err := con.sendMessage(NewMessage(body, false))
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handlePing(data []byte, con *Connection) {
+	if len(data) != 8 {
+		fmt.Println("Invalid ping")
+		return
+	}
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdPong})
+	buff.Write(data)
+	err := con.sendMessage(NewMessage(buff.Bytes(), false))
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handlePong(data []byte, con *Connection) {
+	if len(data) != 8 {
+		fmt.Println("Invalid pong")
+		return
+	}
+	nonce := binary.BigEndian.Uint64(data)
+	mutex.Lock()
+	if !con.awaitingPong || nonce != con.pingNonce {
+		mutex.Unlock()
+		return
+	}
+	sample := time.Since(con.pingSent)
+	if con.rtt == 0 {
+		con.rtt = sample
+	} else {
+		//smoothed the same way TCP does: 7/8 old + 1/8 new
+		con.rtt = (7*con.rtt + sample) / 8
+	}
+	con.awaitingPong = false
+	con.missedPongs = 0
+	rtt := con.rtt
+	id := con.id
+	mutex.Unlock()
+	if id != nil {
+		routing.Table.SetRTT(id, rtt)
+	}
+}
+
+//RTT - returns the smoothed round trip time of the connection
+func (con *Connection) RTT() time.Duration {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return con.rtt
+}
@@ -0,0 +1,327 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//Prekey bundles let a sender start a forward secret session with a node
+//that is offline. Each node uploads a signed prekey and a batch of one
+//time prekeys to its mailbox servers, each server getting its own share of
+//the one time prekeys. A fetch asks one server at a time and returns the
+//signed prekey and one of that server's one time prekeys, so each is used
+//at most once
+
+const (
+	prekeyLen       = 4 + 32
+	prekeyFetchWait = 10 * time.Second
+	//MaxOneTimePrekeys - one time prekeys a server keeps for each node
+	MaxOneTimePrekeys = 100
+)
+
+//Prekey - an X25519 public key with its ID
+type Prekey struct {
+	ID     uint32
+	Public []byte
+}
+
+//PrekeyBundle - what a sender needs to start a session with Owner
+type PrekeyBundle struct {
+	Owner         []byte
+	SignedPrekey  Prekey
+	Signature     []byte //owner's signature over the signed prekey
+	OneTimePrekey *Prekey
+}
+
+type storedPrekeys struct {
+	SignedPrekey Prekey
+	Signature    []byte
+	OneTime      []Prekey
+}
+
+var (
+	_prekeys = make(map[string]*storedPrekeys)
+	pkmutex  = sync.Mutex{}
+)
+
+func (prekey *Prekey) serialize() []byte {
+	b := make([]byte, prekeyLen)
+	binary.BigEndian.PutUint32(b[0:4], prekey.ID)
+	copy(b[4:], prekey.Public)
+	return b
+}
+
+func deserializePrekey(b []byte) Prekey {
+	return Prekey{
+		ID:     binary.BigEndian.Uint32(b[0:4]),
+		Public: append([]byte(nil), b[4:prekeyLen]...),
+	}
+}
+
+//Verify - checks the owner's signature over the signed prekey
+func (bundle *PrekeyBundle) Verify() error {
+	key, err := lookupKey(bundle.Owner)
+	if err != nil {
+		return err
+	}
+	if !encryption.ValidateSig(key, bundle.Signature, bundle.SignedPrekey.serialize()) {
+		return errors.New("Invalid signed prekey signature")
+	}
+	return nil
+}
+
+//OneTimePrekeyLimit - one time prekeys a node keeps the private keys of,
+//enough for what all of its mailbox servers can hold
+func OneTimePrekeyLimit() int {
+	return MaxOneTimePrekeys * config.AttrInt("mailboxreplicas", 3)
+}
+
+//PublishPrekeys - signs the signed prekey and uploads it to this node's
+//mailbox servers, splitting the one time prekeys between them
+func PublishPrekeys(ctx context.Context, signed Prekey, oneTime []Prekey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sig, err := encryption.Sign(_me.Key, signed.serialize())
+	if err != nil {
+		return err
+	}
+	servers := mailboxServers(_me.ID())
+	sent := 0
+	for i, server := range servers {
+		share := make([]Prekey, 0, len(oneTime)/len(servers)+1)
+		for j := i; j < len(oneTime); j += len(servers) {
+			share = append(share, oneTime[j])
+		}
+		var buff bytes.Buffer
+		buff.Write(signed.serialize())
+		buff.Write(sig)
+		cnt := make([]byte, 2)
+		binary.BigEndian.PutUint16(cnt, uint16(len(share)))
+		buff.Write(cnt)
+		for _, prekey := range share {
+			buff.Write(prekey.serialize())
+		}
+		req, err := signedRequest(commands.CmdPrekeyPublish, buff.Bytes())
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(server.ID(), _me.ID()) {
+			handlePrekeyPublish(_me.ID(), req)
+			sent++
+			continue
+		}
+		err = sendTo(server.ID(), req)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return errors.New("Could not reach any mailbox server")
+	}
+	return nil
+}
+
+func handlePrekeyPublish(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	owner, extra, err := verifyRequest(inner.Body)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ownerKey, err := lookupKey(owner)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sigLen := ownerKey.SigLen()
+	if len(extra) < prekeyLen+sigLen+2 {
+		fmt.Println("Malformed prekey publish from", util.ToHexString(from))
+		return
+	}
+	signed := deserializePrekey(extra)
+	sig := extra[prekeyLen : prekeyLen+sigLen]
+	idx := prekeyLen + sigLen
+	cnt := int(binary.BigEndian.Uint16(extra[idx : idx+2]))
+	idx += 2
+	if len(extra) != idx+cnt*prekeyLen {
+		fmt.Println("Malformed prekey publish from", util.ToHexString(from))
+		return
+	}
+	key := util.ToHexString(owner)
+	pkmutex.Lock()
+	defer pkmutex.Unlock()
+	stored, exists := _prekeys[key]
+	if !exists {
+		stored = &storedPrekeys{}
+		_prekeys[key] = stored
+	}
+	stored.SignedPrekey = signed
+	stored.Signature = append([]byte(nil), sig...)
+	for i := 0; i < cnt; i++ {
+		stored.OneTime = append(stored.OneTime, deserializePrekey(extra[idx+i*prekeyLen:]))
+	}
+	if len(stored.OneTime) > MaxOneTimePrekeys {
+		stored.OneTime = stored.OneTime[len(stored.OneTime)-MaxOneTimePrekeys:]
+	}
+}
+
+//FetchPrekeys - asks the owner's mailbox servers for a prekey bundle, one
+//after the other until one answers, so only one one time prekey is used up
+func FetchPrekeys(ctx context.Context, owner []byte) (PrekeyBundle, error) {
+	ctx, cancel := context.WithTimeout(ctx, prekeyFetchWait)
+	defer cancel()
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdPrekeyFetch})
+	buff.Write(owner)
+	req := NewMessage(buff.Bytes(), false)
+	answers := make(chan PrekeyBundle, 1)
+	_messageCallbacks.Add(req.ID(), func(resp Message) {
+		bundle, err := deserializeBundle(resp.Body)
+		if err == nil {
+			err = bundle.Verify()
+		}
+		if err != nil || !bytes.Equal(bundle.Owner, owner) {
+			fmt.Println("Invalid prekey bundle", err)
+			return
+		}
+		select {
+		case answers <- bundle:
+		default:
+		}
+	})
+	servers := mailboxServers(owner)
+	for _, server := range servers {
+		if bytes.Equal(server.ID(), _me.ID()) {
+			handlePrekeyFetch(_me.ID(), req)
+		} else if err := sendTo(server.ID(), req); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		wait := time.NewTimer(prekeyFetchWait / time.Duration(len(servers)))
+		select {
+		case bundle := <-answers:
+			wait.Stop()
+			return bundle, nil
+		case <-ctx.Done():
+			wait.Stop()
+			return PrekeyBundle{}, errors.New("No prekey bundle for " + util.ToHexString(owner))
+		case <-wait.C:
+		}
+	}
+	select {
+	case bundle := <-answers:
+		return bundle, nil
+	default:
+		return PrekeyBundle{}, errors.New("No prekey bundle for " + util.ToHexString(owner))
+	}
+}
+
+func handlePrekeyFetch(from []byte, inner Message) {
+	if !_me.IsServer() || len(inner.Body) != 2+32 {
+		return
+	}
+	owner := inner.Body[2:34]
+	pkmutex.Lock()
+	stored, exists := _prekeys[util.ToHexString(owner)]
+	if !exists {
+		pkmutex.Unlock()
+		return
+	}
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdPrekeyFetchResp})
+	buff.Write(inner.ID())
+	buff.Write(owner)
+	buff.Write(stored.SignedPrekey.serialize())
+	buff.Write(stored.Signature)
+	if len(stored.OneTime) > 0 {
+		buff.WriteByte(0x01)
+		buff.Write(stored.OneTime[0].serialize())
+		stored.OneTime = stored.OneTime[1:]
+	} else {
+		buff.WriteByte(0x00)
+	}
+	pkmutex.Unlock()
+	resp := NewMessage(buff.Bytes(), false)
+	if bytes.Equal(from, _me.ID()) {
+		handlePrekeyFetchResp(from, resp)
+		return
+	}
+	err := sendTo(from, resp)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handlePrekeyFetchResp(from []byte, inner Message) {
+	if len(inner.Body) < 2+32 {
+		return
+	}
+	_messageCallbacks.Call(inner.Body[2:34], inner)
+}
+
+//deserializeBundle - Version, cmd, request ID, owner, signed prekey, sig,
+//has one time prekey, one time prekey
+func deserializeBundle(body []byte) (PrekeyBundle, error) {
+	idx := 2 + 32 + 32
+	if len(body) < idx {
+		return PrekeyBundle{}, errors.New("Prekey bundle too short")
+	}
+	ownerKey, err := lookupKey(body[34:66])
+	if err != nil {
+		return PrekeyBundle{}, err
+	}
+	sigLen := ownerKey.SigLen()
+	if len(body) < idx+prekeyLen+sigLen+1 {
+		return PrekeyBundle{}, errors.New("Prekey bundle too short")
+	}
+	bundle := PrekeyBundle{
+		Owner:        body[34:66],
+		SignedPrekey: deserializePrekey(body[idx:]),
+		Signature:    body[idx+prekeyLen : idx+prekeyLen+sigLen],
+	}
+	idx += prekeyLen + sigLen
+	if body[idx] == 0x01 {
+		if len(body) < idx+1+prekeyLen {
+			return PrekeyBundle{}, errors.New("Prekey bundle too short")
+		}
+		prekey := deserializePrekey(body[idx+1:])
+		bundle.OneTimePrekey = &prekey
+	}
+	return bundle, nil
+}
+
+func savePrekeys() error {
+	pkmutex.Lock()
+	defer pkmutex.Unlock()
+	return util.SaveGob(config.Attr("prekeyfile"), _prekeys)
+}
+
+func loadPrekeys() error {
+	prekeys := make(map[string]*storedPrekeys)
+	err := util.LoadGob(config.Attr("prekeyfile"), &prekeys)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	pkmutex.Lock()
+	_prekeys = prekeys
+	pkmutex.Unlock()
+	return nil
+}
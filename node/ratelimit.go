@@ -0,0 +1,96 @@
+package node
+
+import (
+	"mobchat/config"
+	"mobchat/node/commands"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//tokenBucket - refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type bucketLimit struct {
+	rate  float64
+	burst float64
+}
+
+//commandLimits - tighter limits for commands that are expensive to answer.
+//Everything else only counts against the per connection limit
+var commandLimits = map[byte]bucketLimit{
+	commands.CmdHandshake:    {rate: 0.1, burst: 2},
+	commands.CmdCheckRouting: {rate: 0.2, burst: 3},
+	commands.CmdGetRouting:   {rate: 0.05, burst: 2},
+	commands.CmdGetRoute:     {rate: 1, burst: 5},
+	commands.CmdPing:         {rate: 1, burst: 3},
+}
+
+//rateLimiter - per connection limiter with a bucket per limited command
+type rateLimiter struct {
+	mu     sync.Mutex
+	total  *tokenBucket
+	perCmd map[byte]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	rate, err := strconv.ParseFloat(config.Attr("ratelimit"), 64)
+	if err != nil || rate <= 0 {
+		rate = 50
+	}
+	burst, err := strconv.ParseFloat(config.Attr("ratelimitburst"), 64)
+	if err != nil || burst < 1 {
+		burst = 2 * rate
+	}
+	return &rateLimiter{
+		total:  newTokenBucket(rate, burst),
+		perCmd: make(map[byte]*tokenBucket),
+	}
+}
+
+//allow - reports whether a message with the given command may be handled
+func (rl *rateLimiter) allow(cmd byte) bool {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.total.allow(now) {
+		return false
+	}
+	limit, limited := commandLimits[cmd]
+	if !limited {
+		return true
+	}
+	bucket, exists := rl.perCmd[cmd]
+	if !exists {
+		bucket = newTokenBucket(limit.rate, limit.burst)
+		rl.perCmd[cmd] = bucket
+	}
+	return bucket.allow(now)
+}
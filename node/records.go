@@ -0,0 +1,399 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//Records are small signed documents, such as device lists and profiles,
+//kept by the server nodes closest to the ID of the key that signed them,
+//the same servers that keep that ID's mailbox. A record is self
+//certifying: it carries the signing key and its owner is the ID of that
+//key, so the key doesn't have to belong to a node. Servers keep the record
+//with the highest sequence number per owner and kind, at most recordsmax
+//records in all, and answer a fetch for a record they don't have with an
+//empty response. Misses are remembered for recordmissttl
+
+const (
+	maxRecordData   = 64 * 1024
+	recordFetchWait = 5 * time.Second
+)
+
+//Record -
+type Record struct {
+	Kind byte
+	Seq  uint64
+	Key  encryption.Key //public key of the owner
+	Data []byte
+	Sig  []byte
+}
+
+var (
+	_records      = make(map[string][]byte)          //serialized records by owner and kind
+	_recordMisses = make(map[string]time.Time)       //fetches no server had a record for
+	_recordAsked  = make(map[string]map[string]bool) //servers that may still say no, by request
+	recmutex      = sync.Mutex{}
+)
+
+//NewRecord - signs a record with key. Seq needs to grow with every update
+//for servers to accept it
+func NewRecord(kind byte, seq uint64, key encryption.Key, data []byte) (Record, error) {
+	rec := Record{
+		Kind: kind,
+		Seq:  seq,
+		Key:  key.PublicKey(),
+		Data: data,
+	}
+	signed, err := rec.signedPart()
+	if err != nil {
+		return Record{}, err
+	}
+	rec.Sig, err = encryption.Sign(key, signed)
+	if err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+//Owner - ID of the key that signed the record
+func (rec *Record) Owner() []byte {
+	return rec.Key.ID()
+}
+
+//signedPart - kind, seq, key, data length, data
+func (rec *Record) signedPart() ([]byte, error) {
+	if len(rec.Data) > maxRecordData {
+		return nil, errors.New("Record too large")
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(rec.Kind)
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, rec.Seq)
+	buff.Write(seq)
+	key, err := rec.Key.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	buff.Write(key)
+	ln := make([]byte, 4)
+	binary.BigEndian.PutUint32(ln, uint32(len(rec.Data)))
+	buff.Write(ln)
+	buff.Write(rec.Data)
+	return buff.Bytes(), nil
+}
+
+//Serialize -
+func (rec *Record) Serialize() ([]byte, error) {
+	signed, err := rec.signedPart()
+	if err != nil {
+		return nil, err
+	}
+	return append(signed, rec.Sig...), nil
+}
+
+//Verify -
+func (rec *Record) Verify() error {
+	signed, err := rec.signedPart()
+	if err != nil {
+		return err
+	}
+	if !encryption.ValidateSig(rec.Key, rec.Sig, signed) {
+		return errors.New("Invalid record signature")
+	}
+	return nil
+}
+
+//DeserializeRecord -
+func DeserializeRecord(data []byte) (Record, error) {
+	if len(data) < 1+8 {
+		return Record{}, errors.New("Record too short")
+	}
+	rec := Record{
+		Kind: data[0],
+		Seq:  binary.BigEndian.Uint64(data[1:9]),
+	}
+	keyLen, err := encryption.SerializedLen(data[9:])
+	if err != nil {
+		return Record{}, err
+	}
+	rec.Key, err = encryption.Deserialize(data[9 : 9+keyLen])
+	if err != nil {
+		return Record{}, err
+	}
+	idx := 9 + keyLen
+	if len(data) < idx+4 {
+		return Record{}, errors.New("Record too short")
+	}
+	ln := int(binary.BigEndian.Uint32(data[idx : idx+4]))
+	idx += 4
+	if ln > maxRecordData || len(data) != idx+ln+rec.Key.SigLen() {
+		return Record{}, errors.New("Invalid record length")
+	}
+	rec.Data = data[idx : idx+ln]
+	rec.Sig = data[idx+ln:]
+	return rec, nil
+}
+
+func recordKey(owner []byte, kind byte) string {
+	return util.ToHexString(owner) + util.ToHexString([]byte{kind})
+}
+
+//PublishRecord - stores the record on the servers of its owner. It is sent
+//with the owner as sender, so a record of a persona isn't tied to the node
+//that publishes it
+func PublishRecord(ctx context.Context, rec Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := rec.Serialize()
+	if err != nil {
+		return err
+	}
+	recmutex.Lock()
+	delete(_recordMisses, recordKey(rec.Owner(), rec.Kind))
+	recmutex.Unlock()
+	body := append([]byte{commands.Version, commands.CmdRecordStore}, data...)
+	msg := NewMessage(body, false)
+	sent := 0
+	for _, server := range mailboxServers(rec.Owner()) {
+		if bytes.Equal(server.ID(), _me.ID()) {
+			handleRecordStore(_me.ID(), msg)
+			sent++
+			continue
+		}
+		if bytes.Equal(rec.Owner(), _me.ID()) {
+			err = sendTo(server.ID(), msg)
+		} else {
+			err = sendAs(rec.Owner(), server.ID(), msg, PriorityChat)
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return errors.New("Could not reach any server")
+	}
+	return nil
+}
+
+func handleRecordStore(from []byte, inner Message) {
+	if !_me.IsServer() {
+		return
+	}
+	rec, err := DeserializeRecord(inner.Body[2:])
+	if err == nil {
+		err = rec.Verify()
+	}
+	if err != nil {
+		fmt.Println("Invalid record from", util.ToHexString(from), err)
+		return
+	}
+	key := recordKey(rec.Owner(), rec.Kind)
+	recmutex.Lock()
+	existing, exists := _records[key]
+	if exists && binary.BigEndian.Uint64(existing[1:9]) >= rec.Seq {
+		recmutex.Unlock()
+		return
+	}
+	if !exists && len(_records) >= config.AttrInt("recordsmax", 10000) {
+		recmutex.Unlock()
+		fmt.Println("Record store full, dropping record from", util.ToHexString(from))
+		return
+	}
+	_records[key] = append([]byte(nil), inner.Body[2:]...)
+	recmutex.Unlock()
+}
+
+//missedRecord - whether no server had the record a moment ago. Caller
+//holds recmutex
+func missedRecord(key string) bool {
+	missed, exists := _recordMisses[key]
+	if !exists {
+		return false
+	}
+	if time.Since(missed) > config.AttrDuration("recordmissttl", time.Minute) {
+		delete(_recordMisses, key)
+		return false
+	}
+	return true
+}
+
+//addRecordMiss - remembers a fetch no server had a record for, dropping
+//expired misses first. Caller holds recmutex
+func addRecordMiss(key string) {
+	for k := range _recordMisses {
+		missedRecord(k)
+	}
+	if len(_recordMisses) >= config.AttrInt("recordsmax", 10000) {
+		return
+	}
+	_recordMisses[key] = time.Now()
+}
+
+//FetchRecord - asks the owner's servers for a record and returns the newest
+//valid one once all of them answered or the timeout is up. Answers without
+//a record can't be verified, so they only count from the servers that were
+//asked, once each
+func FetchRecord(ctx context.Context, owner []byte, kind byte) (Record, error) {
+	key := recordKey(owner, kind)
+	recmutex.Lock()
+	missed := missedRecord(key)
+	recmutex.Unlock()
+	if missed {
+		return Record{}, errors.New("No record for " + util.ToHexString(owner))
+	}
+	ctx, cancel := context.WithTimeout(ctx, recordFetchWait)
+	defer cancel()
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdRecordFetch, kind})
+	buff.Write(owner)
+	req := NewMessage(buff.Bytes(), false)
+	servers := mailboxServers(owner)
+	asked := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		asked[util.ToHexString(server.ID())] = true
+	}
+	reqKey := util.ToHexString(req.ID())
+	recmutex.Lock()
+	_recordAsked[reqKey] = asked
+	recmutex.Unlock()
+	defer func() {
+		recmutex.Lock()
+		delete(_recordAsked, reqKey)
+		recmutex.Unlock()
+	}()
+	answers := make(chan *Record, len(servers))
+	_messageCallbacks.Add(req.ID(), func(resp Message) {
+		if len(resp.Body) < 2+32 {
+			return
+		}
+		if len(resp.Body) == 2+32 {
+			//the server has no such record
+			select {
+			case answers <- nil:
+			default:
+			}
+			return
+		}
+		rec, err := DeserializeRecord(resp.Body[2+32:])
+		if err == nil {
+			err = rec.Verify()
+		}
+		if err != nil || rec.Kind != kind || !bytes.Equal(rec.Owner(), owner) {
+			fmt.Println("Invalid record", err)
+			return
+		}
+		select {
+		case answers <- &rec:
+		default:
+		}
+	})
+	sent := 0
+	for _, server := range servers {
+		if bytes.Equal(server.ID(), _me.ID()) {
+			handleRecordFetch(_me.ID(), req)
+			sent++
+			continue
+		}
+		err := sendTo(server.ID(), req)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		sent++
+	}
+	var newest *Record
+	answered := 0
+	for answered < sent {
+		select {
+		case rec := <-answers:
+			answered++
+			if rec != nil && (newest == nil || rec.Seq > newest.Seq) {
+				newest = rec
+			}
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+	if newest == nil {
+		if sent > 0 && answered == sent {
+			recmutex.Lock()
+			addRecordMiss(key)
+			recmutex.Unlock()
+		}
+		return Record{}, errors.New("No record for " + util.ToHexString(owner))
+	}
+	return *newest, nil
+}
+
+func handleRecordFetch(from []byte, inner Message) {
+	if !_me.IsServer() || len(inner.Body) != 3+32 {
+		return
+	}
+	recmutex.Lock()
+	data := _records[recordKey(inner.Body[3:35], inner.Body[2])]
+	recmutex.Unlock()
+	//without data the response says there is no such record
+	body := append([]byte{commands.Version, commands.CmdRecordFetchResp}, inner.ID()...)
+	resp := NewMessage(append(body, data...), false)
+	if bytes.Equal(from, _me.ID()) {
+		handleRecordFetchResp(from, resp)
+		return
+	}
+	err := sendTo(from, resp)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleRecordFetchResp(from []byte, inner Message) {
+	if len(inner.Body) < 2+32 {
+		return
+	}
+	if len(inner.Body) == 2+32 {
+		key := util.ToHexString(inner.Body[2:34])
+		sender := util.ToHexString(from)
+		recmutex.Lock()
+		asked := _recordAsked[key][sender]
+		delete(_recordAsked[key], sender)
+		recmutex.Unlock()
+		if !asked {
+			return
+		}
+	}
+	_messageCallbacks.Call(inner.Body[2:34], inner)
+}
+
+func saveRecords() error {
+	recmutex.Lock()
+	defer recmutex.Unlock()
+	return util.SaveGob(config.Attr("recordfile"), _records)
+}
+
+func loadRecords() error {
+	records := make(map[string][]byte)
+	err := util.LoadGob(config.Attr("recordfile"), &records)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	recmutex.Lock()
+	_records = records
+	recmutex.Unlock()
+	return nil
+}
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mobchat/node/commands"
+	"mobchat/util"
+)
+
+//relay frames: Version, CmdRelayMessage, to (32), from (32), inner message.
+//The inner message is a full serialized Message carrying its own command so
+//anything can be addressed to a node that is not a direct peer. Frames are
+//forwarded to the recipient if it is connected, otherwise flooded to all
+//peers. messageExists stops a frame from being forwarded twice by a node
+const relayHeaderLen = 2 + 32 + 32
+
+//connectionTo - returns the handshaken connection to the given node ID
+func connectionTo(id []byte) *Connection {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, con := range _connections._lst {
+		if con.handshake && bytes.Equal(con.id, id) {
+			return con
+		}
+	}
+	return nil
+}
+
+//sendTo - sends the inner message to the node with the given ID
+func sendTo(to []byte, inner Message) error {
+	return sendToWithPriority(to, inner, PriorityChat)
+}
+
+func sendToWithPriority(to []byte, inner Message, prio Priority) error {
+	frame, err := relayFrame(_me.ID(), to, inner)
+	if err != nil {
+		return err
+	}
+	return forward(to, frame, prio)
+}
+
+//sendAs - sends the inner message with another ID than this node's as
+//sender. Answers to it are flooded, since no node has that ID. The frame
+//never goes straight to the recipient, which would see it come from this
+//node, but the peers relaying it still do
+func sendAs(from []byte, to []byte, inner Message, prio Priority) error {
+	frame, err := relayFrame(from, to, inner)
+	if err != nil {
+		return err
+	}
+	return relayAround(to, frame, prio)
+}
+
+func relayFrame(from []byte, to []byte, inner Message) (Message, error) {
+	if len(to) != 32 {
+		return Message{}, errors.New("Invalid node ID")
+	}
+	var buff bytes.Buffer
+	buff.Write([]byte{commands.Version, commands.CmdRelayMessage})
+	buff.Write(to)
+	buff.Write(from)
+	buff.Write(inner.Serialize())
+	frame := NewMessage(buff.Bytes(), false)
+	//record our own frame so it isn't handled when a peer floods it back
+	messageExists(frame.ID())
+	return frame, nil
+}
+
+//relayAround - sends the frame to all peers except the recipient
+func relayAround(to []byte, frame Message, prio Priority) error {
+	mutex.Lock()
+	peers := make([]*Connection, 0, len(_connections._lst))
+	for _, con := range _connections._lst {
+		if con.isPeer && !bytes.Equal(con.id, to) {
+			peers = append(peers, con)
+		}
+	}
+	mutex.Unlock()
+	if len(peers) == 0 {
+		return errors.New("No other peers to relay through")
+	}
+	for _, con := range peers {
+		con.sendMessageWithPriority(frame, prio)
+	}
+	return nil
+}
+
+func forward(to []byte, frame Message, prio Priority) error {
+	con := connectionTo(to)
+	if con != nil {
+		return con.sendMessageWithPriority(frame, prio)
+	}
+	if _connections.countPeers() == 0 {
+		return errors.New("No peers to relay through")
+	}
+	_connections.SendMessageWithPriority(frame, prio)
+	return nil
+}
+
+func handleRelay(msg Message, con *Connection) {
+	if len(msg.Body) < relayHeaderLen+9 {
+		misbehaving(con, "malformed relay", scoreMalformed)
+		return
+	}
+	to := msg.Body[2:34]
+	from := msg.Body[34:66]
+	if !bytes.Equal(to, _me.ID()) {
+		err := forward(to, msg, PriorityChat)
+		if err != nil {
+			fmt.Println(err)
+		}
+		//answers to drop fetches sent as the box are passed on like any
+		//other frame, so peers can't tell who took them
+		if _, exists := getDropBox(to); exists {
+			inner := DeserializeMessage(msg.Body[relayHeaderLen:])
+			if len(inner.Body) >= 2 && inner.Body[1] == commands.CmdDropFetchResp {
+				handleDropFetchResp(from, inner)
+			}
+		}
+		return
+	}
+	inner := DeserializeMessage(msg.Body[relayHeaderLen:])
+	if len(inner.Body) < 2 {
+		fmt.Println("Empty relayed message from", util.ToHexString(from))
+		return
+	}
+	switch inner.Body[1] {
+	case commands.CmdGeneric, commands.CmdGenericMulti:
+		err := handleDirect(from, inner)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case commands.CmdMailboxStore:
+		handleMailboxStore(from, inner)
+	case commands.CmdMailboxFetch:
+		handleMailboxFetch(from, inner)
+	case commands.CmdMailboxFetchResp:
+		handleMailboxFetchResp(from, inner)
+	case commands.CmdMailboxDelete:
+		handleMailboxDelete(from, inner)
+	case commands.CmdReceipt:
+		handleReceipt(from, inner)
+	case commands.CmdPrekeyPublish:
+		handlePrekeyPublish(from, inner)
+	case commands.CmdPrekeyFetch:
+		handlePrekeyFetch(from, inner)
+	case commands.CmdPrekeyFetchResp:
+		handlePrekeyFetchResp(from, inner)
+	case commands.CmdRecordStore:
+		handleRecordStore(from, inner)
+	case commands.CmdRecordFetch:
+		handleRecordFetch(from, inner)
+	case commands.CmdRecordFetchResp:
+		handleRecordFetchResp(from, inner)
+	case commands.CmdDropStore:
+		handleDropStore(from, inner)
+	case commands.CmdDropFetch:
+		handleDropFetch(from, inner)
+	case commands.CmdDropFetchResp:
+		handleDropFetchResp(from, inner)
+	case commands.CmdDropDelete:
+		handleDropDelete(from, inner)
+	default:
+		fmt.Println("Junk relayed message from", util.ToHexString(from))
+	}
+}
@@ -0,0 +1,481 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/node/routing"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//Key statements retire a node key. A succession is signed by the old key
+//and by the new key it names, so contacts can move to the new ID. A
+//revocation is signed by the old key only and can be made ahead of time and
+//kept offline until the key is lost or stolen. Statements are flooded to
+//all nodes, which drop the old ID from routing and refuse anything signed
+//with it from then on. A revocation overrides a succession for the same
+//key, since a stolen key could name a successor of the thief's choosing.
+//Statements about IDs this node knows are kept for good. Others are only
+//held for a while, at most keystatementsmax of them, so anyone can't fill
+//the disk by retiring made up keys
+
+//StatementKind -
+type StatementKind byte
+
+const (
+	//KeySuccession - the old key hands over to a new one
+	KeySuccession StatementKind = 0x01
+
+	//KeyRevocation - the old key must not be used anymore
+	KeyRevocation StatementKind = 0x02
+)
+
+//KeyStatement - a succession or revocation of Old
+type KeyStatement struct {
+	Kind      StatementKind
+	Timestamp uint64
+	Reason    string
+	Old       encryption.Key
+	New       encryption.Key //only for successions
+	NewSig    []byte         //signature of New over the signed part
+	Sig       []byte         //signature of Old over the signed part and NewSig
+}
+
+//KeyChangeHandler - called when a node ID is retired. successor is nil for
+//a revocation
+type KeyChangeHandler func(old []byte, successor []byte)
+
+type strayStatement struct {
+	data     []byte
+	received time.Time
+}
+
+var (
+	_keyStatements     = make(map[string][]byte) //serialized statements by old ID
+	_strayStatements   = make(map[string]strayStatement)
+	_keyChangeHandlers []KeyChangeHandler
+	_knownIDChecks     []func(id []byte) bool
+	revmutex           = sync.Mutex{}
+)
+
+//signedPart - kind, timestamp, reason length, reason, old key, new key
+func (st *KeyStatement) signedPart() ([]byte, error) {
+	var buff bytes.Buffer
+	buff.WriteByte(byte(st.Kind))
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, st.Timestamp)
+	buff.Write(ts)
+	if len(st.Reason) > 255 {
+		return nil, errors.New("Reason too long")
+	}
+	buff.WriteByte(byte(len(st.Reason)))
+	buff.WriteString(st.Reason)
+	old := st.Old.PublicKey()
+	oldKey, err := old.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	buff.Write(oldKey)
+	if st.Kind == KeySuccession {
+		successor := st.New.PublicKey()
+		newKey, err := successor.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		buff.Write(newKey)
+	}
+	return buff.Bytes(), nil
+}
+
+//Serialize -
+func (st *KeyStatement) Serialize() ([]byte, error) {
+	signed, err := st.signedPart()
+	if err != nil {
+		return nil, err
+	}
+	signed = append(signed, st.NewSig...)
+	return append(signed, st.Sig...), nil
+}
+
+//DeserializeKeyStatement -
+func DeserializeKeyStatement(data []byte) (KeyStatement, error) {
+	if len(data) < 1+8+1 {
+		return KeyStatement{}, errors.New("Key statement too short")
+	}
+	st := KeyStatement{
+		Kind:      StatementKind(data[0]),
+		Timestamp: binary.BigEndian.Uint64(data[1:9]),
+	}
+	if st.Kind != KeySuccession && st.Kind != KeyRevocation {
+		return KeyStatement{}, errors.New("Unknown key statement")
+	}
+	idx := 10 + int(data[9])
+	if len(data) < idx {
+		return KeyStatement{}, errors.New("Key statement too short")
+	}
+	st.Reason = string(data[10:idx])
+	keyLen, err := encryption.SerializedLen(data[idx:])
+	if err != nil {
+		return KeyStatement{}, err
+	}
+	st.Old, err = encryption.Deserialize(data[idx : idx+keyLen])
+	if err != nil {
+		return KeyStatement{}, err
+	}
+	idx += keyLen
+	if st.Kind == KeySuccession {
+		keyLen, err = encryption.SerializedLen(data[idx:])
+		if err != nil {
+			return KeyStatement{}, err
+		}
+		st.New, err = encryption.Deserialize(data[idx : idx+keyLen])
+		if err != nil {
+			return KeyStatement{}, err
+		}
+		idx += keyLen
+		if len(data) < idx+st.New.SigLen() {
+			return KeyStatement{}, errors.New("Key statement too short")
+		}
+		st.NewSig = data[idx : idx+st.New.SigLen()]
+		idx += st.New.SigLen()
+	}
+	if len(data) != idx+st.Old.SigLen() {
+		return KeyStatement{}, errors.New("Invalid key statement length")
+	}
+	st.Sig = data[idx:]
+	return st, nil
+}
+
+//Verify - checks the signatures of the statement
+func (st *KeyStatement) Verify() error {
+	signed, err := st.signedPart()
+	if err != nil {
+		return err
+	}
+	if st.Kind == KeySuccession {
+		if !encryption.ValidateSig(st.New, st.NewSig, signed) {
+			return errors.New("Invalid successor signature")
+		}
+		if bytes.Equal(st.New.ID(), st.Old.ID()) {
+			return errors.New("Key can't succeed itself")
+		}
+	}
+	if !encryption.ValidateSig(st.Old, st.Sig, append(signed, st.NewSig...)) {
+		return errors.New("Invalid key statement signature")
+	}
+	return nil
+}
+
+//newKeyStatement - signs a statement about old
+func newKeyStatement(kind StatementKind, old encryption.Key, successor encryption.Key, reason string) (KeyStatement, error) {
+	st := KeyStatement{
+		Kind:      kind,
+		Timestamp: uint64(time.Now().UnixNano()),
+		Reason:    reason,
+		Old:       old,
+		New:       successor,
+	}
+	signed, err := st.signedPart()
+	if err != nil {
+		return KeyStatement{}, err
+	}
+	if kind == KeySuccession {
+		st.NewSig, err = encryption.Sign(successor, signed)
+		if err != nil {
+			return KeyStatement{}, err
+		}
+	}
+	st.Sig, err = encryption.Sign(old, append(signed, st.NewSig...))
+	if err != nil {
+		return KeyStatement{}, err
+	}
+	st.Old = old.PublicKey()
+	st.New = successor.PublicKey()
+	return st, nil
+}
+
+//RevocationCertificate - a signed revocation of this node's key. Keep it
+//somewhere safe and publish it with PublishKeyStatement if the key is lost
+func RevocationCertificate(reason string) ([]byte, error) {
+	st, err := newKeyStatement(KeyRevocation, _me.Key, encryption.Key{}, reason)
+	if err != nil {
+		return nil, err
+	}
+	return st.Serialize()
+}
+
+//RotateKey - makes a new node key, signs the succession with both keys and
+//floods it. The old key stays in the keystore under a second label. The
+//node uses the new key right away, peers drop the connections of the old
+//ID and they are dialed again with the new one. Returns the new ID
+func RotateKey() ([]byte, error) {
+	successor, err := encryption.GenerateEd25519()
+	if err != nil {
+		return nil, err
+	}
+	st, err := newKeyStatement(KeySuccession, _me.Key, successor, "")
+	if err != nil {
+		return nil, err
+	}
+	ksmutex.Lock()
+	ks, err := openKeystore()
+	if err == nil {
+		label := config.Attr("keylabel")
+		err = ks.Add(label+"-"+util.ToHexString(_me.ID()[:4]), _me.Key, _passphrase)
+		if err == nil {
+			err = ks.Remove(label, _passphrase)
+		}
+		if err == nil {
+			err = ks.Add(label, successor, _passphrase)
+		}
+	}
+	ksmutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	data, err := st.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	err = PublishKeyStatement(data)
+	if err != nil {
+		return nil, err
+	}
+	if n := routing.Table.Get(_me.ID()); n != nil {
+		routing.Table.RemoveNode(n)
+	}
+	_me.Key = successor
+	n := routing.NewNode(_me.Key.PublicKey(), _me.Address, nil)
+	routing.Table.AddNode(&n)
+	return successor.ID(), nil
+}
+
+//PublishKeyStatement - applies a succession or revocation and floods it to
+//the network
+func PublishKeyStatement(data []byte) error {
+	st, err := DeserializeKeyStatement(data)
+	if err != nil {
+		return err
+	}
+	err = st.Verify()
+	if err != nil {
+		return err
+	}
+	applyKeyStatement(st, data)
+	broadcastKeyStatement(data, nil)
+	return nil
+}
+
+//AddKeyChangeHandler - registers a callback for retired node IDs
+func AddKeyChangeHandler(handler KeyChangeHandler) {
+	revmutex.Lock()
+	_keyChangeHandlers = append(_keyChangeHandlers, handler)
+	revmutex.Unlock()
+}
+
+//AddKnownIDCheck - registers a check for IDs whose key statements are
+//worth keeping for good, such as contacts
+func AddKnownIDCheck(check func(id []byte) bool) {
+	revmutex.Lock()
+	_knownIDChecks = append(_knownIDChecks, check)
+	revmutex.Unlock()
+}
+
+//isKnownID - this node, a node in the routing table or connected, or one a
+//check registered with AddKnownIDCheck knows
+func isKnownID(id []byte) bool {
+	if bytes.Equal(id, _me.ID()) || routing.Table.Get(id) != nil || connectionTo(id) != nil {
+		return true
+	}
+	revmutex.Lock()
+	checks := _knownIDChecks
+	revmutex.Unlock()
+	for _, check := range checks {
+		if check(id) {
+			return true
+		}
+	}
+	return false
+}
+
+//keyStatement - the statement retiring the ID, if any. Caller holds
+//revmutex
+func keyStatement(key string) ([]byte, bool) {
+	if data, exists := _keyStatements[key]; exists {
+		return data, true
+	}
+	stray, exists := _strayStatements[key]
+	if !exists {
+		return nil, false
+	}
+	if time.Since(stray.received) > config.AttrDuration("keystatementttl", 24*time.Hour) {
+		delete(_strayStatements, key)
+		return nil, false
+	}
+	return stray.data, true
+}
+
+//addStray - holds a statement about an unknown ID, dropping expired ones
+//and then the oldest beyond keystatementsmax. Caller holds revmutex
+func addStray(key string, data []byte) {
+	ttl := config.AttrDuration("keystatementttl", 24*time.Hour)
+	oldest := ""
+	for k, stray := range _strayStatements {
+		if time.Since(stray.received) > ttl {
+			delete(_strayStatements, k)
+			continue
+		}
+		if oldest == "" || stray.received.Before(_strayStatements[oldest].received) {
+			oldest = k
+		}
+	}
+	if oldest != "" && len(_strayStatements) >= config.AttrInt("keystatementsmax", 1000) {
+		delete(_strayStatements, oldest)
+	}
+	_strayStatements[key] = strayStatement{data: append([]byte(nil), data...), received: time.Now()}
+}
+
+//IsRevoked - whether the node ID was retired by a succession or revocation
+func IsRevoked(id []byte) bool {
+	revmutex.Lock()
+	defer revmutex.Unlock()
+	_, exists := keyStatement(util.ToHexString(id))
+	return exists
+}
+
+//Successor - the key that took over from id, if it was retired by a
+//succession that wasn't revoked later
+func Successor(id []byte) (encryption.Key, bool) {
+	revmutex.Lock()
+	data, exists := keyStatement(util.ToHexString(id))
+	revmutex.Unlock()
+	if !exists {
+		return encryption.Key{}, false
+	}
+	st, err := DeserializeKeyStatement(data)
+	if err != nil || st.Kind != KeySuccession {
+		return encryption.Key{}, false
+	}
+	return st.New, true
+}
+
+//applyKeyStatement - records a verified statement. Returns false if it
+//didn't change anything
+func applyKeyStatement(st KeyStatement, data []byte) bool {
+	oldID := st.Old.ID()
+	key := util.ToHexString(oldID)
+	known := isKnownID(oldID)
+	revmutex.Lock()
+	if existing, exists := keyStatement(key); exists {
+		//only a revocation can replace a succession
+		if st.Kind != KeyRevocation || StatementKind(existing[0]) == KeyRevocation {
+			revmutex.Unlock()
+			return false
+		}
+	}
+	//a revocation after a kept succession must replace it, even though
+	//the old ID is gone from routing by now
+	if _, kept := _keyStatements[key]; kept {
+		known = true
+	}
+	if !known {
+		addStray(key, data)
+		revmutex.Unlock()
+		return true
+	}
+	delete(_strayStatements, key)
+	_keyStatements[key] = append([]byte(nil), data...)
+	handlers := _keyChangeHandlers
+	revmutex.Unlock()
+	err := saveKeyStatements()
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println("key retired", key)
+
+	if n := routing.Table.Get(oldID); n != nil && !bytes.Equal(oldID, _me.ID()) {
+		routing.Table.RemoveNode(n)
+	}
+	if con := connectionTo(oldID); con != nil && !bytes.Equal(oldID, _me.ID()) {
+		con.close()
+	}
+	var successor []byte
+	if st.Kind == KeySuccession {
+		successor = st.New.ID()
+	}
+	for _, handler := range handlers {
+		handler(oldID, successor)
+	}
+	return true
+}
+
+//broadcastKeyStatement - sends a statement to all connections, or only to
+//con if it is set
+func broadcastKeyStatement(data []byte, con *Connection) {
+	body := append([]byte{commands.Version, commands.CmdKeyStatement}, data...)
+	msg := NewMessage(body, false)
+	if con != nil {
+		err := con.sendMessage(msg)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	_connections.SendMessage(msg)
+}
+
+func handleKeyStatement(msg Message, con *Connection) {
+	st, err := DeserializeKeyStatement(msg.Body[2:])
+	if err == nil {
+		err = st.Verify()
+	}
+	if err != nil {
+		fmt.Println(err)
+		misbehaving(con, "invalid key statement", scoreBadSignature)
+		return
+	}
+	if applyKeyStatement(st, msg.Body[2:]) {
+		go _connections.SendMessage(msg)
+	}
+}
+
+//sendKeyStatements - catches a new connection up on retired keys
+func sendKeyStatements(con *Connection) {
+	revmutex.Lock()
+	statements := make([][]byte, 0, len(_keyStatements))
+	for _, data := range _keyStatements {
+		statements = append(statements, data)
+	}
+	revmutex.Unlock()
+	for _, data := range statements {
+		broadcastKeyStatement(data, con)
+	}
+}
+
+func saveKeyStatements() error {
+	revmutex.Lock()
+	defer revmutex.Unlock()
+	return util.SaveGob(config.Attr("revokedfile"), _keyStatements)
+}
+
+func loadKeyStatements() error {
+	statements := make(map[string][]byte)
+	err := util.LoadGob(config.Attr("revokedfile"), &statements)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	revmutex.Lock()
+	_keyStatements = statements
+	revmutex.Unlock()
+	return nil
+}
@@ -0,0 +1,166 @@
+package node
+
+import (
+	"bytes"
+	"mobchat/encryption"
+	"mobchat/node/commands"
+	"mobchat/node/routing"
+	"testing"
+)
+
+func serializedStatement(t *testing.T, kind StatementKind, old encryption.Key, successor encryption.Key) []byte {
+	st, err := newKeyStatement(kind, old, successor, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := st.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestKeyStatement(t *testing.T) {
+	old := generateKey(t)
+	successor := generateKey(t)
+	other := generateKey(t)
+	rsaKey, err := encryption.Generate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a succession to other, signed by successor instead of other
+	forged, err := newKeyStatement(KeySuccession, old, successor, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.New = other.PublicKey()
+	forgedData, err := forged.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    func() []byte
+		decodes bool
+		valid   bool
+	}{
+		{"succession", func() []byte { return serializedStatement(t, KeySuccession, old, successor) }, true, true},
+		{"revocation", func() []byte { return serializedStatement(t, KeyRevocation, old, encryption.Key{}) }, true, true},
+		{"rsa revocation", func() []byte { return serializedStatement(t, KeyRevocation, rsaKey, encryption.Key{}) }, true, true},
+		{"rsa to ed25519", func() []byte { return serializedStatement(t, KeySuccession, rsaKey, successor) }, true, true},
+		{"successor didn't sign", func() []byte { return forgedData }, true, false},
+		{"succeeds itself", func() []byte { return serializedStatement(t, KeySuccession, old, old) }, true, false},
+		{"changed reason", func() []byte {
+			data := serializedStatement(t, KeyRevocation, old, encryption.Key{})
+			data[10] ^= 0x01
+			return data
+		}, true, false},
+		{"unknown kind", func() []byte {
+			data := serializedStatement(t, KeyRevocation, old, encryption.Key{})
+			data[0] = 0x7F
+			return data
+		}, false, false},
+		{"truncated", func() []byte {
+			data := serializedStatement(t, KeySuccession, old, successor)
+			return data[:len(data)-1]
+		}, false, false},
+		{"trailing byte", func() []byte {
+			return append(serializedStatement(t, KeyRevocation, old, encryption.Key{}), 0x00)
+		}, false, false},
+		{"too short", func() []byte { return []byte{byte(KeyRevocation), 0x00} }, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := DeserializeKeyStatement(tt.data())
+			if (err == nil) != tt.decodes {
+				t.Fatalf("decoding: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			err = st.Verify()
+			if (err == nil) != tt.valid {
+				t.Fatalf("verifying: %v", err)
+			}
+		})
+	}
+}
+
+type keyChange struct {
+	old       []byte
+	successor []byte
+}
+
+//TestKeyStatementOrder - statements about a key in different orders, for
+//a key in the routing table and one this node doesn't know
+func TestKeyStatementOrder(t *testing.T) {
+	const (
+		succession = "succession"
+		revocation = "revocation"
+	)
+	tests := []struct {
+		name      string
+		known     bool
+		order     []string
+		applied   []bool
+		changes   int
+		successor bool
+	}{
+		{"succession", true, []string{succession}, []bool{true}, 1, true},
+		{"revocation after succession", true, []string{succession, revocation}, []bool{true, true}, 2, false},
+		{"succession after revocation", true, []string{revocation, succession}, []bool{true, false}, 1, false},
+		{"repeated succession", true, []string{succession, succession}, []bool{true, false}, 1, true},
+		{"unknown succession", false, []string{succession}, []bool{true}, 0, true},
+		{"unknown revocation after succession", false, []string{succession, revocation}, []bool{true, true}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testNode(t)
+			old := generateKey(t)
+			successor := generateKey(t)
+			if tt.known {
+				n := routing.NewNode(old.PublicKey(), commands.NewAddress("127.0.0.1", "1"), nil)
+				routing.Table.AddNode(&n)
+			}
+			changes := make([]keyChange, 0)
+			AddKeyChangeHandler(func(old []byte, successor []byte) {
+				changes = append(changes, keyChange{old: old, successor: successor})
+			})
+			statements := map[string][]byte{
+				succession: serializedStatement(t, KeySuccession, old, successor),
+				revocation: serializedStatement(t, KeyRevocation, old, encryption.Key{}),
+			}
+
+			for i, kind := range tt.order {
+				st, err := DeserializeKeyStatement(statements[kind])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if applied := applyKeyStatement(st, statements[kind]); applied != tt.applied[i] {
+					t.Fatalf("%s applied %v", kind, applied)
+				}
+			}
+
+			if !IsRevoked(old.ID()) {
+				t.Fatal("old key not retired")
+			}
+			key, ok := Successor(old.ID())
+			if ok != tt.successor || (ok && !bytes.Equal(key.ID(), successor.ID())) {
+				t.Fatalf("successor %v", ok)
+			}
+			if len(changes) != tt.changes {
+				t.Fatalf("%d key changes", len(changes))
+			}
+			last := tt.order[len(tt.order)-1]
+			if tt.changes > 0 && last == revocation && tt.applied[len(tt.applied)-1] &&
+				changes[len(changes)-1].successor != nil {
+				t.Fatal("revocation reported a successor")
+			}
+			if tt.known && routing.Table.Get(old.ID()) != nil {
+				t.Fatal("retired key still routed")
+			}
+		})
+	}
+}
@@ -114,13 +114,17 @@ func DeserializeRoutes(data []byte) ([]Route, error) {
 		ln := int(data[idx])
 		idx++
 		route := Route{}
-		for idx < idx+144*ln {
-			node, err := DeserializeNode(data[idx : idx+144])
+		for i := 0; i < ln; i++ {
+			nodeLen, err := NodeLen(data[idx:])
+			if err != nil {
+				return nil, err
+			}
+			node, err := DeserializeNode(data[idx : idx+nodeLen])
 			if err != nil {
 				return nil, err
 			}
 			route.Path = append(route.Path, &node)
-			idx += 144
+			idx += nodeLen
 		}
 		routes = append(routes, route)
 	}
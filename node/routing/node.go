@@ -2,11 +2,11 @@ package routing
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"mobchat/encryption"
 	"mobchat/node/commands"
+	"time"
 )
 
 //Node -
@@ -14,15 +14,13 @@ type Node struct {
 	PubKey        encryption.Key
 	Address       commands.Address
 	Connections   map[string]*Node
-	RequestedPeer bool //attempted to connect as peer
+	RequestedPeer bool          //attempted to connect as peer
+	RTT           time.Duration //smoothed round trip time, 0 if never measured
 }
 
 //ID -
 func (node *Node) ID() []byte {
-	h := sha256.New()
-	id := node.PubKey.Public.N.Bytes()
-	h.Write(id)
-	return h.Sum(nil)
+	return node.PubKey.ID()
 }
 
 //IsServer - shows whether this noe can accept connections
@@ -36,7 +34,7 @@ func (node *Node) Serialize() []byte {
 	//buff.Write(node.ID)
 	pubKey, _ := node.PubKey.Serialize()
 	buff.Write(pubKey)
-	buff.Write(node.Address.Serialize()) //len 12
+	buff.Write(node.Address.Serialize()) //len commands.AddressLen
 
 	return buff.Bytes()
 
@@ -67,10 +65,8 @@ func (node *Node) RemoveConnection(n *Node) {
 //NewNode -
 func NewNode(pubKey encryption.Key, address commands.Address, connections []*Node) Node {
 	node := Node{
-		Address: address,
-		PubKey: encryption.Key{
-			Public: pubKey.Public,
-		},
+		Address:     address,
+		PubKey:      pubKey.PublicKey(),
 		Connections: make(map[string]*Node),
 	}
 	for _, n := range connections {
@@ -86,17 +82,34 @@ func (node *Node) IDString() string {
 	return string(dst)
 }
 
+//NodeLen - length of the serialized node at the start of data. It depends
+//on the algorithm of the node's key
+func NodeLen(data []byte) (int, error) {
+	keyLen, err := encryption.SerializedLen(data)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < keyLen+commands.AddressLen {
+		return 0, errors.New("Invalid data - node too short")
+	}
+	return keyLen + commands.AddressLen, nil
+}
+
 //DeserializeNode -
 func DeserializeNode(data []byte) (Node, error) {
-	//132
-	if len(data) != 144 {
-		return Node{}, errors.New("Invalid data - length needs to be 144 bytes")
+	ln, err := NodeLen(data)
+	if err != nil {
+		return Node{}, err
+	}
+	if len(data) != ln {
+		return Node{}, errors.New("Invalid data - wrong node length")
 	}
-	pubKey, err := encryption.Deserialize(data[0:132])
+	keyLen := ln - commands.AddressLen
+	pubKey, err := encryption.Deserialize(data[0:keyLen])
 	if err != nil {
 		return Node{}, err
 	}
-	address, err := commands.DeserializeAddress(data[132:])
+	address, err := commands.DeserializeAddress(data[keyLen:])
 	if err != nil {
 		return Node{}, err
 	}
@@ -5,9 +5,11 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"mobchat/node/commands"
+	"mobchat/util"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 //Table - global var for Routing Table
@@ -73,6 +75,77 @@ func (routing *Routing) FindNodeByAddress(addr commands.Address) *Node {
 	return nil
 }
 
+//Get - returns the node with the given ID or nil
+func (routing *Routing) Get(id []byte) *Node {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return routing.Nodes[util.ToHexString(id)]
+}
+
+//ServerNodes - returns the nodes that accept incoming connections, fastest
+//measured first
+func (routing *Routing) ServerNodes() []*Node {
+	mutex.Lock()
+	nodes := make([]*Node, 0, len(routing.Nodes))
+	rtts := make(map[*Node]time.Duration, len(routing.Nodes))
+	for _, node := range routing.Nodes {
+		if node.IsServer() {
+			nodes = append(nodes, node)
+			rtts[node] = node.RTT
+		}
+	}
+	mutex.Unlock()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := rtts[nodes[i]], rtts[nodes[j]]
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+	return nodes
+}
+
+//Closest - returns up to n server nodes whose IDs are closest to id by XOR
+//distance. Used to pick the nodes responsible for data keyed by an ID
+func (routing *Routing) Closest(id []byte, n int) []*Node {
+	nodes := routing.ServerNodes()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return bytes.Compare(xor(nodes[i].ID(), id), xor(nodes[j].ID(), id)) < 0
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+func xor(a, b []byte) []byte {
+	d := make([]byte, len(a))
+	for i := range a {
+		if i < len(b) {
+			d[i] = a[i] ^ b[i]
+		}
+	}
+	return d
+}
+
+//IsConnected - whether the routing table knows of any connection of the node
+func (routing *Routing) IsConnected(id []byte) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	node, exists := routing.Nodes[util.ToHexString(id)]
+	return exists && len(node.Connections) > 0
+}
+
+//SetRTT - records the measured round trip time to a directly connected node
+func (routing *Routing) SetRTT(id []byte, rtt time.Duration) {
+	mutex.Lock()
+	node, exists := routing.Nodes[util.ToHexString(id)]
+	if exists {
+		node.RTT = rtt
+	}
+	mutex.Unlock()
+}
+
 //RemoveNode -
 func (routing *Routing) RemoveNode(node *Node) {
 	mutex.Lock()
@@ -121,22 +194,25 @@ func DeserializeRouting(data []byte) (Routing, error) {
 	//get the routing length (number of nodes)
 	routingLen := binary.BigEndian.Uint32(data[0:4])
 	arNodes := make([]Node, routingLen)
+	idx := 4
 	for i := range arNodes {
-		idx := 4 + i*144
-		nodeData := data[idx : idx+144]
-		node, err := DeserializeNode(nodeData)
+		ln, err := NodeLen(data[idx:])
+		if err != nil {
+			return Routing{}, err
+		}
+		node, err := DeserializeNode(data[idx : idx+ln])
 		if err != nil {
 			return Routing{}, err
 		}
+		node.Connections = make(map[string]*Node)
 		arNodes[i] = node
+		idx += ln
 	}
 	//add indexing
 	cnt := uint32(0)
-	idx := routingLen*144 + 4
 	for cnt < routingLen {
 		ln := uint8(data[idx])
 		i := uint8(0)
-		arNodes[cnt].Connections = make(map[string]*Node)
 		idx++
 		for i < ln {
 			nodeIdx := binary.BigEndian.Uint32(data[idx : idx+4])
@@ -0,0 +1,179 @@
+package node
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/node/commands"
+	"strconv"
+	"sync"
+)
+
+//Priority - send lane of an outbound message. Lower values are written first
+type Priority int
+
+const (
+	//PriorityControl - handshake, keepalive and routing traffic
+	PriorityControl Priority = iota
+	//PriorityChat - user messages
+	PriorityChat
+	//PriorityBulk - large transfers that can wait
+	PriorityBulk
+
+	numPriorities
+)
+
+const (
+	//QueuePolicyDropOldest - discards the oldest queued message of the lane
+	QueuePolicyDropOldest = "dropoldest"
+	//QueuePolicyBlock - blocks the sender until there is room. Never push
+	//while holding the node mutex, or one slow peer stalls the whole node
+	QueuePolicyBlock = "block"
+	//QueuePolicyDisconnect - drops the connection to the slow peer
+	QueuePolicyDisconnect = "disconnect"
+)
+
+var (
+	errQueueFull   = errors.New("Send queue full")
+	errQueueClosed = errors.New("Send queue closed")
+)
+
+//sendQueue - bounded, prioritised outbound queue drained by a single writer
+type sendQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	lanes   [numPriorities][]Message
+	max     int
+	policy  string
+	closed  bool
+	dropped uint64
+}
+
+func newSendQueue() *sendQueue {
+	max, err := strconv.Atoi(config.Attr("sendqueuelen"))
+	if err != nil || max <= 0 {
+		max = 256
+	}
+	policy := config.Attr("sendqueuepolicy")
+	switch policy {
+	case QueuePolicyDropOldest, QueuePolicyBlock, QueuePolicyDisconnect:
+	default:
+		fmt.Println("Unknown sendqueuepolicy", policy, "- using", QueuePolicyDropOldest)
+		policy = QueuePolicyDropOldest
+	}
+	q := &sendQueue{
+		max:    max,
+		policy: policy,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *sendQueue) push(msg Message, prio Priority) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && len(q.lanes[prio]) >= q.max {
+		switch q.policy {
+		case QueuePolicyBlock:
+			q.cond.Wait()
+		case QueuePolicyDisconnect:
+			return errQueueFull
+		default:
+			q.lanes[prio] = q.lanes[prio][1:]
+			q.dropped++
+		}
+	}
+	if q.closed {
+		return errQueueClosed
+	}
+	q.lanes[prio] = append(q.lanes[prio], msg)
+	q.cond.Broadcast()
+	return nil
+}
+
+//pop - blocks until a message is available. Returns false once the queue
+//is closed and fully drained
+func (q *sendQueue) pop() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for prio := range q.lanes {
+			if len(q.lanes[prio]) > 0 {
+				msg := q.lanes[prio][0]
+				q.lanes[prio] = q.lanes[prio][1:]
+				q.cond.Broadcast()
+				return msg, true
+			}
+		}
+		if q.closed {
+			return Message{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cnt := 0
+	for prio := range q.lanes {
+		cnt += len(q.lanes[prio])
+	}
+	return cnt
+}
+
+func (q *sendQueue) droppedCount() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+//close - stops accepting messages. Queued messages are still written
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+//priorityOf - picks the lane for a message from its command code
+func priorityOf(msg Message) Priority {
+	if msg.Encrypted || len(msg.Body) < 2 {
+		return PriorityChat
+	}
+	switch msg.Body[1] {
+	case commands.CmdHandshake,
+		commands.CmdHandshakeResp,
+		commands.CmdCheckRouting,
+		commands.CmdCheckRoutingResp,
+		commands.CmdGetRouting,
+		commands.CmdGetRoutingResp,
+		commands.CmdGetRoute,
+		commands.CmdGetRouteResp,
+		commands.CmdPeerConnected,
+		commands.CmdPeerDisconnected,
+		commands.CmdPing,
+		commands.CmdPong:
+		return PriorityControl
+	}
+	return PriorityChat
+}
+
+//writer - the only goroutine writing to the socket
+func (con *Connection) writer() {
+	defer close(con.flushed)
+	for {
+		msg, ok := con.queue.pop()
+		if !ok {
+			return
+		}
+		encoder := gob.NewEncoder(con.c)
+		err := encoder.Encode(msg.Serialize())
+		if err != nil {
+			fmt.Println(err)
+			con.queue.close()
+			con.close()
+		}
+	}
+}
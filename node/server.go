@@ -7,7 +7,8 @@ import (
 	"net"
 )
 
-//Listen - starts listening to the given port for incoming connections
+//Listen - starts listening to the given port for incoming connections.
+//Blocks until the node is shut down
 func Listen(port string) error {
 	if !_initialized {
 		Initialize()
@@ -17,12 +18,23 @@ func Listen(port string) error {
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		fmt.Println(err)
+		return err
 	}
-	fmt.Println("Listening on", port)
+	return accept(ln)
+}
+
+func accept(ln net.Listener) error {
+	lifemutex.Lock()
+	_listener = ln
+	lifemutex.Unlock()
+	fmt.Println("Listening on", ln.Addr().String())
 	for {
 		// accept a connection
 		conn, err := ln.Accept()
 		if err != nil {
+			if stopping() {
+				return nil
+			}
 			fmt.Println(err)
 			continue
 		}
@@ -36,13 +48,15 @@ func handleConnection(conn net.Conn) {
 
 	// receive the message
 	fmt.Println(conn.RemoteAddr().String(), "connected")
-	c := Connection{
-		c:      conn,
-		addr:   conn.RemoteAddr(),
-		server: false,
+	if isBannedAddr(conn.RemoteAddr()) {
+		fmt.Println("Refusing banned address", conn.RemoteAddr().String())
+		conn.Close()
+		return
 	}
-	_connections.Add(&c)
+	c := newConnection(conn, false)
+	_connections.Add(c)
 	go c.startHandshakeTimeout()
+	go c.keepalive()
 	//c.sendMessage([]byte("hello"))
 	for {
 		decoder := gob.NewDecoder(conn)
@@ -50,16 +64,21 @@ func handleConnection(conn net.Conn) {
 		err := decoder.Decode(&m)
 		if err != nil {
 			if err == io.EOF {
-				_connections.Remove(c)
+				_connections.Remove(*c)
 			} else {
 				fmt.Println(err)
 				conn.Close()
-				_connections.Remove(c)
+				_connections.Remove(*c)
 			}
+			c.stop()
 			sendPeerDisconnected(c.id)
 			break
 		}
-		go HandleMessage(DeserializeMessage(m), &c)
+		if len(m) < 9 {
+			misbehaving(c, "malformed frame", scoreMalformed)
+			continue
+		}
+		go HandleMessage(DeserializeMessage(m), c)
 
 	}
 
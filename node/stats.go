@@ -0,0 +1,35 @@
+package node
+
+import (
+	"time"
+)
+
+//PeerInfo - snapshot of a single connection for admin tooling
+type PeerInfo struct {
+	ID       []byte
+	Address  string
+	Outgoing bool
+	IsPeer   bool
+	RTT      time.Duration
+	Queued   int
+	Dropped  uint64
+}
+
+//Peers - returns a snapshot of all current connections
+func Peers() []PeerInfo {
+	mutex.Lock()
+	defer mutex.Unlock()
+	peers := make([]PeerInfo, 0, len(_connections._lst))
+	for _, con := range _connections._lst {
+		peers = append(peers, PeerInfo{
+			ID:       con.id,
+			Address:  con.addr.String(),
+			Outgoing: con.server,
+			IsPeer:   con.isPeer,
+			RTT:      con.rtt,
+			Queued:   con.queue.len(),
+			Dropped:  con.queue.droppedCount(),
+		})
+	}
+	return peers
+}
@@ -0,0 +1,275 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Sessions with peers that are offline start from a prekey bundle the peer
+//published on its mailbox servers. The sender combines a fresh ephemeral
+//key with the signed prekey and, if one was left, a one time prekey, and
+//sends the first message right away. The signed prekey is rotated every
+//prekeyrotation, the previous one is kept for messages still in flight
+
+const (
+	prekeyInfo      = "mobchat prekey session"
+	publishInterval = time.Hour
+	prekeyHeaderLen = 1 + 4 + 1 + 4 + 32
+)
+
+//signedPrekey - own signed prekey
+type signedPrekey struct {
+	ID      uint32
+	Priv    []byte
+	Created time.Time
+}
+
+var (
+	_lastPublish time.Time
+	pubmutex     = sync.Mutex{}
+)
+
+func newPrekeyID() uint32 {
+	_store.NextPrekey++
+	return _store.NextPrekey
+}
+
+//PublishPrekeys - rotates the signed prekey if it is due and uploads it
+//with a new batch of one time prekeys
+func PublishPrekeys(ctx context.Context) error {
+	smutex.Lock()
+	if _store.Signed == nil || time.Since(_store.Signed.Created) > config.AttrDuration("prekeyrotation", 7*24*time.Hour) {
+		priv, _, err := encryption.GenerateX25519()
+		if err != nil {
+			smutex.Unlock()
+			return err
+		}
+		_store.PrevSigned = _store.Signed
+		_store.Signed = &signedPrekey{
+			ID:      newPrekeyID(),
+			Priv:    priv,
+			Created: time.Now(),
+		}
+	}
+	signedPub, err := encryption.X25519Public(_store.Signed.Priv)
+	if err != nil {
+		smutex.Unlock()
+		return err
+	}
+	signed := node.Prekey{ID: _store.Signed.ID, Public: signedPub}
+	batch := config.AttrInt("prekeybatch", 20)
+	oneTime := make([]node.Prekey, 0, batch)
+	for i := 0; i < batch; i++ {
+		priv, pub, err := encryption.GenerateX25519()
+		if err != nil {
+			smutex.Unlock()
+			return err
+		}
+		id := newPrekeyID()
+		_store.OneTime[id] = priv
+		oneTime = append(oneTime, node.Prekey{ID: id, Public: pub})
+	}
+	trimOneTime()
+	smutex.Unlock()
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return node.PublishPrekeys(ctx, signed, oneTime)
+}
+
+//trimOneTime - servers keep the newest node.MaxOneTimePrekeys of their
+//share, so older ones can't be handed out anymore. Caller holds smutex
+func trimOneTime() {
+	max := node.OneTimePrekeyLimit()
+	if len(_store.OneTime) <= max {
+		return
+	}
+	ids := make([]uint32, 0, len(_store.OneTime))
+	for id := range _store.OneTime {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids[:len(ids)-max] {
+		delete(_store.OneTime, id)
+	}
+}
+
+//publishIfDue - runs after each routing sync, at most once per publishInterval
+func publishIfDue() {
+	pubmutex.Lock()
+	defer pubmutex.Unlock()
+	if time.Since(_lastPublish) < publishInterval {
+		return
+	}
+	err := PublishPrekeys(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	_lastPublish = time.Now()
+}
+
+//startWithPrekeys - sets up a session from the peer's prekey bundle and
+//sends the first queued message with it
+func startWithPrekeys(ctx context.Context, peer []byte, queue [][]byte) error {
+	bundle, err := node.FetchPrekeys(ctx, peer)
+	if err != nil {
+		return err
+	}
+	priv, pub, err := encryption.GenerateX25519()
+	if err != nil {
+		return err
+	}
+	dhs := make([][]byte, 0, 2)
+	dh, err := encryption.X25519(priv, bundle.SignedPrekey.Public)
+	if err != nil {
+		return err
+	}
+	dhs = append(dhs, dh)
+	var header bytes.Buffer
+	header.WriteByte(commands.PayloadSessionPrekey)
+	ids := make([]byte, 4)
+	binary.BigEndian.PutUint32(ids, bundle.SignedPrekey.ID)
+	header.Write(ids)
+	if bundle.OneTimePrekey != nil {
+		dh, err = encryption.X25519(priv, bundle.OneTimePrekey.Public)
+		if err != nil {
+			return err
+		}
+		dhs = append(dhs, dh)
+		header.WriteByte(0x01)
+		binary.BigEndian.PutUint32(ids, bundle.OneTimePrekey.ID)
+	} else {
+		header.WriteByte(0x00)
+		binary.BigEndian.PutUint32(ids, 0)
+	}
+	header.Write(ids)
+	header.Write(pub)
+	secret, err := encryption.DeriveSecret(prekeyInfo, dhs...)
+	if err != nil {
+		return err
+	}
+	ratchet, err := encryption.NewRatchetInitiator(secret, bundle.SignedPrekey.Public)
+	if err != nil {
+		return err
+	}
+	first, err := ratchet.Encrypt(queue[0], ad(node.ID(), peer))
+	if err != nil {
+		return err
+	}
+	header.Write(first)
+	key := util.ToHexString(peer)
+	smutex.Lock()
+	_store.Sessions[key] = ratchet
+	_store.Started[key] = queue[0]
+	smutex.Unlock()
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	_, err = node.SendDirect(ctx, peer, header.Bytes())
+	if err != nil {
+		return err
+	}
+	flush(peer, queue[1:])
+	return nil
+}
+
+//prekeyPriv - private key for a signed prekey ID. Caller holds smutex
+func prekeyPriv(id uint32) []byte {
+	if _store.Signed != nil && _store.Signed.ID == id {
+		return _store.Signed.Priv
+	}
+	if _store.PrevSigned != nil && _store.PrevSigned.ID == id {
+		return _store.PrevSigned.Priv
+	}
+	return nil
+}
+
+func handlePrekey(env node.Envelope) error {
+	if len(env.Payload) < prekeyHeaderLen+encryption.RatchetHeaderLen {
+		return errors.New("Malformed prekey session start")
+	}
+	peer := env.Sender
+	key := util.ToHexString(peer)
+	signedID := binary.BigEndian.Uint32(env.Payload[1:5])
+	hasOneTime := env.Payload[5] == 0x01
+	oneTimeID := binary.BigEndian.Uint32(env.Payload[6:10])
+	remoteEph := env.Payload[10:42]
+
+	smutex.Lock()
+	first, started := _store.Started[key]
+	//both sides started at once - the lower node ID wins
+	if started && bytes.Compare(node.ID(), peer) < 0 {
+		smutex.Unlock()
+		return nil
+	}
+	signedPriv := prekeyPriv(signedID)
+	oneTimePriv, exists := _store.OneTime[oneTimeID]
+	smutex.Unlock()
+	if signedPriv == nil {
+		return errors.New("Unknown signed prekey")
+	}
+	if hasOneTime && !exists {
+		return errors.New("Unknown or used one time prekey")
+	}
+
+	dhs := make([][]byte, 0, 2)
+	dh, err := encryption.X25519(signedPriv, remoteEph)
+	if err != nil {
+		return err
+	}
+	dhs = append(dhs, dh)
+	if hasOneTime {
+		dh, err = encryption.X25519(oneTimePriv, remoteEph)
+		if err != nil {
+			return err
+		}
+		dhs = append(dhs, dh)
+	}
+	secret, err := encryption.DeriveSecret(prekeyInfo, dhs...)
+	if err != nil {
+		return err
+	}
+	ratchet := encryption.NewRatchetResponder(secret, signedPriv)
+	body, err := ratchet.Decrypt(env.Payload[prekeyHeaderLen:], ad(peer, node.ID()))
+	if err != nil {
+		return err
+	}
+	smutex.Lock()
+	if hasOneTime {
+		delete(_store.OneTime, oneTimeID)
+	}
+	_store.Sessions[key] = ratchet
+	delete(_store.Started, key)
+	delete(_store.Inits, key)
+	handlers := _handlers
+	smutex.Unlock()
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	deliver(handlers, Message{
+		ID:        env.ID,
+		Peer:      peer,
+		Timestamp: env.Timestamp,
+		Body:      body,
+	})
+	if started {
+		//our own first message went into a session the peer dropped
+		flush(peer, [][]byte{first})
+	}
+	return nil
+}
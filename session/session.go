@@ -0,0 +1,400 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+)
+
+//Forward secret one to one sessions on top of node.SendDirect. The
+//initiator sends an ephemeral X25519 key, the other side answers with its
+//own ephemeral key and a first Double Ratchet message. From then on every
+//message uses a fresh key from the ratchet. Messages sent before the
+//session is up are queued and flushed once it is
+
+const secretInfo = "mobchat session"
+
+//Message - a decrypted session message
+type Message struct {
+	ID        []byte
+	Peer      []byte
+	Timestamp uint64
+	Body      []byte
+}
+
+//pendingInit - a session we asked for that wasn't accepted yet
+type pendingInit struct {
+	EphPriv []byte
+	EphPub  []byte
+	Queue   [][]byte
+}
+
+//store - everything that is persisted
+type store struct {
+	Sessions   map[string]*encryption.Ratchet
+	Inits      map[string]*pendingInit
+	Started    map[string][]byte //first message of sessions started from a prekey bundle, until the peer answers
+	Signed     *signedPrekey
+	PrevSigned *signedPrekey
+	OneTime    map[uint32][]byte
+	NextPrekey uint32
+}
+
+var (
+	_store = store{
+		Sessions: make(map[string]*encryption.Ratchet),
+		Inits:    make(map[string]*pendingInit),
+		Started:  make(map[string][]byte),
+		OneTime:  make(map[uint32][]byte),
+	}
+	_handlers []func(Message)
+	smutex    = sync.Mutex{}
+)
+
+type handler struct{}
+
+//Handle - routes session payloads
+func (h handler) Handle(env node.Envelope) {
+	if len(env.Payload) == 0 {
+		return
+	}
+	var err error
+	switch env.Payload[0] {
+	case commands.PayloadSessionInit:
+		err = handleInit(env)
+	case commands.PayloadSessionAccept:
+		err = handleAccept(env)
+	case commands.PayloadSessionMessage:
+		err = handleMessage(env)
+	case commands.PayloadSessionPrekey:
+		err = handlePrekey(env)
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Println("session", util.ToHexString(env.Sender), err)
+	}
+}
+
+//Initialize - loads stored sessions and starts handling session messages.
+//Call after node.Initialize
+func Initialize() error {
+	err := load()
+	if err != nil {
+		return err
+	}
+	node.AddMessageHandler(handler{})
+	node.AddShutdownHook(save)
+	node.AddSyncHook(publishIfDue)
+	node.AddKeyChangeHandler(func(old []byte, successor []byte) {
+		//the retired key might be in the hands of someone else
+		err := Reset(old)
+		if err != nil {
+			fmt.Println(err)
+		}
+	})
+	return nil
+}
+
+//AddHandler - registers a callback for incoming session messages
+func AddHandler(handler func(Message)) {
+	smutex.Lock()
+	_handlers = append(_handlers, handler)
+	smutex.Unlock()
+}
+
+//Has - whether an established session with the peer exists
+func Has(peer []byte) bool {
+	smutex.Lock()
+	defer smutex.Unlock()
+	_, exists := _store.Sessions[util.ToHexString(peer)]
+	return exists
+}
+
+//Reset - forgets the session with the peer. The next Send starts a new one
+func Reset(peer []byte) error {
+	smutex.Lock()
+	delete(_store.Sessions, util.ToHexString(peer))
+	delete(_store.Inits, util.ToHexString(peer))
+	delete(_store.Started, util.ToHexString(peer))
+	smutex.Unlock()
+	return save()
+}
+
+//ad - binds ratchet messages to sender and recipient
+func ad(sender []byte, recipient []byte) []byte {
+	return append(append([]byte(nil), sender...), recipient...)
+}
+
+//Send - encrypts body with the session ratchet and sends it to the peer.
+//Starts a session first if there is none, from the peer's prekey bundle if
+//one can be fetched, otherwise interactively
+func Send(ctx context.Context, peer []byte, body []byte) error {
+	key := util.ToHexString(peer)
+	smutex.Lock()
+	ratchet, exists := _store.Sessions[key]
+	if !exists {
+		init, pending := _store.Inits[key]
+		if pending {
+			init.Queue = append(init.Queue, body)
+			smutex.Unlock()
+			return save()
+		}
+		smutex.Unlock()
+		return startSession(ctx, peer, [][]byte{body})
+	}
+	payload, err := seal(ratchet, peer, body)
+	smutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	_, err = node.SendDirect(ctx, peer, payload)
+	return err
+}
+
+//seal - caller holds smutex
+func seal(ratchet *encryption.Ratchet, peer []byte, body []byte) ([]byte, error) {
+	ct, err := ratchet.Encrypt(body, ad(node.ID(), peer))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{commands.PayloadSessionMessage}, ct...), nil
+}
+
+func startSession(ctx context.Context, peer []byte, queue [][]byte) error {
+	err := startWithPrekeys(ctx, peer, queue)
+	if err == nil {
+		return nil
+	}
+	fmt.Println(err)
+	priv, pub, err := encryption.GenerateX25519()
+	if err != nil {
+		return err
+	}
+	smutex.Lock()
+	_store.Inits[util.ToHexString(peer)] = &pendingInit{
+		EphPriv: priv,
+		EphPub:  pub,
+		Queue:   queue,
+	}
+	smutex.Unlock()
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	_, err = node.SendDirect(ctx, peer, append([]byte{commands.PayloadSessionInit}, pub...))
+	return err
+}
+
+//flush - sends queued messages over the now established session
+func flush(peer []byte, queue [][]byte) {
+	for _, body := range queue {
+		err := Send(context.Background(), peer, body)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func handleInit(env node.Envelope) error {
+	if len(env.Payload) != 1+32 {
+		return errors.New("Malformed session init")
+	}
+	peer := env.Sender
+	key := util.ToHexString(peer)
+	remoteEph := env.Payload[1:33]
+	smutex.Lock()
+	var queue [][]byte
+	if init, pending := _store.Inits[key]; pending {
+		//both sides started at once - the lower node ID wins
+		if bytes.Compare(node.ID(), peer) < 0 {
+			smutex.Unlock()
+			return nil
+		}
+		queue = init.Queue
+		delete(_store.Inits, key)
+	}
+	smutex.Unlock()
+
+	priv, pub, err := encryption.GenerateX25519()
+	if err != nil {
+		return err
+	}
+	dh, err := encryption.X25519(priv, remoteEph)
+	if err != nil {
+		return err
+	}
+	secret, err := encryption.DeriveSecret(secretInfo, dh)
+	if err != nil {
+		return err
+	}
+	ratchet, err := encryption.NewRatchetInitiator(secret, remoteEph)
+	if err != nil {
+		return err
+	}
+	first, err := ratchet.Encrypt(nil, ad(node.ID(), peer))
+	if err != nil {
+		return err
+	}
+	smutex.Lock()
+	_store.Sessions[key] = ratchet
+	smutex.Unlock()
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(commands.PayloadSessionAccept)
+	buff.Write(remoteEph)
+	buff.Write(pub)
+	buff.Write(first)
+	_, err = node.SendDirect(context.Background(), peer, buff.Bytes())
+	if err != nil {
+		return err
+	}
+	flush(peer, queue)
+	return nil
+}
+
+func handleAccept(env node.Envelope) error {
+	if len(env.Payload) < 1+32+32+encryption.RatchetHeaderLen {
+		return errors.New("Malformed session accept")
+	}
+	peer := env.Sender
+	key := util.ToHexString(peer)
+	smutex.Lock()
+	init, pending := _store.Inits[key]
+	if !pending || !bytes.Equal(init.EphPub, env.Payload[1:33]) {
+		smutex.Unlock()
+		return errors.New("Unexpected session accept")
+	}
+	smutex.Unlock()
+	dh, err := encryption.X25519(init.EphPriv, env.Payload[33:65])
+	if err != nil {
+		return err
+	}
+	secret, err := encryption.DeriveSecret(secretInfo, dh)
+	if err != nil {
+		return err
+	}
+	ratchet := encryption.NewRatchetResponder(secret, init.EphPriv)
+	_, err = ratchet.Decrypt(env.Payload[65:], ad(peer, node.ID()))
+	if err != nil {
+		return err
+	}
+	smutex.Lock()
+	_store.Sessions[key] = ratchet
+	delete(_store.Inits, key)
+	smutex.Unlock()
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	flush(peer, init.Queue)
+	return nil
+}
+
+func handleMessage(env node.Envelope) error {
+	key := util.ToHexString(env.Sender)
+	smutex.Lock()
+	ratchet, exists := _store.Sessions[key]
+	if !exists {
+		smutex.Unlock()
+		return errors.New("No session")
+	}
+	body, err := ratchet.Decrypt(env.Payload[1:], ad(env.Sender, node.ID()))
+	if err == nil {
+		delete(_store.Started, key)
+	}
+	handlers := _handlers
+	smutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = save()
+	if err != nil {
+		fmt.Println(err)
+	}
+	msg := Message{
+		ID:        env.ID,
+		Peer:      env.Sender,
+		Timestamp: env.Timestamp,
+		Body:      body,
+	}
+	deliver(handlers, msg)
+	return nil
+}
+
+func deliver(handlers []func(Message), msg Message) {
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+//save - the store holds ratchet and prekey secrets, so it is sealed with
+//the keystore passphrase before it goes to disk
+func save() error {
+	var buff bytes.Buffer
+	smutex.Lock()
+	err := gob.NewEncoder(&buff).Encode(_store)
+	smutex.Unlock()
+	if err != nil {
+		return err
+	}
+	sealed, err := node.SealState(buff.Bytes())
+	if err != nil {
+		return err
+	}
+	return util.SaveGob(config.Attr("sessionfile"), sealed)
+}
+
+func load() error {
+	s := store{}
+	sealed := make([]byte, 0)
+	err := util.LoadGob(config.Attr("sessionfile"), &sealed)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := node.OpenState(sealed)
+	if err != nil {
+		return err
+	}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&s)
+	if err != nil {
+		return err
+	}
+	smutex.Lock()
+	if s.Sessions != nil {
+		_store.Sessions = s.Sessions
+	}
+	if s.Inits != nil {
+		_store.Inits = s.Inits
+	}
+	if s.Started != nil {
+		_store.Started = s.Started
+	}
+	if s.OneTime != nil {
+		_store.OneTime = s.OneTime
+	}
+	_store.Signed = s.Signed
+	_store.PrevSigned = s.PrevSigned
+	_store.NextPrekey = s.NextPrekey
+	smutex.Unlock()
+	return nil
+}
@@ -0,0 +1,470 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/session"
+	"mobchat/util"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A contact card is a record signed by the user's root key or a persona key
+//with a display name, the addresses of servers the owner can be reached
+//through and optionally a one time invite token. The record sequence number
+//is the card version. Cards are passed around as mobchat: links or as
+//uppercase base32 text, which fits the alphanumeric mode of QR codes.
+//Whoever imports a card with a token answers with their own card, and the
+//issuer adds them as contact if the token is still valid. Persona cards
+//only list the servers of the persona's drop box, never the device
+
+const (
+	cardFormat   = 1
+	inviteLen    = 16
+	cardURI      = "mobchat:card/"
+	cardQRPrefix = "MOBCHAT:CARD/"
+)
+
+var _qrEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//Card -
+type Card struct {
+	Record    node.Record
+	Name      string
+	Addresses []commands.Address
+	Token     []byte //nil unless the card is an invite
+}
+
+//InviteAccepted - someone used an invite of this user or a persona
+type InviteAccepted struct {
+	Issuer  []byte //user or persona ID that issued the invite
+	Contact []byte //ID of the new contact
+	Name    string
+}
+
+type invite struct {
+	Issuer  []byte
+	Created time.Time
+}
+
+var (
+	_invites        = make(map[string]invite)
+	_inviteHandlers []func(InviteAccepted)
+	imutex          = sync.Mutex{}
+)
+
+//ID - the ID of the key that signed the card
+func (card *Card) ID() []byte {
+	return card.Record.Owner()
+}
+
+//Serialize - the signed record
+func (card *Card) Serialize() ([]byte, error) {
+	return card.Record.Serialize()
+}
+
+//URI - the card as mobchat: link
+func (card *Card) URI() (string, error) {
+	data, err := card.Serialize()
+	if err != nil {
+		return "", err
+	}
+	return cardURI + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+//QR - the card as text for the alphanumeric mode of QR codes
+func (card *Card) QR() (string, error) {
+	data, err := card.Serialize()
+	if err != nil {
+		return "", err
+	}
+	return cardQRPrefix + _qrEncoding.EncodeToString(data), nil
+}
+
+//cardData - format, name length, name, address count, addresses, token
+//length, token
+func cardData(name string, addresses []commands.Address, token []byte) ([]byte, error) {
+	if len(name) > maxProfileName || len(addresses) > 255 {
+		return nil, errors.New("Card too large")
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(cardFormat)
+	buff.WriteByte(byte(len(name)))
+	buff.WriteString(name)
+	buff.WriteByte(byte(len(addresses)))
+	for _, address := range addresses {
+		buff.Write(address.Serialize())
+	}
+	buff.WriteByte(byte(len(token)))
+	buff.Write(token)
+	return buff.Bytes(), nil
+}
+
+func newCard(key encryption.Key, name string, withInvite bool) (Card, error) {
+	card := Card{
+		Name:      name,
+		Addresses: node.MailboxAddresses(key.ID()),
+	}
+	if withInvite {
+		card.Token = make([]byte, inviteLen)
+		_, err := rand.Read(card.Token)
+		if err != nil {
+			return Card{}, err
+		}
+	}
+	data, err := cardData(card.Name, card.Addresses, card.Token)
+	if err != nil {
+		return Card{}, err
+	}
+	card.Record, err = node.NewRecord(commands.RecordCard, uint64(time.Now().Unix()), key, data)
+	if err != nil {
+		return Card{}, err
+	}
+	if withInvite {
+		imutex.Lock()
+		_invites[util.ToHexString(card.Token)] = invite{Issuer: key.ID(), Created: time.Now()}
+		imutex.Unlock()
+		err = saveInvites()
+		if err != nil {
+			return Card{}, err
+		}
+	}
+	return card, nil
+}
+
+//MyCard - a card of this user with the profile name. Needs the root key.
+//With invite the card carries a one time token
+func MyCard(invite bool) (Card, error) {
+	if !IsRoot() {
+		return Card{}, errors.New("Only the root device can sign cards")
+	}
+	umutex.Lock()
+	key := _me.Key
+	umutex.Unlock()
+	name := ""
+	if p, exists := GetProfile(key.ID()); exists {
+		name = p.Name
+	}
+	return newCard(key, name, invite)
+}
+
+//PersonaCard - a card of the persona
+func PersonaCard(id []byte, invite bool) (Card, error) {
+	key, err := personaKey(id)
+	if err != nil {
+		return Card{}, err
+	}
+	persona, _ := GetPersona(id)
+	return newCard(key, persona.Name, invite)
+}
+
+//DecodeCard - reads and verifies a serialized card
+func DecodeCard(data []byte) (Card, error) {
+	rec, err := node.DeserializeRecord(data)
+	if err == nil {
+		err = rec.Verify()
+	}
+	if err != nil {
+		return Card{}, err
+	}
+	if rec.Kind != commands.RecordCard {
+		return Card{}, errors.New("Not a contact card")
+	}
+	d := rec.Data
+	if len(d) < 2 || d[0] != cardFormat || len(d) < 2+int(d[1])+1 {
+		return Card{}, errors.New("Invalid contact card")
+	}
+	card := Card{Record: rec, Name: string(d[2 : 2+int(d[1])])}
+	idx := 2 + int(d[1])
+	cnt := int(d[idx])
+	idx++
+	if len(d) < idx+cnt*commands.AddressLen+1 {
+		return Card{}, errors.New("Invalid contact card")
+	}
+	for i := 0; i < cnt; i++ {
+		address, err := commands.DeserializeAddress(d[idx : idx+commands.AddressLen])
+		if err != nil {
+			return Card{}, err
+		}
+		card.Addresses = append(card.Addresses, address)
+		idx += commands.AddressLen
+	}
+	ln := int(d[idx])
+	idx++
+	if len(d) != idx+ln || (ln != 0 && ln != inviteLen) {
+		return Card{}, errors.New("Invalid contact card")
+	}
+	if ln > 0 {
+		card.Token = d[idx : idx+ln]
+	}
+	return card, nil
+}
+
+//ParseCard - reads a card from a link or QR code text
+func ParseCard(text string) (Card, error) {
+	text = strings.TrimSpace(text)
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(text, cardURI):
+		data, err = base64.RawURLEncoding.DecodeString(text[len(cardURI):])
+	case strings.HasPrefix(strings.ToUpper(text), cardQRPrefix):
+		data, err = _qrEncoding.DecodeString(strings.ToUpper(text[len(cardQRPrefix):]))
+	default:
+		return Card{}, errors.New("Not a contact card")
+	}
+	if err != nil {
+		return Card{}, err
+	}
+	return DecodeCard(data)
+}
+
+//ImportOptions - what to do besides adding the contact
+type ImportOptions struct {
+	Connect bool //dial the addresses on the card
+	Session bool //send the invite answer through a session, starting one
+}
+
+func connectTo(addresses []commands.Address) {
+	for _, address := range addresses {
+		if address.IP == "0.0.0.0" {
+			continue
+		}
+		node.Dial(address.IP, address.Port)
+	}
+}
+
+//ImportCard - adds the owner of a user card as contact, named after the
+//card unless name is set. Answers the invite if the card has a token
+func ImportCard(ctx context.Context, card Card, name string, opts ImportOptions) (Contact, error) {
+	if name == "" {
+		name = card.Name
+	}
+	contact, err := ImportSigned(card.Record, name)
+	if err != nil {
+		return Contact{}, err
+	}
+	if opts.Connect {
+		connectTo(card.Addresses)
+	}
+	if card.Token == nil {
+		return contact, nil
+	}
+	payload := append([]byte{commands.PayloadInvite}, card.Token...)
+	//a device without the root key answers without a card, the issuer
+	//looks up its user instead
+	if own, err := MyCard(false); err == nil {
+		data, err := own.Serialize()
+		if err != nil {
+			return contact, err
+		}
+		payload = append(payload, data...)
+	}
+	if !opts.Session {
+		_, err = Send(ctx, contact.ID, payload)
+		return contact, err
+	}
+	devices, err := Devices(ctx, contact.ID)
+	if err != nil {
+		return contact, err
+	}
+	devices = reachable(devices)
+	if len(devices) == 0 {
+		return contact, errors.New("No reachable device of " + util.ToHexString(contact.ID))
+	}
+	for _, device := range devices {
+		err = session.Send(ctx, device, payload)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	return contact, nil
+}
+
+//ImportPersonaCard - adds the owner of a persona card as contact of the
+//persona id and answers the invite from that persona
+func ImportPersonaCard(ctx context.Context, id []byte, card Card, name string, opts ImportOptions) (PersonaContact, error) {
+	if name == "" {
+		name = card.Name
+	}
+	key, err := card.Record.Key.Serialize()
+	if err != nil {
+		return PersonaContact{}, err
+	}
+	contact, err := AddPersonaContact(id, key, name)
+	if err != nil {
+		return PersonaContact{}, err
+	}
+	if opts.Connect {
+		connectTo(card.Addresses)
+	}
+	if card.Token == nil {
+		return contact, nil
+	}
+	own, err := PersonaCard(id, false)
+	if err != nil {
+		return contact, err
+	}
+	data, err := own.Serialize()
+	if err != nil {
+		return contact, err
+	}
+	payload := append(append([]byte{commands.PayloadInvite}, card.Token...), data...)
+	return contact, sendPersona(ctx, id, [][]byte{key}, nil, payload)
+}
+
+//AddInviteHandler - registers a callback for used invites
+func AddInviteHandler(handler func(InviteAccepted)) {
+	imutex.Lock()
+	_inviteHandlers = append(_inviteHandlers, handler)
+	imutex.Unlock()
+}
+
+//checkInvite - the issuer of a valid token. Expired tokens are dropped
+func checkInvite(token []byte) ([]byte, bool) {
+	key := util.ToHexString(token)
+	imutex.Lock()
+	inv, exists := _invites[key]
+	imutex.Unlock()
+	if !exists {
+		return nil, false
+	}
+	if time.Since(inv.Created) >= config.AttrDuration("invitettl", 7*24*time.Hour) {
+		consumeInvite(token)
+		return nil, false
+	}
+	return inv.Issuer, true
+}
+
+//consumeInvite - makes sure a token can't be used again
+func consumeInvite(token []byte) {
+	imutex.Lock()
+	delete(_invites, util.ToHexString(token))
+	imutex.Unlock()
+	err := saveInvites()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//handleInvite - an invite answer from sender, a node or a persona. The
+//invite is only used up once the answer was handled
+func handleInvite(ctx context.Context, sender []byte, data []byte) error {
+	if len(data) < inviteLen {
+		return errors.New("Malformed invite answer")
+	}
+	var card *Card
+	if len(data) > inviteLen {
+		c, err := DecodeCard(data[inviteLen:])
+		if err != nil {
+			return err
+		}
+		card = &c
+	}
+	issuer, valid := checkInvite(data[:inviteLen])
+	if !valid {
+		return errors.New("Unknown or expired invite")
+	}
+	accepted := InviteAccepted{Issuer: issuer}
+	umutex.Lock()
+	own := _me.Key.HasPublic() && bytes.Equal(issuer, _me.ID())
+	umutex.Unlock()
+	switch {
+	case own && card != nil:
+		if !bytes.Equal(card.ID(), sender) {
+			devices, err := Devices(ctx, card.ID())
+			if err != nil || !contains(devices, sender) {
+				return errors.New("Card of an invite answer isn't the sender's")
+			}
+		}
+		contact, err := ImportSigned(card.Record, card.Name)
+		if err != nil {
+			return err
+		}
+		accepted.Contact, accepted.Name = contact.ID, contact.Name
+	case own:
+		id := sender
+		if owner, ok := UserOf(sender); ok {
+			id = owner
+		}
+		contact, err := AddContact(ctx, id, "")
+		if err != nil {
+			return err
+		}
+		accepted.Contact = contact.ID
+	case card != nil && bytes.Equal(card.ID(), sender):
+		key, err := card.Record.Key.Serialize()
+		if err != nil {
+			return err
+		}
+		contact, err := AddPersonaContact(issuer, key, card.Name)
+		if err != nil {
+			return err
+		}
+		accepted.Contact, accepted.Name = contact.ID, contact.Name
+	default:
+		return errors.New("Invite answer without a matching card")
+	}
+	consumeInvite(data[:inviteLen])
+	imutex.Lock()
+	handlers := _inviteHandlers
+	imutex.Unlock()
+	for _, handler := range handlers {
+		handler(accepted)
+	}
+	return nil
+}
+
+//handlePersonaInvite - a persona handler for invite answers
+func handlePersonaInvite(msg PersonaMessage) {
+	if len(msg.Payload) == 0 || msg.Payload[0] != commands.PayloadInvite {
+		return
+	}
+	err := handleInvite(context.Background(), msg.Sender, msg.Payload[1:])
+	if err != nil {
+		fmt.Println("invite", util.ToHexString(msg.Sender), err)
+	}
+}
+
+//handleSessionInvite - a session handler for invite answers
+func handleSessionInvite(msg session.Message) {
+	if len(msg.Body) == 0 || msg.Body[0] != commands.PayloadInvite || IsBlocked(msg.Peer) {
+		return
+	}
+	err := handleInvite(context.Background(), msg.Peer, msg.Body[1:])
+	if err != nil {
+		fmt.Println("invite", util.ToHexString(msg.Peer), err)
+	}
+}
+
+func saveInvites() error {
+	imutex.Lock()
+	defer imutex.Unlock()
+	return util.SaveGob(config.Attr("invitefile"), _invites)
+}
+
+func loadInvites() error {
+	invites := make(map[string]invite)
+	err := util.LoadGob(config.Attr("invitefile"), &invites)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	imutex.Lock()
+	_invites = invites
+	imutex.Unlock()
+	return nil
+}
@@ -0,0 +1,546 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//Contacts remember the key of each person when they were added. Verifying a
+//contact means comparing the safety number with them out of band, so a man
+//in the middle would show up as a different number. When a contact's key is
+//retired the contact is moved to the successor, if there is one, and loses
+//its verified flag. Handlers get a warning for verified contacts. If the old
+//key is revoked after the succession, the successor may be a thief's key, so
+//the contact is moved back to the old ID and handlers are always warned.
+//A contact can be a user, a single node or a persona. Blocked contacts are
+//dropped by the node before their direct messages are opened, and so are
+//the devices of a blocked user
+
+//TrustLevel - how much the local user trusts a contact
+type TrustLevel int8
+
+const (
+	//TrustBlocked - messages are dropped
+	TrustBlocked TrustLevel = -1
+	//TrustUnknown - the default
+	TrustUnknown TrustLevel = 0
+	//TrustKnown - known personally
+	TrustKnown TrustLevel = 1
+	//TrustTrusted - trusted, e.g. to introduce others
+	TrustTrusted TrustLevel = 2
+)
+
+func (level TrustLevel) String() string {
+	switch level {
+	case TrustBlocked:
+		return "blocked"
+	case TrustUnknown:
+		return "unknown"
+	case TrustKnown:
+		return "known"
+	case TrustTrusted:
+		return "trusted"
+	}
+	return "invalid"
+}
+
+//Contact -
+type Contact struct {
+	ID         []byte
+	Name       string //petname given by the local user
+	Key        []byte //serialized public key, nil for blocked strangers
+	Added      time.Time
+	Updated    time.Time
+	Verified   bool
+	VerifiedAt time.Time
+	Trust      TrustLevel
+	Devices    [][]byte //preferred devices of a user contact
+	Personas   [][]byte //personas the contact uses with this user
+	Notes      string
+	Previous   []byte //ID the contact was moved from by a succession
+	PrevKey    []byte //key of Previous
+}
+
+//KeyWarning - a verified contact's key was retired, or the succession a
+//contact was moved to was revoked
+type KeyWarning struct {
+	Contact   Contact
+	Successor []byte //nil if the key was revoked
+	Undone    []byte //successor the contact was moved back from
+}
+
+var (
+	_contacts        = make(map[string]*Contact)
+	_warningHandlers []func(KeyWarning)
+	cmutex           = sync.Mutex{}
+)
+
+//PublicKey - the contact's key
+func (contact *Contact) PublicKey() (encryption.Key, error) {
+	return encryption.Deserialize(contact.Key)
+}
+
+//keyFor - the key of a node, or of a user from its device list
+func keyFor(ctx context.Context, id []byte) (encryption.Key, error) {
+	key, err := node.KeyOf(id)
+	if err == nil {
+		return key, nil
+	}
+	rec, err := node.FetchRecord(ctx, id, commands.RecordDevices)
+	if err != nil {
+		return encryption.Key{}, errors.New("No key known for " + util.ToHexString(id))
+	}
+	return rec.Key, nil
+}
+
+//addContact - adds a contact with key, or renames the existing one. A
+//different key than the one on record is refused
+func addContact(key encryption.Key, name string) (Contact, error) {
+	serialized, err := key.Serialize()
+	if err != nil {
+		return Contact{}, err
+	}
+	id := key.ID()
+	cmutex.Lock()
+	contact, exists := _contacts[util.ToHexString(id)]
+	if exists && contact.Key != nil && !bytes.Equal(contact.Key, serialized) {
+		cmutex.Unlock()
+		return Contact{}, errors.New("Key differs from the contact's key")
+	}
+	if !exists {
+		contact = &Contact{
+			ID:    id,
+			Added: time.Now(),
+		}
+		_contacts[util.ToHexString(id)] = contact
+	}
+	contact.Key = serialized
+	contact.Name = name
+	contact.Updated = time.Now()
+	c := *contact
+	cmutex.Unlock()
+	return c, saveContacts()
+}
+
+//AddContact - adds a node or user as contact, or renames it if it is one.
+//The key of a user is taken from its device list
+func AddContact(ctx context.Context, id []byte, name string) (Contact, error) {
+	key, err := keyFor(ctx, id)
+	if err != nil {
+		return Contact{}, err
+	}
+	return addContact(key, name)
+}
+
+//ImportSigned - adds the owner of a signed record, such as a contact card,
+//device list or profile, as contact. The record proves the key
+func ImportSigned(rec node.Record, name string) (Contact, error) {
+	err := rec.Verify()
+	if err != nil {
+		return Contact{}, err
+	}
+	return addContact(rec.Key, name)
+}
+
+//updateContact - applies change to the contact and saves
+func updateContact(id []byte, change func(contact *Contact)) error {
+	cmutex.Lock()
+	contact, exists := _contacts[util.ToHexString(id)]
+	if !exists {
+		cmutex.Unlock()
+		return errors.New("Unknown contact")
+	}
+	change(contact)
+	contact.Updated = time.Now()
+	cmutex.Unlock()
+	return saveContacts()
+}
+
+//SetPetname - renames the contact
+func SetPetname(id []byte, name string) error {
+	return updateContact(id, func(contact *Contact) {
+		contact.Name = name
+	})
+}
+
+//SetTrust - changes the trust level of the contact
+func SetTrust(id []byte, level TrustLevel) error {
+	if level < TrustBlocked || level > TrustTrusted {
+		return errors.New("Invalid trust level")
+	}
+	return updateContact(id, func(contact *Contact) {
+		contact.Trust = level
+	})
+}
+
+//SetNotes -
+func SetNotes(id []byte, notes string) error {
+	return updateContact(id, func(contact *Contact) {
+		contact.Notes = notes
+	})
+}
+
+//SetPreferred - the devices and personas to prefer for the contact
+func SetPreferred(id []byte, devices [][]byte, personas [][]byte) error {
+	return updateContact(id, func(contact *Contact) {
+		contact.Devices = devices
+		contact.Personas = personas
+	})
+}
+
+//Block - drops all messages from the ID. IDs that aren't contacts yet are
+//added without a key. The device list of a blocked user is fetched and kept
+//with the contact, so its devices stay blocked when the list isn't cached
+func Block(id []byte) error {
+	cmutex.Lock()
+	if _, exists := _contacts[util.ToHexString(id)]; !exists {
+		_contacts[util.ToHexString(id)] = &Contact{ID: id, Added: time.Now()}
+	}
+	cmutex.Unlock()
+	err := SetTrust(id, TrustBlocked)
+	if err != nil {
+		return err
+	}
+	go blockDevices(id)
+	return nil
+}
+
+//blockDevices - adds the devices of a blocked user to its contact
+func blockDevices(id []byte) {
+	devices, err := Devices(context.Background(), id)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = updateContact(id, func(contact *Contact) {
+		for _, device := range devices {
+			if !contains(contact.Devices, device) {
+				contact.Devices = append(contact.Devices, device)
+			}
+		}
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//Unblock - resets the trust level of a blocked contact
+func Unblock(id []byte) error {
+	return updateContact(id, func(contact *Contact) {
+		if contact.Trust == TrustBlocked {
+			contact.Trust = TrustUnknown
+		}
+	})
+}
+
+//IsBlocked - whether the ID, or the user of a device, is blocked
+func IsBlocked(id []byte) bool {
+	cmutex.Lock()
+	contact, exists := _contacts[util.ToHexString(id)]
+	blocked := exists && contact.Trust == TrustBlocked
+	cmutex.Unlock()
+	if blocked {
+		return true
+	}
+	if owner, ok := UserOf(id); ok && !bytes.Equal(owner, id) {
+		cmutex.Lock()
+		contact, exists = _contacts[util.ToHexString(owner)]
+		blocked = exists && contact.Trust == TrustBlocked
+		cmutex.Unlock()
+		if blocked {
+			return true
+		}
+	}
+	cmutex.Lock()
+	defer cmutex.Unlock()
+	for _, contact := range _contacts {
+		if contact.Trust == TrustBlocked && contains(contact.Devices, id) {
+			return true
+		}
+	}
+	return false
+}
+
+//acceptSender - the node delivery filter
+func acceptSender(sender []byte) bool {
+	return !IsBlocked(sender)
+}
+
+//RemoveContact -
+func RemoveContact(id []byte) error {
+	cmutex.Lock()
+	delete(_contacts, util.ToHexString(id))
+	cmutex.Unlock()
+	return saveContacts()
+}
+
+//GetContact -
+func GetContact(id []byte) (Contact, bool) {
+	cmutex.Lock()
+	defer cmutex.Unlock()
+	contact, exists := _contacts[util.ToHexString(id)]
+	if !exists {
+		return Contact{}, false
+	}
+	return *contact, true
+}
+
+//Contacts - all contacts
+func Contacts() []Contact {
+	cmutex.Lock()
+	defer cmutex.Unlock()
+	contacts := make([]Contact, 0, len(_contacts))
+	for _, contact := range _contacts {
+		contacts = append(contacts, *contact)
+	}
+	return contacts
+}
+
+//SafetyNumber - the number to compare with the contact
+func SafetyNumber(id []byte) (string, error) {
+	contact, exists := GetContact(id)
+	if !exists {
+		return "", errors.New("Unknown contact")
+	}
+	key, err := contact.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	return encryption.SafetyNumber(node.PublicKey(), key)
+}
+
+//Verify - marks the contact as verified if number is the safety number the
+//contact read out
+func Verify(id []byte, number string) error {
+	contact, exists := GetContact(id)
+	if !exists {
+		return errors.New("Unknown contact")
+	}
+	key, err := contact.PublicKey()
+	if err != nil {
+		return err
+	}
+	err = encryption.CompareSafetyNumber(node.PublicKey(), key, number)
+	if err != nil {
+		return err
+	}
+	return setVerified(id, true)
+}
+
+//Unverify - clears the verified flag
+func Unverify(id []byte) error {
+	return setVerified(id, false)
+}
+
+func setVerified(id []byte, verified bool) error {
+	cmutex.Lock()
+	contact, exists := _contacts[util.ToHexString(id)]
+	if !exists {
+		cmutex.Unlock()
+		return errors.New("Unknown contact")
+	}
+	contact.Verified = verified
+	contact.VerifiedAt = time.Time{}
+	if verified {
+		contact.VerifiedAt = time.Now()
+	}
+	cmutex.Unlock()
+	return saveContacts()
+}
+
+//AddKeyWarningHandler - registers a callback for key changes of verified
+//contacts
+func AddKeyWarningHandler(handler func(KeyWarning)) {
+	cmutex.Lock()
+	_warningHandlers = append(_warningHandlers, handler)
+	cmutex.Unlock()
+}
+
+//isKnown - whether id is a contact or a device of a known user
+func isKnown(id []byte) bool {
+	if _, exists := GetContact(id); exists {
+		return true
+	}
+	_, exists := UserOf(id)
+	return exists
+}
+
+//keyChanged - moves a contact whose key was retired to its successor
+func keyChanged(old []byte, successor []byte) {
+	cmutex.Lock()
+	contact, exists := _contacts[util.ToHexString(old)]
+	if !exists {
+		if successor == nil {
+			undoSuccession(old)
+			return
+		}
+		cmutex.Unlock()
+		return
+	}
+	warning := KeyWarning{Contact: *contact, Successor: successor}
+	handlers := _warningHandlers
+	if successor != nil && !bytes.Equal(successor, old) {
+		delete(_contacts, util.ToHexString(old))
+		moved := *contact
+		moved.ID = successor
+		moved.Key = nil
+		if key, ok := node.Successor(old); ok {
+			moved.Key, _ = key.Serialize()
+		}
+		moved.Verified = false
+		moved.VerifiedAt = time.Time{}
+		moved.Previous = old
+		moved.PrevKey = contact.Key
+		_contacts[util.ToHexString(successor)] = &moved
+	} else {
+		contact.Verified = false
+		contact.VerifiedAt = time.Time{}
+	}
+	cmutex.Unlock()
+	err := saveContacts()
+	if err != nil {
+		fmt.Println(err)
+	}
+	if !warning.Contact.Verified {
+		return
+	}
+	fmt.Println("key of verified contact", warning.Contact.Name, "changed")
+	for _, handler := range handlers {
+		handler(warning)
+	}
+}
+
+//undoSuccession - moves a contact back to old after its succession was
+//revoked. Caller holds cmutex, which is released
+func undoSuccession(old []byte) {
+	var contact *Contact
+	for _, c := range _contacts {
+		if bytes.Equal(c.Previous, old) {
+			contact = c
+			break
+		}
+	}
+	if contact == nil {
+		cmutex.Unlock()
+		return
+	}
+	moved := contact.ID
+	delete(_contacts, util.ToHexString(moved))
+	restored := *contact
+	restored.ID = old
+	restored.Key = contact.PrevKey
+	restored.Previous = nil
+	restored.PrevKey = nil
+	restored.Verified = false
+	restored.VerifiedAt = time.Time{}
+	_contacts[util.ToHexString(old)] = &restored
+	warning := KeyWarning{Contact: restored, Undone: moved}
+	handlers := _warningHandlers
+	cmutex.Unlock()
+	err := saveContacts()
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println("succession of contact", restored.Name, "was revoked, moved back from", util.ToHexString(moved))
+	for _, handler := range handlers {
+		handler(warning)
+	}
+}
+
+func saveContacts() error {
+	cmutex.Lock()
+	defer cmutex.Unlock()
+	return util.SaveGob(config.Attr("contactsfile"), _contacts)
+}
+
+func loadContacts() error {
+	contacts := make(map[string]*Contact)
+	err := util.LoadGob(config.Attr("contactsfile"), &contacts)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cmutex.Lock()
+	_contacts = contacts
+	cmutex.Unlock()
+	return nil
+}
+
+//ExportContacts - all contacts for ImportContacts
+func ExportContacts() ([]byte, error) {
+	cmutex.Lock()
+	defer cmutex.Unlock()
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(_contacts)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//ImportContacts - adds contacts made by ExportContacts, keeping the local
+//version of contacts that exist already. Contacts whose key doesn't match
+//their ID are skipped and none of them count as verified. Returns how many
+//were added
+func ImportContacts(data []byte) (int, error) {
+	return importContacts(data, false)
+}
+
+func importContacts(data []byte, keepVerified bool) (int, error) {
+	contacts := make(map[string]*Contact)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&contacts)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	cmutex.Lock()
+	for _, contact := range contacts {
+		if contact.Key != nil {
+			key, err := contact.PublicKey()
+			if err != nil || !bytes.Equal(key.ID(), contact.ID) {
+				fmt.Println("skipping imported contact with a key not matching its ID", util.ToHexString(contact.ID))
+				continue
+			}
+		}
+		if !keepVerified {
+			//only a safety number compared on this device counts
+			contact.Verified = false
+			contact.VerifiedAt = time.Time{}
+		}
+		if _, exists := _contacts[util.ToHexString(contact.ID)]; !exists {
+			_contacts[util.ToHexString(contact.ID)] = contact
+			added++
+		}
+	}
+	cmutex.Unlock()
+	return added, saveContacts()
+}
+
+//restoreContacts - the contacts section of a backup, which was made by
+//this user and so keeps what was verified
+func restoreContacts(data []byte) error {
+	_, err := importContacts(data, true)
+	return err
+}
+
+func contains(ids [][]byte, id []byte) bool {
+	for _, known := range ids {
+		if bytes.Equal(known, id) {
+			return true
+		}
+	}
+	return false
+}
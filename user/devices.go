@@ -0,0 +1,425 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"sync"
+	"time"
+)
+
+//The device list is a record signed by the root key and published on the
+//servers of the user ID, where senders look it up. The root device also
+//sends each new list to the user's devices so they learn they were added
+//or removed. A message to a user goes to all of the user's devices, and a
+//copy goes to the sender's other devices so they see what was sent
+
+//SyncedMessage - a message another device of this user sent
+type SyncedMessage struct {
+	ID        []byte
+	Device    []byte //device that sent it
+	To        []byte //user it was sent to
+	Timestamp uint64
+	Payload   []byte
+}
+
+type cachedDevices struct {
+	user    User
+	fetched time.Time
+}
+
+var (
+	_devices      = make(map[string]*cachedDevices) //device lists of other users
+	_owners       = make(map[string][]byte)         //user ID by device ID
+	_syncHandlers []func(SyncedMessage)
+	_published    bool
+	dmutex        = sync.Mutex{}
+)
+
+type handler struct{}
+
+//Handle - routes device, profile and invite payloads
+func (h handler) Handle(env node.Envelope) {
+	if len(env.Payload) == 0 {
+		return
+	}
+	var err error
+	switch env.Payload[0] {
+	case commands.PayloadDeviceLink:
+		err = handleLink(env)
+	case commands.PayloadDeviceSync:
+		err = handleSync(env)
+	case commands.PayloadProfile:
+		err = handleProfilePush(env.Sender, env.Payload[1:])
+	case commands.PayloadInvite:
+		err = handleInvite(context.Background(), env.Sender, env.Payload[1:])
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Println("device", util.ToHexString(env.Sender), err)
+	}
+}
+
+func serializeDevices(devices [][]byte) []byte {
+	data := make([]byte, 2, 2+32*len(devices))
+	binary.BigEndian.PutUint16(data, uint16(len(devices)))
+	for _, device := range devices {
+		data = append(data, device...)
+	}
+	return data
+}
+
+func deserializeDevices(data []byte) ([][]byte, error) {
+	if len(data) < 2 {
+		return nil, errors.New("Device list too short")
+	}
+	cnt := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) != 2+32*cnt {
+		return nil, errors.New("Invalid device list length")
+	}
+	devices := make([][]byte, cnt)
+	for i := range devices {
+		devices[i] = data[2+32*i : 2+32*(i+1)]
+	}
+	return devices, nil
+}
+
+//deviceRecord - signs the device list. Caller holds umutex
+func deviceRecord() (node.Record, error) {
+	return node.NewRecord(commands.RecordDevices, _me.Seq, _me.Key, serializeDevices(_me.Devices))
+}
+
+//userFromRecord - the user a verified device list record describes
+func userFromRecord(rec node.Record) (User, error) {
+	if rec.Kind != commands.RecordDevices {
+		return User{}, errors.New("Not a device list")
+	}
+	devices, err := deserializeDevices(rec.Data)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Key: rec.Key, Devices: devices, Seq: rec.Seq}, nil
+}
+
+//changeDevices - applies change to the device list, then publishes it and
+//sends it to the old and new devices. Only the root device can do this
+func changeDevices(ctx context.Context, change func(devices [][]byte) ([][]byte, error)) error {
+	if !IsRoot() {
+		return errors.New("Only the root device can change devices")
+	}
+	umutex.Lock()
+	devices, err := change(_me.Devices)
+	if err != nil {
+		umutex.Unlock()
+		return err
+	}
+	notify := append(append([][]byte(nil), _me.Devices...), devices...)
+	_me.Devices = devices
+	_me.Seq++
+	rec, err := deviceRecord()
+	umutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = saveUser()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = node.PublishRecord(ctx, rec)
+	if err != nil {
+		fmt.Println(err)
+	}
+	data, err := rec.Serialize()
+	if err != nil {
+		return err
+	}
+	payload := append([]byte{commands.PayloadDeviceLink}, data...)
+	seen := make(map[string]bool)
+	for _, device := range notify {
+		if seen[util.ToHexString(device)] || bytes.Equal(device, node.ID()) {
+			continue
+		}
+		seen[util.ToHexString(device)] = true
+		_, err = node.SendDirect(ctx, device, payload)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	return nil
+}
+
+//AddDevice - certifies another node as device of this user. Start that
+//node with linkto set to this user's ID first
+func AddDevice(ctx context.Context, device []byte) error {
+	return changeDevices(ctx, func(devices [][]byte) ([][]byte, error) {
+		for _, d := range devices {
+			if bytes.Equal(d, device) {
+				return nil, errors.New("Device already added")
+			}
+		}
+		return append(append([][]byte(nil), devices...), device), nil
+	})
+}
+
+//RemoveDevice - withdraws the certification of a device
+func RemoveDevice(ctx context.Context, device []byte) error {
+	return changeDevices(ctx, func(devices [][]byte) ([][]byte, error) {
+		if bytes.Equal(device, node.ID()) {
+			return nil, errors.New("The root device can't be removed")
+		}
+		kept := make([][]byte, 0, len(devices))
+		for _, d := range devices {
+			if !bytes.Equal(d, device) {
+				kept = append(kept, d)
+			}
+		}
+		if len(kept) == len(devices) {
+			return nil, errors.New("Unknown device")
+		}
+		return kept, nil
+	})
+}
+
+//handleLink - a new device list from the root device of this user, or of
+//the user this device waits to be linked to
+func handleLink(env node.Envelope) error {
+	rec, err := node.DeserializeRecord(env.Payload[1:])
+	if err == nil {
+		err = rec.Verify()
+	}
+	if err != nil {
+		return err
+	}
+	linked, err := userFromRecord(rec)
+	if err != nil {
+		return err
+	}
+	umutex.Lock()
+	if _me.Key.HasPublic() {
+		if !bytes.Equal(rec.Owner(), _me.ID()) || rec.Seq <= _me.Seq {
+			umutex.Unlock()
+			return errors.New("Unexpected device list")
+		}
+	} else if !bytes.Equal(rec.Owner(), _linkTo) {
+		umutex.Unlock()
+		return errors.New("Unexpected device list")
+	}
+	if !linked.HasDevice(node.ID()) {
+		if _me.Key.HasPublic() {
+			fmt.Println("this device was removed from user", util.ToHexString(rec.Owner()))
+			_linkTo = nil
+			_me = User{Personas: _me.Personas}
+		}
+		umutex.Unlock()
+		return saveUser()
+	}
+	if !_me.Key.HasPublic() {
+		fmt.Println("linked to user", util.ToHexString(rec.Owner()))
+	}
+	linked.Personas = _me.Personas
+	_me = linked
+	_linkTo = nil
+	umutex.Unlock()
+	return saveUser()
+}
+
+//publishDevicesOnce - the root device republishes the device list after
+//the first routing sync, in case the servers changed
+func publishDevicesOnce() {
+	dmutex.Lock()
+	if _published || !IsRoot() {
+		dmutex.Unlock()
+		return
+	}
+	_published = true
+	dmutex.Unlock()
+	umutex.Lock()
+	rec, err := deviceRecord()
+	umutex.Unlock()
+	if err == nil {
+		err = node.PublishRecord(context.Background(), rec)
+	}
+	if err != nil {
+		fmt.Println(err)
+		dmutex.Lock()
+		_published = false
+		dmutex.Unlock()
+	}
+}
+
+//deviceKeyChanged - the root device moves a device whose node key was
+//retired to its successor, or drops it
+func deviceKeyChanged(old []byte, successor []byte) {
+	umutex.Lock()
+	isDevice := _me.HasDevice(old)
+	umutex.Unlock()
+	if !isDevice || !IsRoot() || bytes.Equal(old, node.ID()) {
+		return
+	}
+	err := changeDevices(context.Background(), func(devices [][]byte) ([][]byte, error) {
+		kept := make([][]byte, 0, len(devices))
+		for _, d := range devices {
+			if bytes.Equal(d, old) {
+				if successor != nil {
+					kept = append(kept, successor)
+				}
+				continue
+			}
+			kept = append(kept, d)
+		}
+		return kept, nil
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//Devices - the devices of a user. Other users' device lists are fetched
+//from the servers and cached for devicelistttl. A node ID without a device
+//list is treated as a user with that node as only device
+func Devices(ctx context.Context, userID []byte) ([][]byte, error) {
+	umutex.Lock()
+	if _me.Key.HasPublic() && bytes.Equal(userID, _me.ID()) {
+		devices := _me.Devices
+		umutex.Unlock()
+		return devices, nil
+	}
+	umutex.Unlock()
+	key := util.ToHexString(userID)
+	dmutex.Lock()
+	cached, exists := _devices[key]
+	dmutex.Unlock()
+	if exists && time.Since(cached.fetched) < config.AttrDuration("devicelistttl", 10*time.Minute) {
+		return cached.user.Devices, nil
+	}
+	rec, err := node.FetchRecord(ctx, userID, commands.RecordDevices)
+	if err != nil {
+		if exists {
+			return cached.user.Devices, nil
+		}
+		if _, keyErr := node.KeyOf(userID); keyErr == nil {
+			return [][]byte{userID}, nil
+		}
+		return nil, err
+	}
+	user, err := userFromRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	dmutex.Lock()
+	if !exists || user.Seq >= cached.user.Seq {
+		if exists {
+			for _, device := range cached.user.Devices {
+				delete(_owners, util.ToHexString(device))
+			}
+		}
+		_devices[key] = &cachedDevices{user: user, fetched: time.Now()}
+		for _, device := range user.Devices {
+			_owners[util.ToHexString(device)] = userID
+		}
+	}
+	devices := _devices[key].user.Devices
+	dmutex.Unlock()
+	return devices, nil
+}
+
+//UserOf - the user a device belongs to, as far as known from device lists
+//fetched so far
+func UserOf(device []byte) ([]byte, bool) {
+	umutex.Lock()
+	if _me.Key.HasPublic() && _me.HasDevice(device) {
+		id := _me.ID()
+		umutex.Unlock()
+		return id, true
+	}
+	umutex.Unlock()
+	dmutex.Lock()
+	defer dmutex.Unlock()
+	id, exists := _owners[util.ToHexString(device)]
+	return id, exists
+}
+
+//reachable - the devices with a known node key
+func reachable(devices [][]byte) [][]byte {
+	known := make([][]byte, 0, len(devices))
+	for _, device := range devices {
+		if bytes.Equal(device, node.ID()) {
+			continue
+		}
+		if _, err := node.KeyOf(device); err != nil {
+			fmt.Println("skipping device", util.ToHexString(device), err)
+			continue
+		}
+		known = append(known, device)
+	}
+	return known
+}
+
+//Send - sends the payload to all devices of the user and a copy to this
+//user's other devices. Returns the message ID
+func Send(ctx context.Context, userID []byte, payload []byte) ([]byte, error) {
+	devices, err := Devices(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	devices = reachable(devices)
+	if len(devices) == 0 {
+		return nil, errors.New("No reachable device of " + util.ToHexString(userID))
+	}
+	id, err := node.SendMulti(ctx, devices, payload)
+	if err != nil {
+		return nil, err
+	}
+	umutex.Lock()
+	own := reachable(_me.Devices)
+	umutex.Unlock()
+	if len(own) > 0 {
+		sync := append([]byte{commands.PayloadDeviceSync}, userID...)
+		_, err = node.SendMulti(ctx, own, append(sync, payload...))
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	return id, nil
+}
+
+//AddSyncHandler - registers a callback for messages this user sent from
+//another device
+func AddSyncHandler(handler func(SyncedMessage)) {
+	dmutex.Lock()
+	_syncHandlers = append(_syncHandlers, handler)
+	dmutex.Unlock()
+}
+
+func handleSync(env node.Envelope) error {
+	if len(env.Payload) < 1+32 {
+		return errors.New("Malformed device sync")
+	}
+	umutex.Lock()
+	own := _me.HasDevice(env.Sender)
+	umutex.Unlock()
+	if !own {
+		return errors.New("Device sync from a foreign device")
+	}
+	dmutex.Lock()
+	handlers := _syncHandlers
+	dmutex.Unlock()
+	msg := SyncedMessage{
+		ID:        env.ID,
+		Device:    env.Sender,
+		To:        env.Payload[1:33],
+		Timestamp: env.Timestamp,
+		Payload:   env.Payload[33:],
+	}
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mobchat/encryption"
+	"mobchat/node"
+)
+
+//An identity is what other people know this user as: the user itself, on
+//the root device, or one of its personas. Packages built on top sign and
+//send as an identity without touching its private key. A nil identity
+//means the user
+
+//Identities - the user ID, if this device holds the root key, and the
+//persona IDs
+func Identities() [][]byte {
+	ids := make([][]byte, 0)
+	if IsRoot() {
+		umutex.Lock()
+		ids = append(ids, _me.ID())
+		umutex.Unlock()
+	}
+	for _, persona := range Personas() {
+		ids = append(ids, persona.ID)
+	}
+	return ids
+}
+
+//isUser - whether as stands for the user. Caller holds umutex
+func isUser(as []byte) bool {
+	return as == nil || (_me.Key.HasPublic() && bytes.Equal(as, _me.ID()))
+}
+
+//identityKey - the private key of an identity
+func identityKey(as []byte) (encryption.Key, error) {
+	umutex.Lock()
+	user, key := isUser(as), _me.Key
+	umutex.Unlock()
+	if !user {
+		return personaKey(as)
+	}
+	if key.SignPrivate == nil && key.Private == nil {
+		return encryption.Key{}, errors.New("Only the root device can act as the user")
+	}
+	return key, nil
+}
+
+//IsIdentity - whether id is the user or one of its personas
+func IsIdentity(id []byte) bool {
+	umutex.Lock()
+	user := _me.Key.HasPublic() && bytes.Equal(id, _me.ID())
+	umutex.Unlock()
+	if user {
+		return true
+	}
+	_, exists := GetPersona(id)
+	return exists
+}
+
+//IdentityID - the ID of an identity, resolving nil to the user ID. nil
+//while the device waits to be linked
+func IdentityID(as []byte) []byte {
+	umutex.Lock()
+	defer umutex.Unlock()
+	if as != nil {
+		return as
+	}
+	if !_me.Key.HasPublic() {
+		return nil
+	}
+	return _me.ID()
+}
+
+//NewRecord - a record signed by the identity
+func NewRecord(as []byte, kind byte, seq uint64, data []byte) (node.Record, error) {
+	key, err := identityKey(as)
+	if err != nil {
+		return node.Record{}, err
+	}
+	return node.NewRecord(kind, seq, key, data)
+}
+
+//SendFrom - sends the payload as the identity. As the user it goes to all
+//devices of to. As a persona it goes to the drop box of to, using its key
+//if given and otherwise the key of the persona contact
+func SendFrom(ctx context.Context, as []byte, to []byte, toKey []byte, payload []byte) error {
+	umutex.Lock()
+	user := isUser(as)
+	umutex.Unlock()
+	if user {
+		_, err := Send(ctx, to, payload)
+		return err
+	}
+	if toKey == nil {
+		return SendAs(ctx, as, to, payload)
+	}
+	key, err := encryption.Deserialize(toKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(key.ID(), to) {
+		return errors.New("Key does not match recipient")
+	}
+	return sendPersona(ctx, as, [][]byte{toKey}, nil, payload)
+}
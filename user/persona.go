@@ -1,4 +1,607 @@
 package user
 
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/util"
+	"sync"
+	"time"
+)
+
+//A persona is a pseudonym with its own key, profile, contacts and groups.
+//Persona messages don't go through the node's direct messages, which are
+//signed by the node key, but are sealed for the recipient persona and put
+//in its drop box, so the recipient only learns the sending persona. A
+//persona ID is the ID of its key and says nothing about the user, the
+//device or the other personas. The servers of a drop box still see which
+//node uses it. Persona keys stay on the device that created them
+
+//PersonaContact - another persona a persona talks to
+type PersonaContact struct {
+	ID    []byte
+	Name  string
+	Key   []byte //serialized public key
+	Added time.Time
+}
+
+//PersonaGroup - a group of personas. Every message to the group carries the
+//member list as the sender has it, the last one received wins
+type PersonaGroup struct {
+	ID      []byte
+	Name    string
+	Members [][]byte //serialized public keys, including the own persona
+}
+
+//Persona -
 type Persona struct {
+	ID       []byte
+	Name     string
+	About    string
+	Created  time.Time
+	Contacts []PersonaContact
+	Groups   []PersonaGroup
+}
+
+//PersonaMessage - a message to one of this user's personas. Payloads start
+//with a payload code like those of direct messages
+type PersonaMessage struct {
+	Persona   []byte //recipient persona
+	Sender    []byte //sending persona
+	SenderKey []byte //serialized public key of the sending persona
+	Group     []byte //nil unless sent to a persona group
+	Timestamp uint64
+	Payload   []byte
+}
+
+var (
+	_personaKeys     = make(map[string]encryption.Key)
+	_personaHandlers []func(PersonaMessage)
+	pmutex           = sync.Mutex{}
+)
+
+func personaLabel(id []byte) string {
+	return config.Attr("userlabel") + "-persona-" + util.ToHexString(id)
+}
+
+//findPersona - index of the persona in _me.Personas. Caller holds umutex
+func findPersona(id []byte) int {
+	for i, persona := range _me.Personas {
+		if bytes.Equal(persona.ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+//changePersona - applies change to the persona and saves the user
+func changePersona(id []byte, change func(persona *Persona) error) error {
+	umutex.Lock()
+	idx := findPersona(id)
+	if idx < 0 {
+		umutex.Unlock()
+		return errors.New("Unknown persona")
+	}
+	persona := copyPersona(_me.Personas[idx])
+	err := change(&persona)
+	if err != nil {
+		umutex.Unlock()
+		return err
+	}
+	personas := append([]Persona(nil), _me.Personas...)
+	personas[idx] = persona
+	_me.Personas = personas
+	umutex.Unlock()
+	return saveUser()
+}
+
+func copyPersona(persona Persona) Persona {
+	persona.Contacts = append([]PersonaContact(nil), persona.Contacts...)
+	persona.Groups = append([]PersonaGroup(nil), persona.Groups...)
+	return persona
+}
+
+func personaKey(id []byte) (encryption.Key, error) {
+	pmutex.Lock()
+	defer pmutex.Unlock()
+	key, exists := _personaKeys[util.ToHexString(id)]
+	if !exists {
+		return encryption.Key{}, errors.New("Unknown persona")
+	}
+	return key, nil
+}
+
+//loadPersonas - unlocks the persona keys and starts fetching their drop
+//boxes
+func loadPersonas() error {
+	umutex.Lock()
+	personas := _me.Personas
+	umutex.Unlock()
+	for _, persona := range personas {
+		key, err := node.LoadKey(personaLabel(persona.ID))
+		if err != nil {
+			return err
+		}
+		registerPersona(key)
+	}
+	return nil
+}
+
+func registerPersona(key encryption.Key) {
+	pmutex.Lock()
+	_personaKeys[util.ToHexString(key.ID())] = key
+	pmutex.Unlock()
+	node.AddDropBox(key, handlePersonaDrop)
+}
+
+//CreatePersona - makes a persona with a new key
+func CreatePersona(name string, about string) (Persona, error) {
+	key, err := encryption.GenerateEd25519()
+	if err != nil {
+		return Persona{}, err
+	}
+	err = node.StoreKey(personaLabel(key.ID()), key)
+	if err != nil {
+		return Persona{}, err
+	}
+	persona := Persona{
+		ID:      key.ID(),
+		Name:    name,
+		About:   about,
+		Created: time.Now(),
+	}
+	umutex.Lock()
+	_me.Personas = append(append([]Persona(nil), _me.Personas...), persona)
+	umutex.Unlock()
+	registerPersona(key)
+	return persona, saveUser()
+}
+
+//RemovePersona - deletes the persona and its key. Messages to it can't be
+//read anymore
+func RemovePersona(id []byte) error {
+	umutex.Lock()
+	idx := findPersona(id)
+	if idx < 0 {
+		umutex.Unlock()
+		return errors.New("Unknown persona")
+	}
+	personas := append([]Persona(nil), _me.Personas[:idx]...)
+	_me.Personas = append(personas, _me.Personas[idx+1:]...)
+	umutex.Unlock()
+	node.RemoveDropBox(id)
+	pmutex.Lock()
+	delete(_personaKeys, util.ToHexString(id))
+	pmutex.Unlock()
+	err := node.DeleteKey(personaLabel(id))
+	if err != nil {
+		fmt.Println(err)
+	}
+	return saveUser()
+}
+
+//Personas - all personas of this user
+func Personas() []Persona {
+	umutex.Lock()
+	defer umutex.Unlock()
+	personas := make([]Persona, len(_me.Personas))
+	for i, persona := range _me.Personas {
+		personas[i] = copyPersona(persona)
+	}
+	return personas
+}
+
+//GetPersona -
+func GetPersona(id []byte) (Persona, bool) {
+	umutex.Lock()
+	defer umutex.Unlock()
+	idx := findPersona(id)
+	if idx < 0 {
+		return Persona{}, false
+	}
+	return copyPersona(_me.Personas[idx]), true
+}
+
+//PersonaPublicKey - the serialized public key of the persona, to hand to
+//the people it should talk to
+func PersonaPublicKey(id []byte) ([]byte, error) {
+	key, err := personaKey(id)
+	if err != nil {
+		return nil, err
+	}
+	pub := key.PublicKey()
+	return pub.Serialize()
+}
+
+//AddPersonaContact - adds the persona with the serialized public key as
+//contact of the persona id, or renames it if it is one
+func AddPersonaContact(id []byte, key []byte, name string) (PersonaContact, error) {
+	pub, err := encryption.Deserialize(key)
+	if err != nil {
+		return PersonaContact{}, err
+	}
+	if !pub.HasPublic() {
+		return PersonaContact{}, errors.New("Invalid persona key")
+	}
+	contact := PersonaContact{
+		ID:    pub.ID(),
+		Name:  name,
+		Key:   key,
+		Added: time.Now(),
+	}
+	err = changePersona(id, func(persona *Persona) error {
+		for i, existing := range persona.Contacts {
+			if bytes.Equal(existing.ID, contact.ID) {
+				persona.Contacts[i].Name = name
+				contact = persona.Contacts[i]
+				return nil
+			}
+		}
+		persona.Contacts = append(persona.Contacts, contact)
+		return nil
+	})
+	return contact, err
+}
+
+//RemovePersonaContact -
+func RemovePersonaContact(id []byte, contactID []byte) error {
+	return changePersona(id, func(persona *Persona) error {
+		kept := persona.Contacts[:0]
+		for _, contact := range persona.Contacts {
+			if !bytes.Equal(contact.ID, contactID) {
+				kept = append(kept, contact)
+			}
+		}
+		persona.Contacts = kept
+		return nil
+	})
+}
+
+//contactKey - the key of a contact of the persona. Caller holds umutex
+func (persona *Persona) contactKey(contactID []byte) ([]byte, bool) {
+	for _, contact := range persona.Contacts {
+		if bytes.Equal(contact.ID, contactID) {
+			return contact.Key, true
+		}
+	}
+	return nil, false
+}
+
+//CreatePersonaGroup - makes a group of the persona and some of its contacts
+func CreatePersonaGroup(id []byte, name string, members [][]byte) (PersonaGroup, error) {
+	own, err := PersonaPublicKey(id)
+	if err != nil {
+		return PersonaGroup{}, err
+	}
+	groupID := make([]byte, 16)
+	_, err = rand.Read(groupID)
+	if err != nil {
+		return PersonaGroup{}, err
+	}
+	group := PersonaGroup{
+		ID:      groupID,
+		Name:    name,
+		Members: [][]byte{own},
+	}
+	err = changePersona(id, func(persona *Persona) error {
+		for _, member := range members {
+			key, exists := persona.contactKey(member)
+			if !exists {
+				return errors.New("Unknown contact " + util.ToHexString(member))
+			}
+			group.Members = append(group.Members, key)
+		}
+		persona.Groups = append(persona.Groups, group)
+		return nil
+	})
+	return group, err
+}
+
+//AddPersonaMessageHandler - registers a callback for messages to personas
+func AddPersonaMessageHandler(handler func(PersonaMessage)) {
+	pmutex.Lock()
+	_personaHandlers = append(_personaHandlers, handler)
+	pmutex.Unlock()
+}
+
+//serializeGroupHeader - group ID, name length, name, count, member keys
+func serializeGroupHeader(group PersonaGroup) []byte {
+	var buff bytes.Buffer
+	buff.Write(group.ID)
+	name := []byte(group.Name)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	buff.WriteByte(byte(len(name)))
+	buff.Write(name)
+	cnt := make([]byte, 2)
+	binary.BigEndian.PutUint16(cnt, uint16(len(group.Members)))
+	buff.Write(cnt)
+	for _, member := range group.Members {
+		buff.Write(member)
+	}
+	return buff.Bytes()
+}
+
+func deserializeGroupHeader(data []byte) (PersonaGroup, error) {
+	if len(data) < 16+1 || len(data) < 16+1+int(data[16])+2 {
+		return PersonaGroup{}, errors.New("Group header too short")
+	}
+	group := PersonaGroup{
+		ID:   data[0:16],
+		Name: string(data[17 : 17+int(data[16])]),
+	}
+	idx := 17 + int(data[16])
+	cnt := int(binary.BigEndian.Uint16(data[idx : idx+2]))
+	idx += 2
+	for i := 0; i < cnt; i++ {
+		ln, err := encryption.SerializedLen(data[idx:])
+		if err != nil {
+			return PersonaGroup{}, err
+		}
+		group.Members = append(group.Members, data[idx:idx+ln])
+		idx += ln
+	}
+	if idx != len(data) {
+		return PersonaGroup{}, errors.New("Invalid group header length")
+	}
+	return group, nil
+}
+
+//sealPersona - Encrypt(sender key, sig, recipient, timestamp, group header
+//length, group header, payload) for the recipient key. The signature covers
+//everything after it
+func sealPersona(sender encryption.Key, recipient encryption.Key, header []byte, payload []byte) ([]byte, error) {
+	var signed bytes.Buffer
+	signed.Write(recipient.ID())
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	signed.Write(ts)
+	ln := make([]byte, 4)
+	binary.BigEndian.PutUint32(ln, uint32(len(header)))
+	signed.Write(ln)
+	signed.Write(header)
+	signed.Write(payload)
+	sig, err := encryption.Sign(sender, signed.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	pub := sender.PublicKey()
+	key, err := pub.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	plain := append(append(key, sig...), signed.Bytes()...)
+	return encryption.Encrypt([]encryption.Key{recipient}, plain, encryption.GetCipherKey())
+}
+
+func openPersona(recipient encryption.Key, blob []byte) (PersonaMessage, PersonaGroup, error) {
+	plain, err := encryption.DecryptMultiple(recipient, 0, blob)
+	if err != nil {
+		return PersonaMessage{}, PersonaGroup{}, err
+	}
+	keyLen, err := encryption.SerializedLen(plain)
+	if err != nil {
+		return PersonaMessage{}, PersonaGroup{}, err
+	}
+	sender, err := encryption.Deserialize(plain[:keyLen])
+	if err != nil {
+		return PersonaMessage{}, PersonaGroup{}, err
+	}
+	if len(plain) < keyLen+sender.SigLen()+32+8+4 {
+		return PersonaMessage{}, PersonaGroup{}, errors.New("Persona message too short")
+	}
+	sig := plain[keyLen : keyLen+sender.SigLen()]
+	signed := plain[keyLen+sender.SigLen():]
+	if !encryption.ValidateSig(sender, sig, signed) {
+		return PersonaMessage{}, PersonaGroup{}, errors.New("Invalid signature")
+	}
+	if !bytes.Equal(signed[0:32], recipient.ID()) {
+		return PersonaMessage{}, PersonaGroup{}, errors.New("Persona message for someone else")
+	}
+	ln := int(binary.BigEndian.Uint32(signed[40:44]))
+	if len(signed) < 44+ln {
+		return PersonaMessage{}, PersonaGroup{}, errors.New("Persona message too short")
+	}
+	msg := PersonaMessage{
+		Persona:   recipient.ID(),
+		Sender:    sender.ID(),
+		SenderKey: plain[:keyLen],
+		Timestamp: binary.BigEndian.Uint64(signed[32:40]),
+		Payload:   signed[44+ln:],
+	}
+	var group PersonaGroup
+	if ln > 0 {
+		group, err = deserializeGroupHeader(signed[44 : 44+ln])
+		if err != nil {
+			return PersonaMessage{}, PersonaGroup{}, err
+		}
+		msg.Group = group.ID
+	}
+	return msg, group, nil
+}
+
+//sendPersona - seals the payload for each recipient key and drops it in
+//their drop boxes
+func sendPersona(ctx context.Context, id []byte, recipients [][]byte, header []byte, payload []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := personaKey(id)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for _, serialized := range recipients {
+		recipient, err := encryption.Deserialize(serialized)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if bytes.Equal(recipient.ID(), id) {
+			continue
+		}
+		blob, err := sealPersona(key, recipient, header, payload)
+		if err == nil {
+			err = node.Drop(recipient.ID(), blob)
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return errors.New("Could not send to any recipient")
+	}
+	return nil
+}
+
+//SendAs - sends the payload from the persona to one of its contacts
+func SendAs(ctx context.Context, id []byte, contactID []byte, payload []byte) error {
+	umutex.Lock()
+	idx := findPersona(id)
+	var key []byte
+	exists := false
+	if idx >= 0 {
+		key, exists = _me.Personas[idx].contactKey(contactID)
+	}
+	umutex.Unlock()
+	if !exists {
+		return errors.New("Unknown contact " + util.ToHexString(contactID))
+	}
+	return sendPersona(ctx, id, [][]byte{key}, nil, payload)
+}
+
+//SendAsToGroup - sends the payload from the persona to the other members of
+//one of its groups
+func SendAsToGroup(ctx context.Context, id []byte, groupID []byte, payload []byte) error {
+	umutex.Lock()
+	idx := findPersona(id)
+	var group PersonaGroup
+	exists := false
+	if idx >= 0 {
+		for _, g := range _me.Personas[idx].Groups {
+			if bytes.Equal(g.ID, groupID) {
+				group, exists = g, true
+				break
+			}
+		}
+	}
+	umutex.Unlock()
+	if !exists {
+		return errors.New("Unknown group " + util.ToHexString(groupID))
+	}
+	return sendPersona(ctx, id, group.Members, serializeGroupHeader(group), payload)
+}
+
+//updateGroup - adopts the member list of a group message if the sender is
+//a member of it
+func updateGroup(id []byte, sender []byte, group PersonaGroup) error {
+	isMember := false
+	for _, member := range group.Members {
+		key, err := encryption.Deserialize(member)
+		if err == nil && bytes.Equal(key.ID(), sender) {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		return errors.New("Group message from a non member")
+	}
+	group.ID = append([]byte(nil), group.ID...)
+	return changePersona(id, func(persona *Persona) error {
+		for i, existing := range persona.Groups {
+			if bytes.Equal(existing.ID, group.ID) {
+				persona.Groups[i] = group
+				return nil
+			}
+		}
+		persona.Groups = append(persona.Groups, group)
+		return nil
+	})
+}
+
+func handlePersonaDrop(box []byte, blob []byte) {
+	key, err := personaKey(box)
+	if err != nil {
+		return
+	}
+	msg, group, err := openPersona(key, blob)
+	if err == nil && IsBlocked(msg.Sender) {
+		return
+	}
+	if err == nil && msg.Group != nil {
+		err = updateGroup(box, msg.Sender, group)
+	}
+	if err != nil {
+		fmt.Println("persona", util.ToHexString(box), err)
+		return
+	}
+	pmutex.Lock()
+	handlers := _personaHandlers
+	pmutex.Unlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+type personaBackup struct {
+	Persona Persona
+	Key     []byte //from node.ExportStoredKey
+}
+
+//exportPersonas - the personas section of a backup, with their keys
+func exportPersonas() ([]byte, error) {
+	personas := Personas()
+	backups := make([]personaBackup, 0, len(personas))
+	for _, persona := range personas {
+		key, err := node.ExportStoredKey(personaLabel(persona.ID))
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, personaBackup{Persona: persona, Key: key})
+	}
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(backups)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//restorePersonas - adds the backed up personas this user doesn't have
+func restorePersonas(data []byte) error {
+	backups := []personaBackup{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&backups)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if _, exists := GetPersona(b.Persona.ID); exists {
+			continue
+		}
+		if !node.HasKey(personaLabel(b.Persona.ID)) {
+			err = node.ImportKey(b.Key)
+			if err != nil {
+				return err
+			}
+		}
+		key, err := node.LoadKey(personaLabel(b.Persona.ID))
+		if err != nil {
+			return err
+		}
+		umutex.Lock()
+		_me.Personas = append(append([]Persona(nil), _me.Personas...), b.Persona)
+		umutex.Unlock()
+		registerPersona(key)
+	}
+	return saveUser()
 }
@@ -0,0 +1,412 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mobchat/config"
+	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/node/commands"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
+)
+
+//A profile is a record signed by the user's root key or a persona key and
+//published on the servers of its owner. Changes are also pushed to the
+//contacts. Profiles that were fetched or pushed are cached, and subscribed
+//profiles are refreshed after routing syncs once they are older than
+//profilettl. The record sequence number is the profile version
+
+const (
+	maxProfileName   = 255
+	maxProfileStatus = 255
+	maxProfileAbout  = 4096
+	maxProfileAvatar = 1024
+)
+
+//Profile -
+type Profile struct {
+	Owner   []byte //user or persona ID
+	Name    string
+	Status  string
+	About   string
+	Avatar  string //reference to the avatar, such as a content hash or URL
+	Updated time.Time
+	Version uint64
+	Fetched time.Time //when it was last fetched, zero for own profiles
+}
+
+type profileState struct {
+	Profiles      map[string]Profile
+	Subscriptions [][]byte
+}
+
+var (
+	_profiles        = make(map[string]Profile)
+	_subscriptions   [][]byte
+	_profileHandlers []func(Profile)
+	prmutex          = sync.Mutex{}
+)
+
+//serializeProfile - name length, name, status length, status, about length,
+//about, avatar length, avatar, updated
+func serializeProfile(p Profile) ([]byte, error) {
+	if len(p.Name) > maxProfileName || len(p.Status) > maxProfileStatus ||
+		len(p.About) > maxProfileAbout || len(p.Avatar) > maxProfileAvatar {
+		return nil, errors.New("Profile field too long")
+	}
+	var buff bytes.Buffer
+	buff.WriteByte(byte(len(p.Name)))
+	buff.WriteString(p.Name)
+	buff.WriteByte(byte(len(p.Status)))
+	buff.WriteString(p.Status)
+	ln := make([]byte, 2)
+	binary.BigEndian.PutUint16(ln, uint16(len(p.About)))
+	buff.Write(ln)
+	buff.WriteString(p.About)
+	binary.BigEndian.PutUint16(ln, uint16(len(p.Avatar)))
+	buff.Write(ln)
+	buff.WriteString(p.Avatar)
+	updated := make([]byte, 8)
+	binary.BigEndian.PutUint64(updated, uint64(p.Updated.UnixNano()))
+	buff.Write(updated)
+	return buff.Bytes(), nil
+}
+
+//profileFromRecord - the profile a verified record holds
+func profileFromRecord(rec node.Record) (Profile, error) {
+	if rec.Kind != commands.RecordProfile {
+		return Profile{}, errors.New("Not a profile")
+	}
+	data := rec.Data
+	p := Profile{Owner: rec.Owner(), Version: rec.Seq}
+	fields := []*string{&p.Name, &p.Status, &p.About, &p.Avatar}
+	idx := 0
+	for i, field := range fields {
+		ln := 0
+		if i < 2 {
+			if len(data) < idx+1 {
+				return Profile{}, errors.New("Profile too short")
+			}
+			ln = int(data[idx])
+			idx++
+		} else {
+			if len(data) < idx+2 {
+				return Profile{}, errors.New("Profile too short")
+			}
+			ln = int(binary.BigEndian.Uint16(data[idx : idx+2]))
+			idx += 2
+		}
+		if len(data) < idx+ln {
+			return Profile{}, errors.New("Profile too short")
+		}
+		*field = string(data[idx : idx+ln])
+		idx += ln
+	}
+	if len(data) != idx+8 {
+		return Profile{}, errors.New("Invalid profile length")
+	}
+	p.Updated = time.Unix(0, int64(binary.BigEndian.Uint64(data[idx:idx+8])))
+	return p, nil
+}
+
+//GetProfile - the cached profile of a user or persona
+func GetProfile(owner []byte) (Profile, bool) {
+	prmutex.Lock()
+	defer prmutex.Unlock()
+	p, exists := _profiles[util.ToHexString(owner)]
+	return p, exists
+}
+
+//cacheProfile - keeps p if it is newer than the cached one and tells the
+//handlers. Returns whether it was newer
+func cacheProfile(p Profile) bool {
+	key := util.ToHexString(p.Owner)
+	prmutex.Lock()
+	if cached, exists := _profiles[key]; exists && cached.Version >= p.Version {
+		if !p.Fetched.IsZero() {
+			cached.Fetched = p.Fetched
+			_profiles[key] = cached
+		}
+		prmutex.Unlock()
+		return false
+	}
+	_profiles[key] = p
+	handlers := _profileHandlers
+	prmutex.Unlock()
+	for _, handler := range handlers {
+		handler(p)
+	}
+	return true
+}
+
+//publishProfile - signs the profile with key, publishes it and pushes it
+//to recipients
+func publishProfile(ctx context.Context, key encryption.Key, p Profile, push func(payload []byte)) (Profile, error) {
+	p.Owner = key.ID()
+	p.Updated = time.Now()
+	p.Fetched = time.Time{}
+	//a version from the clock keeps growing when the local state was lost
+	p.Version = uint64(p.Updated.Unix())
+	if cached, exists := GetProfile(p.Owner); exists && cached.Version >= p.Version {
+		p.Version = cached.Version + 1
+	}
+	data, err := serializeProfile(p)
+	if err != nil {
+		return Profile{}, err
+	}
+	rec, err := node.NewRecord(commands.RecordProfile, p.Version, key, data)
+	if err != nil {
+		return Profile{}, err
+	}
+	cacheProfile(p)
+	err = saveProfiles()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = node.PublishRecord(ctx, rec)
+	if err != nil {
+		fmt.Println(err)
+	}
+	serialized, err := rec.Serialize()
+	if err != nil {
+		return Profile{}, err
+	}
+	go push(append([]byte{commands.PayloadProfile}, serialized...))
+	return p, nil
+}
+
+//SetProfile - publishes the profile of this user. Needs the root key
+func SetProfile(ctx context.Context, p Profile) (Profile, error) {
+	if !IsRoot() {
+		return Profile{}, errors.New("Only the root device can change the profile")
+	}
+	umutex.Lock()
+	key := _me.Key
+	umutex.Unlock()
+	return publishProfile(ctx, key, p, func(payload []byte) {
+		for _, contact := range Contacts() {
+			if contact.Trust == TrustBlocked || contact.Key == nil {
+				continue
+			}
+			_, err := Send(context.Background(), contact.ID, payload)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	})
+}
+
+//SetPersonaProfile - changes and publishes the profile of the persona
+func SetPersonaProfile(ctx context.Context, id []byte, p Profile) (Profile, error) {
+	key, err := personaKey(id)
+	if err != nil {
+		return Profile{}, err
+	}
+	err = changePersona(id, func(persona *Persona) error {
+		persona.Name = p.Name
+		persona.About = p.About
+		return nil
+	})
+	if err != nil {
+		return Profile{}, err
+	}
+	return publishProfile(ctx, key, p, func(payload []byte) {
+		persona, exists := GetPersona(id)
+		if !exists || len(persona.Contacts) == 0 {
+			return
+		}
+		keys := make([][]byte, len(persona.Contacts))
+		for i, contact := range persona.Contacts {
+			keys[i] = contact.Key
+		}
+		err := sendPersona(context.Background(), id, keys, nil, payload)
+		if err != nil {
+			fmt.Println(err)
+		}
+	})
+}
+
+//FetchProfile - the profile of a user or persona. A cached profile is
+//returned while it is younger than profilettl, or when fetching fails
+func FetchProfile(ctx context.Context, owner []byte) (Profile, error) {
+	cached, exists := GetProfile(owner)
+	ttl := config.AttrDuration("profilettl", time.Hour)
+	if exists && (cached.Fetched.IsZero() || time.Since(cached.Fetched) < ttl) {
+		return cached, nil
+	}
+	rec, err := node.FetchRecord(ctx, owner, commands.RecordProfile)
+	if err != nil {
+		if exists {
+			return cached, nil
+		}
+		return Profile{}, err
+	}
+	p, err := profileFromRecord(rec)
+	if err != nil {
+		return Profile{}, err
+	}
+	p.Fetched = time.Now()
+	cacheProfile(p)
+	p, _ = GetProfile(owner)
+	return p, nil
+}
+
+//handleProfilePush - a profile record from sender. Only kept if it is the
+//sender's own, or of a subscribed owner
+func handleProfilePush(sender []byte, data []byte) error {
+	rec, err := node.DeserializeRecord(data)
+	if err == nil {
+		err = rec.Verify()
+	}
+	if err != nil {
+		return err
+	}
+	p, err := profileFromRecord(rec)
+	if err != nil {
+		return err
+	}
+	owner, _ := UserOf(sender)
+	if !bytes.Equal(p.Owner, sender) && !bytes.Equal(p.Owner, owner) && !isSubscribed(p.Owner) {
+		return errors.New("Unexpected profile")
+	}
+	p.Fetched = time.Now()
+	if cacheProfile(p) {
+		return saveProfiles()
+	}
+	return nil
+}
+
+//handlePersonaProfile - a persona handler for pushed profiles
+func handlePersonaProfile(msg PersonaMessage) {
+	if len(msg.Payload) == 0 || msg.Payload[0] != commands.PayloadProfile {
+		return
+	}
+	err := handleProfilePush(msg.Sender, msg.Payload[1:])
+	if err != nil {
+		fmt.Println("profile", util.ToHexString(msg.Sender), err)
+	}
+}
+
+func isSubscribed(owner []byte) bool {
+	prmutex.Lock()
+	defer prmutex.Unlock()
+	for _, id := range _subscriptions {
+		if bytes.Equal(id, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+//Subscribe - keeps the profile of owner up to date. Handlers are called on
+//every new version
+func Subscribe(owner []byte) error {
+	if isSubscribed(owner) {
+		return nil
+	}
+	prmutex.Lock()
+	_subscriptions = append(_subscriptions, owner)
+	prmutex.Unlock()
+	go func() {
+		_, err := FetchProfile(context.Background(), owner)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	return saveProfiles()
+}
+
+//Unsubscribe -
+func Unsubscribe(owner []byte) error {
+	prmutex.Lock()
+	kept := make([][]byte, 0, len(_subscriptions))
+	for _, id := range _subscriptions {
+		if !bytes.Equal(id, owner) {
+			kept = append(kept, id)
+		}
+	}
+	_subscriptions = kept
+	prmutex.Unlock()
+	return saveProfiles()
+}
+
+//AddProfileHandler - registers a callback for new versions of profiles
+func AddProfileHandler(handler func(Profile)) {
+	prmutex.Lock()
+	_profileHandlers = append(_profileHandlers, handler)
+	prmutex.Unlock()
+}
+
+//refreshSubscriptions - fetches the subscribed profiles that are stale
+func refreshSubscriptions() {
+	prmutex.Lock()
+	subscriptions := _subscriptions
+	prmutex.Unlock()
+	changed := false
+	for _, owner := range subscriptions {
+		before, _ := GetProfile(owner)
+		p, err := FetchProfile(context.Background(), owner)
+		if err != nil {
+			continue
+		}
+		changed = changed || p.Version != before.Version || !p.Fetched.Equal(before.Fetched)
+	}
+	if changed {
+		err := saveProfiles()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+//DisplayName - what to show for a user, node or persona ID: the contact
+//name, else the cached profile name, else the start of the hex ID
+func DisplayName(id []byte) string {
+	if contact, exists := GetContact(id); exists && contact.Name != "" {
+		return contact.Name
+	}
+	if persona, exists := GetPersona(id); exists && persona.Name != "" {
+		return persona.Name
+	}
+	if p, exists := GetProfile(id); exists && p.Name != "" {
+		return p.Name
+	}
+	hex := util.ToHexString(id)
+	if len(hex) > 16 {
+		return hex[:16]
+	}
+	return hex
+}
+
+func saveProfiles() error {
+	prmutex.Lock()
+	defer prmutex.Unlock()
+	return util.SaveGob(config.Attr("profilefile"), profileState{
+		Profiles:      _profiles,
+		Subscriptions: _subscriptions,
+	})
+}
+
+func loadProfiles() error {
+	s := profileState{}
+	err := util.LoadGob(config.Attr("profilefile"), &s)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	prmutex.Lock()
+	if s.Profiles != nil {
+		_profiles = s.Profiles
+	}
+	_subscriptions = s.Subscriptions
+	prmutex.Unlock()
+	return nil
+}
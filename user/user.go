@@ -1,10 +1,318 @@
 package user
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mobchat/backup"
+	"mobchat/config"
 	"mobchat/encryption"
+	"mobchat/node"
+	"mobchat/session"
+	"mobchat/util"
+	"os"
+	"sync"
+	"time"
 )
 
+//A user is a root key that certifies the devices, each a node with its own
+//ID, the user is reachable on. The user ID is the ID of the root key. The
+//private root key stays on the device that created the user, which is the
+//one that adds and removes devices
+
+//User -
 type User struct {
-	Key      encryption.Key
+	Key      encryption.Key //root key, private part only on the root device
+	Devices  [][]byte       //node IDs certified by the root key
+	Seq      uint64         //sequence number of the device list
 	Personas []Persona
 }
+
+//state - what is persisted about this device's user
+type state struct {
+	Root     []byte //serialized public root key, nil until set up or linked
+	Devices  [][]byte
+	Seq      uint64
+	Personas []Persona
+}
+
+var (
+	_me     User
+	_linkTo []byte //user ID this device waits to be linked to
+	_fresh  bool   //the user was created on this start, a backup may replace it
+	umutex  = sync.Mutex{}
+)
+
+//ID - the user ID
+func (user *User) ID() []byte {
+	return user.Key.ID()
+}
+
+//HasDevice - whether the device is certified for the user
+func (user *User) HasDevice(id []byte) bool {
+	for _, device := range user.Devices {
+		if bytes.Equal(device, id) {
+			return true
+		}
+	}
+	return false
+}
+
+//Me - this device's user. ok is false while the device waits to be linked
+func Me() (User, bool) {
+	umutex.Lock()
+	defer umutex.Unlock()
+	return _me, _me.Key.HasPublic()
+}
+
+//IsRoot - whether this device holds the private root key
+func IsRoot() bool {
+	umutex.Lock()
+	defer umutex.Unlock()
+	return _me.Key.SignPrivate != nil || _me.Key.Private != nil
+}
+
+//Initialize - loads the user, personas, profiles and contacts, creating a
+//user with this node as only device on first start unless linkto is set.
+//Call after node.Initialize and session.Initialize
+func Initialize() error {
+	err := loadContacts()
+	if err != nil {
+		return err
+	}
+	err = loadUser()
+	if err != nil {
+		return err
+	}
+	err = loadPersonas()
+	if err != nil {
+		return err
+	}
+	err = loadProfiles()
+	if err != nil {
+		return err
+	}
+	err = loadInvites()
+	if err != nil {
+		return err
+	}
+	node.AddDeliveryFilter(acceptSender)
+	node.AddMessageHandler(handler{})
+	node.AddKeyChangeHandler(keyChanged)
+	node.AddKeyChangeHandler(deviceKeyChanged)
+	node.AddKnownIDCheck(isKnown)
+	node.AddSyncHook(publishDevicesOnce)
+	node.AddSyncHook(refreshSubscriptions)
+	node.AddShutdownHook(saveContacts)
+	node.AddShutdownHook(saveUser)
+	node.AddShutdownHook(saveProfiles)
+	AddPersonaMessageHandler(handlePersonaProfile)
+	AddPersonaMessageHandler(handlePersonaInvite)
+	session.AddHandler(handleSessionInvite)
+	backup.Register("contacts", backup.Section{Export: ExportContacts, Restore: restoreContacts})
+	backup.Register("personas", backup.Section{Export: exportPersonas, Restore: restorePersonas})
+	backup.Register("user", backup.Section{Export: exportUser, Restore: restoreUser})
+	return nil
+}
+
+func loadUser() error {
+	s := state{}
+	err := util.LoadGob(config.Attr("userfile"), &s)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.Root == nil {
+		if linkTo := config.Attr("linkto"); linkTo != "" {
+			id, err := util.FromHexString(linkTo)
+			if err != nil || len(id) != 32 {
+				return errors.New("Invalid linkto user ID")
+			}
+			umutex.Lock()
+			_linkTo = id
+			umutex.Unlock()
+			fmt.Println("waiting to be linked to user", linkTo, "as device", util.ToHexString(node.ID()))
+			return nil
+		}
+		if node.HasKey(config.Attr("userlabel")) {
+			return restoredUser()
+		}
+		return createUser()
+	}
+	root, err := encryption.Deserialize(s.Root)
+	if err != nil {
+		return err
+	}
+	label := config.Attr("userlabel")
+	if node.HasKey(label) {
+		root, err = node.LoadKey(label)
+		if err != nil {
+			return err
+		}
+	}
+	umutex.Lock()
+	_me = User{
+		Key:      root,
+		Devices:  s.Devices,
+		Seq:      s.Seq,
+		Personas: s.Personas,
+	}
+	umutex.Unlock()
+	return nil
+}
+
+//createUser - makes a root key that certifies this node
+func createUser() error {
+	root, err := encryption.GenerateEd25519()
+	if err != nil {
+		return err
+	}
+	err = node.StoreKey(config.Attr("userlabel"), root)
+	if err != nil {
+		return err
+	}
+	umutex.Lock()
+	_me = User{
+		Key:     root,
+		Devices: [][]byte{node.ID()},
+		Seq:     1,
+	}
+	_fresh = true
+	umutex.Unlock()
+	fmt.Println("created user", util.ToHexString(root.ID()))
+	return saveUser()
+}
+
+//restoredUser - sets up the user from a root key restored with
+//RestoreMnemonic. The old device list is lost, so this node starts a new one
+func restoredUser() error {
+	root, err := node.LoadKey(config.Attr("userlabel"))
+	if err != nil {
+		return err
+	}
+	umutex.Lock()
+	_me = User{
+		Key:     root,
+		Devices: [][]byte{node.ID()},
+		Seq:     uint64(time.Now().Unix()), //above what the lost root device published
+	}
+	umutex.Unlock()
+	fmt.Println("restored user", util.ToHexString(root.ID()))
+	return saveUser()
+}
+
+//Mnemonic - the root key as words for RestoreMnemonic. Only the root
+//device has it
+func Mnemonic() (string, error) {
+	umutex.Lock()
+	defer umutex.Unlock()
+	if _me.Key.SignPrivate == nil && _me.Key.Private == nil {
+		return "", errors.New("Only the root device has the root key")
+	}
+	return _me.Key.Mnemonic()
+}
+
+//RestoreMnemonic - recreates the root key from its mnemonic and stores it
+//in the keystore. Call after node.SetPassphrase and before Initialize, on a
+//device without a user
+func RestoreMnemonic(phrase string) error {
+	root, err := encryption.KeyFromMnemonic(phrase)
+	if err != nil {
+		return err
+	}
+	return node.StoreKey(config.Attr("userlabel"), root)
+}
+
+type userBackup struct {
+	ID      []byte
+	Key     []byte //from node.ExportStoredKey
+	Devices [][]byte
+	Seq     uint64
+}
+
+//exportUser - the user section of a backup with the root key. Empty on
+//devices that don't have it
+func exportUser() ([]byte, error) {
+	if !IsRoot() {
+		return nil, nil
+	}
+	key, err := node.ExportStoredKey(config.Attr("userlabel"))
+	if err != nil {
+		return nil, err
+	}
+	umutex.Lock()
+	b := userBackup{ID: _me.ID(), Key: key, Devices: _me.Devices, Seq: _me.Seq}
+	umutex.Unlock()
+	var buff bytes.Buffer
+	err = gob.NewEncoder(&buff).Encode(b)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//restoreUser - replaces the user created on this start with the backed up
+//one
+func restoreUser(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	b := userBackup{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&b)
+	if err != nil {
+		return err
+	}
+	label := config.Attr("userlabel")
+	umutex.Lock()
+	fresh := _fresh
+	same := _me.Key.HasPublic() && bytes.Equal(_me.ID(), b.ID)
+	umutex.Unlock()
+	if same {
+		return nil
+	}
+	if !fresh {
+		return errors.New("This device already has a user")
+	}
+	err = node.DeleteKey(label)
+	if err != nil {
+		return err
+	}
+	err = node.ImportKey(b.Key)
+	if err != nil {
+		return err
+	}
+	root, err := node.LoadKey(label)
+	if err != nil {
+		return err
+	}
+	umutex.Lock()
+	_me = User{
+		Key:      root,
+		Devices:  b.Devices,
+		Seq:      b.Seq,
+		Personas: _me.Personas,
+	}
+	_fresh = false
+	umutex.Unlock()
+	fmt.Println("restored user", util.ToHexString(root.ID()))
+	return saveUser()
+}
+
+func saveUser() error {
+	umutex.Lock()
+	defer umutex.Unlock()
+	s := state{
+		Devices:  _me.Devices,
+		Seq:      _me.Seq,
+		Personas: _me.Personas,
+	}
+	if _me.Key.HasPublic() {
+		pub := _me.Key.PublicKey()
+		root, err := pub.Serialize()
+		if err != nil {
+			return err
+		}
+		s.Root = root
+	}
+	return util.SaveGob(config.Attr("userfile"), s)
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"encoding/gob"
+	"os"
+)
+
+//SaveGob - gob encodes v to path. Writes to a temp file first so a crash
+//never leaves a half written file behind
+func SaveGob(path string, v interface{}) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(v)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//LoadGob - decodes a file written by SaveGob into v
+func LoadGob(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewDecoder(f).Decode(v)
+}
@@ -2,6 +2,11 @@ package util
 
 import "encoding/hex"
 
+//FromHexString - converts a hex string back to a []byte
+func FromHexString(s string) ([]byte, error) {
+	return hex.DecodeString(s)
+}
+
 //ToHexString - converts from a []byte to a hex string
 func ToHexString(data []byte) string {
 	dst := make([]byte, hex.EncodedLen(32))